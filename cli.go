@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go-certdist/common"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of go-certdist with its own flags.
+type command struct {
+	name    string
+	args    string // positional arguments shown in the usage
+	summary string
+	flags   func(fs *flag.FlagSet) // registers the command specific flags, may be nil
+	run     func(args []string)    // runs the command with the positional arguments
+	minArgs int
+	// logConfig is set by commands whose run configures logging once the config file with
+	// its log section is loaded, otherwise logging is configured before run.
+	logConfig bool
+}
+
+// globalOptions are accepted before the command and by every command.
+type globalOptions struct {
+	log common.LogConfig
+}
+
+func (o *globalOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.log.Level, "log-level", o.log.Level, "log level: trace, debug, info, warn or error")
+	fs.StringVar(&o.log.Format, "log-format", o.log.Format, "log format: console or json")
+	fs.StringVar(&o.log.Output, "log-output", o.log.Output, "log output: stdout, stderr or syslog")
+}
+
+// configureLogging applies the log configuration, overridden by the CERTDIST_LOG_*
+// environment variables and then by the flags.
+func (o *globalOptions) configureLogging(config common.LogConfig) error {
+	env, err := common.LogConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	return common.ConfigureLogger(config.Merge(env).Merge(o.log))
+}
+
+// newFlagSet returns the flag set of the command including the global options.
+func (c *command) newFlagSet(global *globalOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		_, _ = fmt.Fprintf(out, "Usage: go-certdist %s [options] %s\n\n%s\n\nOptions:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	global.register(fs)
+	return fs
+}
+
+// execute parses the arguments of the command, configures logging unless the command does
+// and runs it. Flags may be given before, between or after the positional arguments.
+func (c *command) execute(global *globalOptions, args []string) {
+	fs := c.newFlagSet(global)
+	positional, err := parseInterspersed(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(positional) < c.minArgs {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !c.logConfig {
+		if err := global.configureLogging(common.LogConfig{}); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	c.run(positional)
+}
+
+// parseInterspersed parses the flags and returns the positional arguments. Unlike
+// FlagSet.Parse it doesn't stop at the first positional argument, only at "--".
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// stringList is a flag which may be given multiple times, comma separated values are split.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
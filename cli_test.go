@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	newFlagSet := func() (*flag.FlagSet, *bool, *stringList) {
+		fs := flag.NewFlagSet("client", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		once := fs.Bool("once", false, "")
+		var domains stringList
+		fs.Var(&domains, "domain", "")
+		return fs, once, &domains
+	}
+
+	t.Run("positional only", func(t *testing.T) {
+		fs, once, _ := newFlagSet()
+		args, err := parseInterspersed(fs, []string{"client.yml"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"client.yml"}, args)
+		assert.False(t, *once)
+	})
+
+	t.Run("flags before and after positional arguments", func(t *testing.T) {
+		fs, once, domains := newFlagSet()
+		args, err := parseInterspersed(fs, []string{"--domain", "a.example.com", "client.yml", "--once", "--domain=b.example.com,c.example.com"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"client.yml"}, args)
+		assert.True(t, *once)
+		assert.Equal(t, stringList{"a.example.com", "b.example.com", "c.example.com"}, *domains)
+	})
+
+	t.Run("arguments after -- are positional", func(t *testing.T) {
+		fs, once, _ := newFlagSet()
+		args, err := parseInterspersed(fs, []string{"client.yml", "--", "--once"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"client.yml", "--once"}, args)
+		assert.False(t, *once)
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		fs, _, _ := newFlagSet()
+		_, err := parseInterspersed(fs, []string{"client.yml", "--unknown"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// artifactVersionFile stores the version of the artifact in its directory, so the server
+// only sends the files again if they changed.
+const artifactVersionFile = ".certdist-version"
+
+func processArtifactRequest(ctx context.Context, servers *serverPool, artifactConfig common.ClientArtifactConfig, force bool) error {
+	if err := recoverInstallation(ctx, artifactConfig.Directory); err != nil {
+		return err
+	}
+	versionFile := filepath.Join(artifactConfig.Directory, artifactVersionFile)
+	currentVersion := ""
+	if data, err := os.ReadFile(versionFile); err == nil && !force {
+		currentVersion = strings.TrimSpace(string(data))
+		log.Ctx(ctx).Info().Str("version", currentVersion).Msg("Found existing artifact version")
+	}
+
+	artifact, err := servers.FetchArtifact(ctx, artifactConfig.Name, currentVersion)
+	if errors.Is(err, certdist.ErrNotModified) {
+		log.Ctx(ctx).Info().Str("artifact", artifactConfig.Name).Msg("Artifact is up-to-date")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get artifact: %w", err)
+	}
+
+	// The version is installed with the files, so it is restored with them
+	write := func(staging string) error {
+		if err := artifact.WriteFiles(staging); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(staging, artifactVersionFile), []byte(artifact.Version+"\n"), 0644)
+	}
+	if err := installFiles(ctx, artifactConfig.Directory, write, verifyWrittenFiles(artifact.Files), artifactConfig.RenewCommands); err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Str("directory", artifactConfig.Directory).Str("artifact", artifactConfig.Name).Str("version", artifact.Version).Int("files", len(artifact.Files)).Msg("Successfully installed artifact")
+	return nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"go-certdist/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessArtifactRequest(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var requests []common.ArtifactRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req common.ArtifactRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+		w.Header().Set(common.ArtifactVersionHeader, "v1")
+		if req.Version == "v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		data, err := common.EncryptAndZipBundle(nil, map[string][]byte{"ticket.key": []byte("secret")}, req.AgePublicKey)
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	pool := newServerPool(common.ClientModeConfig{
+		ConnectionDetails: common.ClientConnectionConfig{Server: srv.URL},
+		AgeKey:            common.AgeKeyConfig{PublicKey: identity.Recipient().String()},
+	}, identity)
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "renewed")
+	artifactConfig := common.ClientArtifactConfig{Name: "tickets", Directory: dir, RenewCommands: []string{"touch " + marker}}
+
+	require.NoError(t, processArtifactRequest(context.Background(), pool, artifactConfig, false))
+	data, err := os.ReadFile(filepath.Join(dir, "ticket.key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+	assert.FileExists(t, marker)
+
+	// The stored version is sent with the next request, nothing is executed
+	require.NoError(t, os.Remove(marker))
+	require.NoError(t, processArtifactRequest(context.Background(), pool, artifactConfig, false))
+	require.Len(t, requests, 2)
+	assert.Equal(t, "v1", requests[1].Version)
+	assert.NoFileExists(t, marker)
+
+	// Forced requests don't send the version
+	require.NoError(t, processArtifactRequest(context.Background(), pool, artifactConfig, true))
+	require.Len(t, requests, 3)
+	assert.Empty(t, requests[2].Version)
+	assert.FileExists(t, marker)
+}
@@ -5,67 +5,87 @@ import (
 	"go-certdist/common"
 	"strings"
 
-	"filippo.io/age"
 	"github.com/rs/zerolog/log"
 )
 
-func validateConfig(config *common.ClientModeConfig) error {
-	// Validate that the server connection is configured
-	if err := validateConnectionDetails(config); err != nil {
-		return err
-	}
-
-	// Validate age public and private key
-	if err := validateAgeKeys(config); err != nil {
-		return err
-	}
+// configValidators check and normalize the configuration, in order. Later validators may
+// rely on earlier ones, e.g. on the public key derived from the private key.
+var configValidators = []func(*common.ClientModeConfig) error{
+	validateConnectionDetails,
+	validateAgeKeys,
+	validateCertificates,
+}
 
-	// Validate that at least one certificate config exists with a domain and a directory
-	if err := validateCertificates(config); err != nil {
-		return err
+func validateConfig(config *common.ClientModeConfig) error {
+	for _, validate := range configValidators {
+		if err := validate(config); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func validateConnectionDetails(config *common.ClientModeConfig) error {
-	if config.ConnectionDetails.Server == "" {
+	if config.ConnectionDetails.Server == "" && len(config.ConnectionDetails.Servers) == 0 {
 		return fmt.Errorf("connection.server is not configured")
 	}
 
-	if strings.HasPrefix(config.ConnectionDetails.Server, "http://") {
-		log.Warn().Str("server", config.ConnectionDetails.Server).Msg("Using insecure HTTP connection")
-	} else if !strings.HasPrefix(config.ConnectionDetails.Server, "https://") {
-		config.ConnectionDetails.Server = "https://" + config.ConnectionDetails.Server
-		log.Info().Str("server", config.ConnectionDetails.Server).Msg("Unknown protocol, assuming HTTPs")
+	if config.ConnectionDetails.Server != "" {
+		config.ConnectionDetails.Server = normalizeServerURL(config.ConnectionDetails.Server)
 	}
-
-	if strings.HasSuffix(config.ConnectionDetails.Server, "/") {
-		config.ConnectionDetails.Server = config.ConnectionDetails.Server[:len(config.ConnectionDetails.Server)-1]
+	for i, server := range config.ConnectionDetails.Servers {
+		if server == "" {
+			return fmt.Errorf("connection.servers %d is empty", i)
+		}
+		config.ConnectionDetails.Servers[i] = normalizeServerURL(server)
 	}
 	return nil
 }
 
+func normalizeServerURL(server string) string {
+	if strings.HasPrefix(server, "http://") {
+		log.Warn().Str("server", server).Msg("Using insecure HTTP connection")
+	} else if !strings.HasPrefix(server, "https://") {
+		server = "https://" + server
+		log.Info().Str("server", server).Msg("Unknown protocol, assuming HTTPs")
+	}
+
+	return strings.TrimSuffix(server, "/")
+}
+
 func validateAgeKeys(config *common.ClientModeConfig) error {
-	if config.AgeKey.PrivateKey == "" {
-		return fmt.Errorf("age_key.private_key is not configured")
+	configured := 0
+	for _, key := range []string{config.AgeKey.PrivateKey, config.AgeKey.PrivateKeyFile, config.AgeKey.SSHKeyFile} {
+		if key != "" {
+			configured++
+		}
+	}
+	if configured == 0 {
+		return fmt.Errorf("neither age_key.private_key, age_key.private_key_file nor age_key.ssh_key_file is configured")
+	}
+	if configured > 1 {
+		return fmt.Errorf("only one of age_key.private_key, age_key.private_key_file and age_key.ssh_key_file may be configured")
+	}
+	if config.AgeKey.PrivateKeyFile == "" && (config.AgeKey.PassphraseFile != "" || config.AgeKey.PassphraseCredential != "") {
+		return fmt.Errorf("age_key.passphrase_file and age_key.passphrase_credential require age_key.private_key_file")
 	}
 
-	identity, err := age.ParseX25519Identity(config.AgeKey.PrivateKey)
+	_, publicKey, err := common.LoadAgeIdentity(config.AgeKey)
 	if err != nil {
-		return fmt.Errorf("invalid age_key.private_key: %w", err)
+		return fmt.Errorf("invalid age_key: %w", err)
 	}
 
 	if config.AgeKey.PublicKey == "" { // auto-create public key if not provided
-		config.AgeKey.PublicKey = identity.Recipient().String()
+		config.AgeKey.PublicKey = publicKey
 	}
-	if identity.Recipient().String() != config.AgeKey.PublicKey {
+	if common.NormalizePublicKey(config.AgeKey.PublicKey) != publicKey {
 		return fmt.Errorf("Public key does not correspond to the private key")
 	}
 	return nil
 }
 
 func validateCertificates(config *common.ClientModeConfig) error {
-	if len(config.Certificate) == 0 {
+	if len(config.Certificate) == 0 && len(config.Artifacts) == 0 {
 		return fmt.Errorf("at least one certificate must be configured")
 	}
 
@@ -76,6 +96,21 @@ func validateCertificates(config *common.ClientModeConfig) error {
 		if certConfig.Directory == "" {
 			return fmt.Errorf("certificate %d: directory is not configured for domain %s", i, certConfig.Domain)
 		}
+		if certConfig.KeyRotationDays < 0 {
+			return fmt.Errorf("certificate %d: key_rotation_days must not be negative", i)
+		}
+		if certConfig.KeyRotationDays > 0 && !certConfig.CSR {
+			return fmt.Errorf("certificate %d: key_rotation_days requires csr", i)
+		}
+	}
+
+	for i, artifactConfig := range config.Artifacts {
+		if artifactConfig.Name == "" {
+			return fmt.Errorf("artifact %d: name is not configured", i)
+		}
+		if artifactConfig.Directory == "" {
+			return fmt.Errorf("artifact %d: directory is not configured for artifact %s", i, artifactConfig.Name)
+		}
 	}
 	return nil
 }
@@ -62,6 +62,31 @@ func TestValidateConnectionDetails(t *testing.T) {
 		assert.NoError(t, validateConnectionDetails(config))
 		assert.Equal(t, "http://example.com", config.ConnectionDetails.Server)
 	})
+
+	t.Run("multiple servers", func(t *testing.T) {
+		config := &common.ClientModeConfig{
+			ConnectionDetails: common.ClientConnectionConfig{
+				Server:  "https://primary.example.com",
+				Servers: []string{"replica.example.com/", "https://primary.example.com"},
+			},
+		}
+		assert.NoError(t, validateConnectionDetails(config))
+		assert.Equal(t, []string{"https://primary.example.com", "https://replica.example.com"}, config.ConnectionDetails.ServerURLs())
+	})
+
+	t.Run("servers only", func(t *testing.T) {
+		config := &common.ClientModeConfig{
+			ConnectionDetails: common.ClientConnectionConfig{
+				Servers: []string{"https://replica.example.com"},
+			},
+		}
+		assert.NoError(t, validateConnectionDetails(config))
+	})
+
+	t.Run("no server", func(t *testing.T) {
+		config := &common.ClientModeConfig{}
+		assert.Error(t, validateConnectionDetails(config))
+	})
 }
 
 func TestValidateCertificates(t *testing.T) {
@@ -77,3 +102,30 @@ func TestValidateCertificates(t *testing.T) {
 		assert.NoError(t, validateCertificates(config))
 	})
 }
+
+func TestValidateAgeKeysSSH(t *testing.T) {
+	keyPath, sshPublicKey := common.NewSSHTestKey(t, t.TempDir())
+
+	t.Run("ssh key file", func(t *testing.T) {
+		config := &common.ClientModeConfig{
+			AgeKey: common.AgeKeyConfig{SSHKeyFile: keyPath},
+		}
+		assert.NoError(t, validateAgeKeys(config))
+		assert.Equal(t, common.NormalizePublicKey(sshPublicKey), config.AgeKey.PublicKey)
+	})
+
+	t.Run("ssh public key with comment", func(t *testing.T) {
+		config := &common.ClientModeConfig{
+			AgeKey: common.AgeKeyConfig{SSHKeyFile: keyPath, PublicKey: sshPublicKey},
+		}
+		assert.NoError(t, validateAgeKeys(config))
+	})
+
+	t.Run("both private key and ssh key file", func(t *testing.T) {
+		privateKey, _ := common.NewAgeTestKey(t)
+		config := &common.ClientModeConfig{
+			AgeKey: common.AgeKeyConfig{SSHKeyFile: keyPath, PrivateKey: privateKey},
+		}
+		assert.Error(t, validateAgeKeys(config))
+	})
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const privateKeyFile = "privkey.pem"
+
+// nextPrivateKeyFile holds a new key until the server signed a certificate for it, so the
+// key in use always matches the certificate.
+const nextPrivateKeyFile = "privkey.pem.next"
+
+// processCSRRequest requests a certificate for the key kept in the directory. The key
+// never leaves the client, the server only signs a CSR for it.
+func processCSRRequest(ctx context.Context, servers *serverPool, certConfig common.CertificateConfig, force bool) error {
+	key, rotated, err := loadCSRKey(certConfig)
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %w", err)
+	}
+	if !force && !rotated && !certificateNeedsRenewal(certConfig.Directory, key) {
+		log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Msg("Certificate is up-to-date")
+		return nil
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: certConfig.Domain},
+		DNSNames: []string{certConfig.Domain},
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	bundle, err := servers.Do(ctx, certdist.Request{
+		Domain: certConfig.Domain,
+		CSR:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get certificate: %w", err)
+	}
+	if !samePublicKey(bundle.Certificate.PublicKey, key.Public()) {
+		return fmt.Errorf("server returned a certificate for another key")
+	}
+
+	log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Time("expiration", bundle.Certificate.NotAfter).Msg("Successfully received signed certificate")
+
+	// A new key is installed together with its certificate
+	delete(bundle.Files, privateKeyFile)
+	nextKey := filepath.Join(certConfig.Directory, nextPrivateKeyFile)
+	write := func(staging string) error {
+		if err := bundle.WriteFiles(staging); err != nil {
+			return err
+		}
+		if rotated {
+			return copyFile(nextKey, filepath.Join(staging, privateKeyFile))
+		}
+		return nil
+	}
+	if err := installFiles(ctx, certConfig.Directory, write, verifyBundleFiles(bundle, key.Public()), certConfig.RenewCommands); err != nil {
+		return err
+	}
+	if rotated {
+		if err := os.Remove(nextKey); err != nil {
+			return fmt.Errorf("failed to remove installed private key: %w", err)
+		}
+		log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Msg("Installed new private key")
+	}
+	log.Ctx(ctx).Info().Str("directory", certConfig.Directory).Str("domain", certConfig.Domain).Msg("Successfully installed certificate")
+	return nil
+}
+
+// loadCSRKey returns the key to request the certificate for. A new key is generated if
+// there is none or the current one is due for rotation, rotated reports whether the key
+// still has to be installed.
+func loadCSRKey(certConfig common.CertificateConfig) (key crypto.Signer, rotated bool, err error) {
+	current := filepath.Join(certConfig.Directory, privateKeyFile)
+	info, err := os.Stat(current)
+	if err == nil && !keyRotationDue(certConfig, info.ModTime()) {
+		key, err := common.ReadPrivateKeyFile(current)
+		return key, false, err
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	// A pending key is reused until the server signed a certificate for it
+	next := filepath.Join(certConfig.Directory, nextPrivateKeyFile)
+	if _, err := os.Stat(next); err == nil {
+		key, err := common.ReadPrivateKeyFile(next)
+		return key, true, err
+	}
+
+	log.Info().Str("domain", certConfig.Domain).Msg("Generating new private key")
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(newKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(certConfig.Directory, 0755); err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(next, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, false, err
+	}
+	return newKey, true, nil
+}
+
+func keyRotationDue(certConfig common.CertificateConfig, created time.Time) bool {
+	if certConfig.KeyRotationDays <= 0 {
+		return false
+	}
+	return time.Since(created) >= time.Duration(certConfig.KeyRotationDays)*24*time.Hour
+}
+
+// certificateNeedsRenewal reports whether the certificate in the directory is missing, for
+// another key or in the last third of its validity.
+func certificateNeedsRenewal(dir string, key crypto.Signer) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	if err != nil {
+		return true
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || !samePublicKey(cert.PublicKey, key.Public()) {
+		return true
+	}
+	renewAt := cert.NotAfter.Add(-cert.NotAfter.Sub(cert.NotBefore) / 3)
+	return !time.Now().Before(renewAt)
+}
+
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"go-certdist/common"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSigningServer signs the CSR of every request with a throwaway CA, it fails while
+// failing is set.
+func newTestSigningServer(t *testing.T, failing *atomic.Bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != common.CertificateRequestEndpoint {
+			http.NotFound(w, r)
+			return
+		}
+		requests.Add(1)
+		if failing.Load() {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		var req common.CertificateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		block, _ := pem.Decode([]byte(req.CSR))
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+		require.NoError(t, err)
+		files := map[string][]byte{"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+		data, err := common.EncryptAndZipBundle(nil, files, req.AgePublicKey)
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestProcessCSRRequest(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var failing atomic.Bool
+	srv, requests := newTestSigningServer(t, &failing)
+	pool := newServerPool(common.ClientModeConfig{
+		ConnectionDetails: common.ClientConnectionConfig{Server: srv.URL},
+		AgeKey:            common.AgeKeyConfig{PublicKey: identity.Recipient().String()},
+	}, identity)
+	dir := t.TempDir()
+	certConfig := common.CertificateConfig{Domain: "db.internal", Directory: dir, CSR: true, KeyRotationDays: 30}
+
+	require.NoError(t, processCertificateRequest(context.Background(), pool, certConfig, false))
+	key, err := common.ReadPrivateKeyFile(filepath.Join(dir, privateKeyFile))
+	require.NoError(t, err)
+	assert.False(t, certificateNeedsRenewal(dir, key))
+	assert.NoFileExists(t, filepath.Join(dir, nextPrivateKeyFile))
+
+	// The certificate is still fresh, the server is not asked
+	require.NoError(t, processCertificateRequest(context.Background(), pool, certConfig, false))
+	assert.EqualValues(t, 1, requests.Load())
+
+	// A rotated key is kept pending until the server signed a certificate for it
+	old := time.Now().Add(-31 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, privateKeyFile), old, old))
+	failing.Store(true)
+	assert.Error(t, processCertificateRequest(context.Background(), pool, certConfig, false))
+	pending, err := common.ReadPrivateKeyFile(filepath.Join(dir, nextPrivateKeyFile))
+	require.NoError(t, err)
+	current, err := common.ReadPrivateKeyFile(filepath.Join(dir, privateKeyFile))
+	require.NoError(t, err)
+	assert.True(t, samePublicKey(key.Public(), current.Public()))
+
+	failing.Store(false)
+	require.NoError(t, processCertificateRequest(context.Background(), pool, certConfig, false))
+	current, err = common.ReadPrivateKeyFile(filepath.Join(dir, privateKeyFile))
+	require.NoError(t, err)
+	assert.True(t, samePublicKey(pending.Public(), current.Public()))
+	assert.False(t, certificateNeedsRenewal(dir, current))
+	assert.NoFileExists(t, filepath.Join(dir, nextPrivateKeyFile))
+}
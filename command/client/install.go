@@ -0,0 +1,326 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"go-certdist/pkg/certdist"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// previousDirectory keeps the files replaced by the last installation, so they can be
+// restored if a renew command fails or by hand.
+const previousDirectory = ".certdist-previous"
+
+// installJournalFile records an installation in progress. The files are moved one by one,
+// if the client stops in between, the previous files are restored on the next run, before
+// the current certificate is checked.
+const installJournalFile = ".certdist-install.json"
+
+// stagingPattern names the directories new files are written to before they are moved
+// into place. They are on the same file system, so the moves are atomic renames.
+const stagingPattern = ".certdist-staging-*"
+
+// installFiles writes new files with write to a staging directory next to the live files,
+// verifies them, keeps the files they replace in .certdist-previous and moves them into
+// dir. If a renew command fails, the previous files are restored and the renew commands
+// run again, so services reload the files that worked before.
+//
+// Only the files are replaced atomically, not the set of them: the journal recovers from
+// interruptions, but a reader can see a mix of old and new files while they are moved.
+// Services should only reload the files in the renew commands.
+func installFiles(ctx context.Context, dir string, write func(staging string) error, verify func(staging string) error, renewCommands []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := recoverInstallation(ctx, dir); err != nil {
+		return err
+	}
+	// Left behind if the client was killed during an installation
+	leftovers, _ := filepath.Glob(filepath.Join(dir, stagingPattern))
+	for _, leftover := range leftovers {
+		_ = os.RemoveAll(leftover)
+	}
+
+	staging, err := os.MkdirTemp(dir, stagingPattern)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(staging) }()
+	if err := write(staging); err != nil {
+		return fmt.Errorf("failed to write files: %w", err)
+	}
+	names, err := syncFiles(staging)
+	if err != nil {
+		return fmt.Errorf("failed to write files: %w", err)
+	}
+	if verify != nil {
+		if err := verify(staging); err != nil {
+			return fmt.Errorf("verification of the new files failed, keeping the current files: %w", err)
+		}
+	}
+
+	previous, err := backupFiles(dir, names)
+	if err != nil {
+		return fmt.Errorf("failed to keep the current files: %w", err)
+	}
+	journal := installJournal{Names: names, Previous: previous}
+	if err := writeInstallJournal(dir, journal); err != nil {
+		return fmt.Errorf("failed to write installation journal: %w", err)
+	}
+	if err := moveFiles(staging, dir, names); err != nil {
+		// The journal stays if restoring fails, so the next run tries again
+		if restoreErr := restoreFiles(dir, journal); restoreErr != nil {
+			log.Ctx(ctx).Error().Err(restoreErr).Str("directory", dir).Msg("Failed to restore previous files")
+		}
+		return fmt.Errorf("failed to install files: %w", err)
+	}
+	if err := removeInstallJournal(dir); err != nil {
+		return err
+	}
+
+	if err := executeRenewCommands(renewCommands); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("directory", dir).Msg("Renew command failed, restoring previous files")
+		if len(previous) == 0 {
+			return fmt.Errorf("failed to execute one or more renew commands, no previous files to restore: %w", err)
+		}
+		if err := writeInstallJournal(dir, journal); err != nil {
+			return fmt.Errorf("failed to write installation journal: %w", err)
+		}
+		if restoreErr := restoreFiles(dir, journal); restoreErr != nil {
+			return fmt.Errorf("failed to execute one or more renew commands: %w, failed to restore previous files: %w", err, restoreErr)
+		}
+		if rerunErr := executeRenewCommands(renewCommands); rerunErr != nil {
+			log.Ctx(ctx).Error().Err(rerunErr).Str("directory", dir).Msg("Renew command failed with the previous files")
+		}
+		return fmt.Errorf("failed to execute one or more renew commands, restored previous files: %w", err)
+	}
+	return nil
+}
+
+// installJournal lists the files of an installation and which of them existed before.
+type installJournal struct {
+	Names    []string `json:"names"`
+	Previous []string `json:"previous"`
+}
+
+// recoverInstallation restores the previous files if an installation into dir was
+// interrupted, so the certificate and key in dir belong together again.
+func recoverInstallation(ctx context.Context, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, installJournalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var journal installJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return fmt.Errorf("invalid installation journal in %s: %w", dir, err)
+	}
+	log.Ctx(ctx).Warn().Str("directory", dir).Msg("Previous installation was interrupted, restoring previous files")
+	if err := restoreFiles(dir, journal); err != nil {
+		return fmt.Errorf("failed to restore previous files: %w", err)
+	}
+	return nil
+}
+
+// writeInstallJournal writes the journal atomically before files are moved.
+func writeInstallJournal(dir string, journal installJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, stagingPattern)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(file.Name()) }()
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, installJournalFile))
+}
+
+func removeInstallJournal(dir string) error {
+	if err := os.Remove(filepath.Join(dir, installJournalFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// syncFiles flushes the files in the directory to disk and returns their names.
+func syncFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		err = file.Sync()
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// backupFiles replaces .certdist-previous with copies of the files about to be replaced and
+// returns their names. If none of them exists, the last backup is kept.
+func backupFiles(dir string, names []string) ([]string, error) {
+	var existing []string
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			existing = append(existing, name)
+		}
+	}
+	if len(existing) == 0 {
+		return nil, nil
+	}
+
+	backup, err := os.MkdirTemp(dir, stagingPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(backup) }()
+	for _, name := range existing {
+		if err := copyFile(filepath.Join(dir, name), filepath.Join(backup, name)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := syncFiles(backup); err != nil {
+		return nil, err
+	}
+
+	previous := filepath.Join(dir, previousDirectory)
+	if err := os.RemoveAll(previous); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(backup, previous); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// rename is replaced in tests to interrupt installations.
+var rename = os.Rename
+
+// moveFiles renames the files from the staging directory into dir. Each file is replaced
+// atomically, the set of files is not; the installation journal only allows rolling back
+// an interrupted move.
+func moveFiles(staging string, dir string, names []string) error {
+	for _, name := range names {
+		if err := rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFiles puts the files kept in .certdist-previous back, removes installed files
+// which didn't exist before and then the journal. It can be repeated if it was interrupted.
+func restoreFiles(dir string, journal installJournal) error {
+	staging, err := os.MkdirTemp(dir, stagingPattern)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(staging) }()
+	for _, name := range journal.Previous {
+		if err := copyFile(filepath.Join(dir, previousDirectory, name), filepath.Join(staging, name)); err != nil {
+			return err
+		}
+	}
+	if err := moveFiles(staging, dir, journal.Previous); err != nil {
+		return err
+	}
+	for _, name := range journal.Names {
+		if !slices.Contains(journal.Previous, name) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return removeInstallJournal(dir)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// verifyWrittenFiles checks that the staged files are complete copies of the files.
+func verifyWrittenFiles(files map[string][]byte) func(staging string) error {
+	return func(staging string) error {
+		for name, data := range files {
+			written, err := os.ReadFile(filepath.Join(staging, name))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(written, data) {
+				return fmt.Errorf("%s was not written completely", name)
+			}
+		}
+		return nil
+	}
+}
+
+// verifyBundleFiles checks the staged files of the bundle, and that its certificate is valid
+// and belongs to the private key, the one of the bundle if key is nil.
+func verifyBundleFiles(bundle *certdist.Bundle, key crypto.PublicKey) func(staging string) error {
+	return func(staging string) error {
+		if err := verifyWrittenFiles(bundle.Files)(staging); err != nil {
+			return err
+		}
+		if time.Now().After(bundle.Certificate.NotAfter) {
+			return fmt.Errorf("certificate expired at %s", bundle.Certificate.NotAfter.Format(time.RFC3339))
+		}
+		if signer, ok := bundle.PrivateKey.(crypto.Signer); key == nil && ok {
+			key = signer.Public()
+		}
+		if key != nil && !samePublicKey(bundle.Certificate.PublicKey, key) {
+			return fmt.Errorf("certificate does not belong to the private key")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestFiles returns a write function for installFiles writing the files.
+func writeTestFiles(files map[string]string) func(staging string) error {
+	return func(staging string) error {
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(staging, name), []byte(data), 0600); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestInstallFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "example.com")
+	ctx := context.Background()
+
+	require.NoError(t, installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "old cert", "privkey.pem": "old key"}), nil, nil))
+	require.NoError(t, installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "new cert", "privkey.pem": "new key"}), nil, nil))
+
+	assert.Equal(t, "new cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+	assert.Equal(t, "new key", readTestFile(t, filepath.Join(dir, "privkey.pem")))
+	assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, previousDirectory, "cert.pem")))
+	assert.Equal(t, "old key", readTestFile(t, filepath.Join(dir, previousDirectory, "privkey.pem")))
+	info, err := os.Stat(filepath.Join(dir, previousDirectory, "privkey.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	staging, _ := filepath.Glob(filepath.Join(dir, stagingPattern))
+	assert.Empty(t, staging)
+}
+
+func TestInstallFilesRestoresOnRenewFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "example.com")
+	ctx := context.Background()
+	runs := filepath.Join(t.TempDir(), "runs")
+	require.NoError(t, installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "old cert"}), nil, nil))
+
+	// The reload fails with the new certificate, but works with the previous one
+	renewCommands := []string{
+		"echo run >> " + runs,
+		fmt.Sprintf("! grep -q new %s", filepath.Join(dir, "cert.pem")),
+	}
+	err := installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "new cert", "chain.pem": "new chain"}), nil, renewCommands)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "restored previous files")
+
+	assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+	assert.NoFileExists(t, filepath.Join(dir, "chain.pem"))
+	assert.Equal(t, 2, strings.Count(readTestFile(t, runs), "run"), "renew commands run again after restoring")
+}
+
+func TestInstallFilesKeepsFilesOnFailedVerification(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "example.com")
+	ctx := context.Background()
+	require.NoError(t, installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "old cert"}), nil, nil))
+
+	verify := func(staging string) error { return errors.New("key mismatch") }
+	err := installFiles(ctx, dir, writeTestFiles(map[string]string{"cert.pem": "new cert"}), verify, []string{"exit 1"})
+	assert.ErrorContains(t, err, "key mismatch")
+	assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+
+	// Incomplete files are detected
+	truncated := writeTestFiles(map[string]string{"cert.pem": "new"})
+	err = installFiles(ctx, dir, truncated, verifyWrittenFiles(map[string][]byte{"cert.pem": []byte("new cert")}), nil)
+	assert.ErrorContains(t, err, "not written completely")
+	assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+}
+
+// failRenamesAfter makes all but the first n renames fail, like a crash or full disk during
+// an installation.
+func failRenamesAfter(t *testing.T, n int) {
+	t.Helper()
+	calls := 0
+	rename = func(oldpath, newpath string) error {
+		calls++
+		if calls > n {
+			return errors.New("disk error")
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+func TestInstallFilesInterrupted(t *testing.T) {
+	ctx := context.Background()
+	oldFiles := map[string]string{"cert.pem": "old cert", "privkey.pem": "old key"}
+	newFiles := map[string]string{"cert.pem": "new cert", "privkey.pem": "new key", "chain.pem": "new chain"}
+
+	t.Run("restored immediately", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "example.com")
+		require.NoError(t, installFiles(ctx, dir, writeTestFiles(oldFiles), nil, nil))
+
+		calls := 0
+		rename = func(oldpath, newpath string) error {
+			calls++
+			if calls == 2 {
+				return errors.New("disk error")
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		t.Cleanup(func() { rename = os.Rename })
+
+		assert.ErrorContains(t, installFiles(ctx, dir, writeTestFiles(newFiles), nil, nil), "disk error")
+		assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+		assert.Equal(t, "old key", readTestFile(t, filepath.Join(dir, "privkey.pem")))
+		assert.NoFileExists(t, filepath.Join(dir, "chain.pem"))
+		assert.NoFileExists(t, filepath.Join(dir, installJournalFile))
+	})
+
+	t.Run("restored on the next run", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "example.com")
+		require.NoError(t, installFiles(ctx, dir, writeTestFiles(oldFiles), nil, nil))
+
+		// Only the first file is moved and restoring fails too, the certificate and the
+		// key don't match until the next run
+		failRenamesAfter(t, 1)
+		assert.Error(t, installFiles(ctx, dir, writeTestFiles(newFiles), nil, nil))
+		assert.FileExists(t, filepath.Join(dir, installJournalFile))
+		rename = os.Rename
+
+		require.NoError(t, recoverInstallation(ctx, dir))
+		assert.Equal(t, "old cert", readTestFile(t, filepath.Join(dir, "cert.pem")))
+		assert.Equal(t, "old key", readTestFile(t, filepath.Join(dir, "privkey.pem")))
+		assert.NoFileExists(t, filepath.Join(dir, "chain.pem"))
+		assert.NoFileExists(t, filepath.Join(dir, installJournalFile))
+
+		// The next installation works as usual
+		require.NoError(t, installFiles(ctx, dir, writeTestFiles(newFiles), nil, nil))
+		assert.Equal(t, "new key", readTestFile(t, filepath.Join(dir, "privkey.pem")))
+	})
+}
@@ -1,34 +1,59 @@
 package client
 
 import (
-	"archive/zip"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"go-certdist/common"
-	"io"
-	"net/http"
+	"go-certdist/pkg/certdist"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"slices"
 	"strings"
-	"time"
 
-	"filippo.io/age"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func ExecuteClient(config common.ClientModeConfig) {
+// Options change a single invocation of the client without editing its configuration.
+type Options struct {
+	Once    bool     // exit after one run even if interval_hours is configured
+	Force   bool     // request certificates and artifacts even if they are up-to-date
+	Domains []string // only request these domains and no artifacts, empty means all
+}
+
+func ExecuteClient(config common.ClientModeConfig, options Options) {
 	if err := validateConfig(&config); err != nil {
 		log.Fatal().Err(err).Msg("Client configuration validation failed")
 	}
+	if err := applyOptions(&config, options); err != nil {
+		log.Fatal().Err(err).Msg("Invalid client options")
+	}
+	identity, _, err := common.LoadAgeIdentity(config.AgeKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load age key")
+	}
 
+	ctx := context.Background()
+	knownVersions := make(map[string]string)
 	for {
+		servers := newServerPool(config, identity)
+		servers.Order(ctx)
+		logServerInfo(ctx, servers.Primary())
 		for _, certConfig := range config.Certificate {
 			log.Info().Msg("==================================================================")
-			log.Info().Str("server", config.ConnectionDetails.Server).Str("domain", certConfig.Domain).Msg("Requesting certificate from server")
-			if err := processCertificateRequest(config, certConfig); err != nil {
-				log.Error().Err(err).Str("domain", certConfig.Domain).Msg("Failed to process certificate request")
+			reqCtx, logCtx := withRequestID(ctx)
+			logCtx.Info().Str("server", servers.Primary().ServerURL).Str("domain", certConfig.Domain).Msg("Requesting certificate from server")
+			if err := processCertificateRequest(reqCtx, servers, certConfig, options.Force); err != nil {
+				logCtx.Error().Err(err).Str("domain", certConfig.Domain).Msg("Failed to process certificate request")
+			}
+		}
+		for _, artifactConfig := range config.Artifacts {
+			log.Info().Msg("==================================================================")
+			reqCtx, logCtx := withRequestID(ctx)
+			logCtx.Info().Str("server", servers.Primary().ServerURL).Str("artifact", artifactConfig.Name).Msg("Requesting artifact from server")
+			if err := processArtifactRequest(reqCtx, servers, artifactConfig, options.Force); err != nil {
+				logCtx.Error().Err(err).Str("artifact", artifactConfig.Name).Msg("Failed to process artifact request")
 			}
 		}
 
@@ -36,94 +61,99 @@ func ExecuteClient(config common.ClientModeConfig) {
 			log.Info().Msg("IntervalHours not configured, exiting after single execution")
 			break
 		}
+		if options.Once {
+			log.Info().Msg("Exiting after single execution as requested")
+			break
+		}
+		options.Force = false // only the first run is forced
 
-		waitDuration := time.Duration(config.IntervalHours) * time.Hour
-		log.Info().Int("hours", config.IntervalHours).Msg("Waiting until next execution")
-		time.Sleep(waitDuration)
+		waitForNextRun(ctx, config, servers, knownVersions)
 	}
 }
 
-func processCertificateRequest(config common.ClientModeConfig, certConfig common.CertificateConfig) error {
-	// Check for existing certificate and its expiration date
-	var expirationDate time.Time
-	if _, err := os.Stat(certConfig.Directory); !os.IsNotExist(err) {
-		log.Info().Str("directory", certConfig.Directory).Msg("Checking existing certificates")
-		existingCerts := common.LoadCertificates([]string{certConfig.Directory})
-		foundCerts := common.FindCertificate(existingCerts, certConfig.Domain)
-		if len(foundCerts) > 0 {
-			expirationDate = foundCerts[0].Expiration
-			log.Info().Time("expiration", expirationDate).Msg("Found existing certificate expiration date")
-		}
-	}
-
-	resp, err := sendRequestToServer(config, certConfig, expirationDate)
-	if err != nil {
-		return fmt.Errorf("failed to send certificate request: %w", err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to close response body")
-		}
-	}(resp.Body)
+// withRequestID returns a context whose requests send a new request ID to the server, and
+// the logger logging the ID, which is also kept in the context for log.Ctx.
+func withRequestID(ctx context.Context) (context.Context, *zerolog.Logger) {
+	reqID := certdist.NewRequestID()
+	logCtx := log.With().Str(common.LogKeyRequestId, reqID).Logger()
+	ctx = certdist.WithRequestID(ctx, reqID)
+	return logCtx.WithContext(ctx), &logCtx
+}
 
-	if resp.StatusCode == http.StatusNotModified {
-		log.Info().Str("domain", certConfig.Domain).Msg("Certificate is up-to-date")
+// applyOptions restricts the configuration to the requested domains.
+func applyOptions(config *common.ClientModeConfig, options Options) error {
+	if len(options.Domains) == 0 {
 		return nil
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to get certificate with status %d: %s", resp.StatusCode, string(body))
+	var certificates []common.CertificateConfig
+	for _, domain := range options.Domains {
+		i := slices.IndexFunc(config.Certificate, func(certConfig common.CertificateConfig) bool {
+			return certConfig.Domain == domain
+		})
+		if i < 0 {
+			return fmt.Errorf("domain %s is not configured", domain)
+		}
+		certificates = append(certificates, config.Certificate[i])
 	}
+	config.Certificate = certificates
+	config.Artifacts = nil
+	return nil
+}
 
-	encryptedData, err := io.ReadAll(resp.Body)
+// logServerInfo logs the version of the server, which also negotiates the API version.
+func logServerInfo(ctx context.Context, client *certdist.Client) {
+	info, err := client.Info(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		log.Info().Err(err).Str("server", client.ServerURL).Msg("Server does not report its version, using API v1")
+		return
 	}
+	log.Info().Str("server", client.ServerURL).Str("version", info.Version).Str("api", client.APIVersion(ctx)).Strs("features", info.Features).Msg("Connected to server")
+}
 
-	// 3. Decrypt the data
-	decryptedData, err := decryptWithAge(encryptedData, config.AgeKey.PrivateKey)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt data: %w", err)
+// processCertificateRequest requests the certificate unless the server reports the existing
+// one as up-to-date. Forced requests don't report the existing certificate, so the server
+// always sends it.
+func processCertificateRequest(ctx context.Context, servers *serverPool, certConfig common.CertificateConfig, force bool) error {
+	if err := recoverInstallation(ctx, certConfig.Directory); err != nil {
+		return err
 	}
-
-	// 4. Unzip the decrypted data
-	if err := unzip(decryptedData, certConfig.Directory); err != nil {
-		return fmt.Errorf("failed to unzip data: %w", err)
+	if certConfig.CSR {
+		return processCSRRequest(ctx, servers, certConfig, force)
 	}
 
-	log.Info().Str("directory", certConfig.Directory).Str("domain", certConfig.Domain).Msg("Successfully downloaded and extracted certificates")
-
-	// 5. Execute renew commands
-	if err := executeRenewCommands(certConfig.RenewCommands); err != nil {
-		return fmt.Errorf("failed to execute one or more renew commands: %w", err)
+	// Check for existing certificate and its expiration date
+	request := certdist.Request{Domain: certConfig.Domain, OCSP: true}
+	if _, err := os.Stat(certConfig.Directory); !force && !os.IsNotExist(err) {
+		log.Ctx(ctx).Info().Str("directory", certConfig.Directory).Msg("Checking existing certificates")
+		existingCerts := common.LoadCertificates([]string{certConfig.Directory})
+		existingCert := common.PrimaryCertificate(common.FindCertificate(existingCerts, certConfig.Domain))
+		if existingCert != nil {
+			log.Ctx(ctx).Info().Time("expiration", existingCert.Expiration).Str("serial", existingCert.SerialNumber).Msg("Found existing certificate expiration date")
+			request.CurrentExpiry = existingCert.Expiration
+			request.CurrentSerial = existingCert.SerialNumber
+		}
+		request.CurrentOCSPUpdate = common.OCSPThisUpdate(certConfig.Directory)
 	}
 
-	return nil
-}
-
-func sendRequestToServer(config common.ClientModeConfig, certConfig common.CertificateConfig, expirationDate time.Time) (*http.Response, error) {
-	// 1. Prepare the request body
-	reqBody := common.CertificateRequest{
-		Domain:       certConfig.Domain,
-		AgePublicKey: config.AgeKey.PublicKey,
-		Expiration:   expirationDate,
+	bundle, err := servers.Do(ctx, request)
+	if errors.Is(err, certdist.ErrNotModified) {
+		log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Msg("Certificate is up-to-date")
+		return nil
 	}
-	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to get certificate: %w", err)
 	}
 
-	// 2. Send the POST request
-	url := fmt.Sprintf("%s%s", config.ConnectionDetails.Server, common.CertificateRequestEndpoint)
-	log.Debug().Str("url", url).Msg("Sending request to server")
+	log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Time("expiration", bundle.Certificate.NotAfter).Msg("Successfully downloaded certificates")
+	if bundle.OCSP != nil {
+		log.Ctx(ctx).Info().Str("domain", certConfig.Domain).Time("this_update", bundle.OCSP.ThisUpdate).Time("next_update", bundle.OCSP.NextUpdate).Msg("Received OCSP response")
+	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
+	if err := installFiles(ctx, certConfig.Directory, bundle.WriteFiles, verifyBundleFiles(bundle, nil), certConfig.RenewCommands); err != nil {
+		return err
 	}
-	return resp, nil
+	log.Ctx(ctx).Info().Str("directory", certConfig.Directory).Str("domain", certConfig.Domain).Msg("Successfully installed certificates")
+	return nil
 }
 
 func executeRenewCommands(commands []string) error {
@@ -144,75 +174,3 @@ func executeRenewCommands(commands []string) error {
 	}
 	return nil
 }
-
-func decryptWithAge(data []byte, privateKey string) ([]byte, error) {
-	identity, err := age.ParseX25519Identity(privateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse age private key: %w", err)
-	}
-
-	r := bytes.NewReader(data)
-	decryptor, err := age.Decrypt(r, identity)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %w", err)
-	}
-
-	out := &bytes.Buffer{}
-	if _, err := io.Copy(out, decryptor); err != nil {
-		return nil, fmt.Errorf("failed to read decrypted data: %w", err)
-	}
-
-	return out.Bytes(), nil
-}
-
-func unzip(data []byte, dest string) error {
-	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
-	if err != nil {
-		return err
-	}
-
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		return err
-	}
-
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-
-		if f.FileInfo().IsDir() {
-			continue // don't create empty directories
-		}
-
-		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return err
-		}
-
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
-		}
-		defer func(outFile *os.File) {
-			err := outFile.Close()
-			if err != nil {
-				log.Warn().Err(err).Str("file", fpath).Msg("Failed to close file on disk")
-			}
-		}(outFile)
-
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer func(rc io.ReadCloser) {
-			err := rc.Close()
-			if err != nil {
-				log.Warn().Err(err).Str("file", fpath).Msg("Failed to close file from zip archive")
-			}
-		}(rc)
-
-		_, err = io.Copy(outFile, rc)
-
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
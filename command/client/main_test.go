@@ -0,0 +1,36 @@
+package client
+
+import (
+	"go-certdist/common"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyOptions(t *testing.T) {
+	newConfig := func() common.ClientModeConfig {
+		return common.ClientModeConfig{
+			Certificate: []common.CertificateConfig{{Domain: "a.example.com"}, {Domain: "b.example.com"}},
+			Artifacts:   []common.ClientArtifactConfig{{Name: "tickets"}},
+		}
+	}
+
+	t.Run("no domains", func(t *testing.T) {
+		config := newConfig()
+		require.NoError(t, applyOptions(&config, Options{Once: true}))
+		assert.Equal(t, newConfig(), config)
+	})
+
+	t.Run("domains", func(t *testing.T) {
+		config := newConfig()
+		require.NoError(t, applyOptions(&config, Options{Domains: []string{"b.example.com"}}))
+		assert.Equal(t, []common.CertificateConfig{{Domain: "b.example.com"}}, config.Certificate)
+		assert.Empty(t, config.Artifacts)
+	})
+
+	t.Run("unknown domain", func(t *testing.T) {
+		config := newConfig()
+		assert.Error(t, applyOptions(&config, Options{Domains: []string{"c.example.com"}}))
+	})
+}
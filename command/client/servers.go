@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"net/http"
+	"slices"
+	"time"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog/log"
+)
+
+// serverPool holds a client per configured server, ordered by their health.
+type serverPool struct {
+	clients []*certdist.Client
+}
+
+// requestTimeout bounds every request to a single server, so a hanging server doesn't
+// prevent the failover to the next one. It is shortened in tests.
+var requestTimeout = 30 * time.Second
+
+// Ordering of servers, healthy servers first
+const (
+	serverHealthy = iota
+	serverDegraded
+	serverUnreachable
+)
+
+func newServerPool(config common.ClientModeConfig, identity age.Identity) *serverPool {
+	pool := &serverPool{}
+	for _, url := range config.ConnectionDetails.ServerURLs() {
+		pool.clients = append(pool.clients, certdist.NewClient(url, identity, config.AgeKey.PublicKey))
+	}
+	return pool
+}
+
+// Order checks the health of all servers and moves healthy servers to the front, keeping
+// the configured order otherwise.
+func (p *serverPool) Order(ctx context.Context) {
+	if len(p.clients) == 1 {
+		return
+	}
+	status := make(map[*certdist.Client]int, len(p.clients))
+	for _, client := range p.clients {
+		reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		problems, err := client.Health(reqCtx)
+		cancel()
+		switch {
+		case err != nil:
+			log.Warn().Err(err).Str("server", client.ServerURL).Msg("Server is unreachable")
+			status[client] = serverUnreachable
+		case len(problems) > 0:
+			log.Warn().Str("server", client.ServerURL).Strs("problems", problems).Msg("Server is degraded")
+			status[client] = serverDegraded
+		default:
+			status[client] = serverHealthy
+		}
+	}
+	slices.SortStableFunc(p.clients, func(a, b *certdist.Client) int {
+		return status[a] - status[b]
+	})
+}
+
+// Primary returns the server currently preferred.
+func (p *serverPool) Primary() *certdist.Client {
+	return p.clients[0]
+}
+
+// Do sends the request to the servers in order until one of them answers it. An unavailable
+// server is moved to the end, so following requests try the next server first.
+func (p *serverPool) Do(ctx context.Context, request certdist.Request) (*certdist.Bundle, error) {
+	var bundle *certdist.Bundle
+	err := p.failover(ctx, func(ctx context.Context, client *certdist.Client) (err error) {
+		bundle, err = client.Do(ctx, request)
+		return err
+	})
+	return bundle, err
+}
+
+// FetchArtifact requests the artifact from the servers in order, like Do.
+func (p *serverPool) FetchArtifact(ctx context.Context, name string, currentVersion string) (*certdist.Artifact, error) {
+	var artifact *certdist.Artifact
+	err := p.failover(ctx, func(ctx context.Context, client *certdist.Client) (err error) {
+		artifact, err = client.FetchArtifact(ctx, name, currentVersion)
+		return err
+	})
+	return artifact, err
+}
+
+// failover sends the request to the servers in order, each attempt is limited to
+// requestTimeout.
+func (p *serverPool) failover(ctx context.Context, request func(ctx context.Context, client *certdist.Client) error) error {
+	var errs []error
+	for _, client := range slices.Clone(p.clients) {
+		reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		err := request(reqCtx, client)
+		cancel()
+		if !shouldFailover(err) {
+			return err
+		}
+		errs = append(errs, err)
+		if len(p.clients) > 1 {
+			log.Ctx(ctx).Warn().Err(err).Str("server", client.ServerURL).Msg("Server failed, trying next server")
+			if serverUnavailable(err) {
+				p.demote(client)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rotate moves the preferred server to the end.
+func (p *serverPool) Rotate() {
+	p.demote(p.clients[0])
+}
+
+// demote moves the server to the end.
+func (p *serverPool) demote(client *certdist.Client) {
+	p.clients = append(slices.DeleteFunc(p.clients, func(c *certdist.Client) bool { return c == client }), client)
+}
+
+// shouldFailover reports whether another server might answer the request. Not modified and
+// other client errors are final. Replicas may only sync some of the domains, so another
+// server might have a certificate this one doesn't have or doesn't authorize.
+func shouldFailover(err error) bool {
+	if err == nil || errors.Is(err, certdist.ErrNotModified) {
+		return false
+	}
+	if errors.Is(err, certdist.ErrNotFound) || errors.Is(err, certdist.ErrForbidden) {
+		return true
+	}
+	return serverUnavailable(err)
+}
+
+// serverUnavailable reports whether the server failed to answer, e.g. it is unreachable or
+// had an internal error.
+func serverUnavailable(err error) bool {
+	var serverErr *certdist.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(t *testing.T, urls ...string) *serverPool {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	config := common.ClientModeConfig{
+		ConnectionDetails: common.ClientConnectionConfig{Servers: urls},
+		AgeKey:            common.AgeKeyConfig{PublicKey: identity.Recipient().String()},
+	}
+	return newServerPool(config, identity)
+}
+
+func TestServerPoolOrdersByHealth(t *testing.T) {
+	degraded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("DEGRADED\nexpiry: example.com expires soon\n"))
+	}))
+	defer degraded.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK\n"))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	pool := newTestPool(t, down.URL, degraded.URL, healthy.URL)
+	pool.Order(context.Background())
+
+	var urls []string
+	for _, client := range pool.clients {
+		urls = append(urls, client.ServerURL)
+	}
+	assert.Equal(t, []string{healthy.URL, degraded.URL, down.URL}, urls)
+}
+
+func TestServerPoolFailover(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Public key not authorized", http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+
+	badRequest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	}))
+	defer badRequest.Close()
+
+	pool := newTestPool(t, failing.URL, forbidden.URL, badRequest.URL)
+	_, err := pool.Do(context.Background(), certdist.Request{Domain: "example.com"})
+	// A replica may not serve the domain, the bad request answer is final and only the
+	// failing server is not preferred anymore
+	var serverErr *certdist.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, http.StatusBadRequest, serverErr.StatusCode)
+	assert.Equal(t, forbidden.URL, pool.Primary().ServerURL)
+	assert.Equal(t, failing.URL, pool.clients[2].ServerURL)
+}
+
+func TestServerPoolFailoverToReplica(t *testing.T) {
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Certificate not found", http.StatusNotFound)
+	}))
+	defer notFound.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Public key not authorized", http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+
+	pool := newTestPool(t, notFound.URL, forbidden.URL)
+	_, err := pool.Do(context.Background(), certdist.Request{Domain: "example.com"})
+	assert.ErrorIs(t, err, certdist.ErrNotFound)
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+	// Both servers answered, their order is kept
+	assert.Equal(t, notFound.URL, pool.Primary().ServerURL)
+}
+
+func TestServerPoolFailoverOnTimeout(t *testing.T) {
+	previous := requestTimeout
+	requestTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { requestTimeout = previous })
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Public key not authorized", http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+
+	pool := newTestPool(t, hanging.URL, forbidden.URL)
+	_, err := pool.Do(context.Background(), certdist.Request{Domain: "example.com"})
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+	assert.Equal(t, forbidden.URL, pool.Primary().ServerURL)
+}
+
+func TestServerPoolAllServersFail(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	pool := newTestPool(t, down.URL, failing.URL)
+	_, err := pool.Do(context.Background(), certdist.Request{Domain: "example.com"})
+	assert.Error(t, err)
+	assert.Equal(t, down.URL, pool.Primary().ServerURL)
+}
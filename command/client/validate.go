@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"path/filepath"
+)
+
+// ValidateConfig runs all checks of the client configuration and some deeper ones, e.g.
+// whether the servers are reachable. Unlike ExecuteClient it returns all problems instead of
+// stopping at the first one. The checks run on a copy of the configuration. Like on startup
+// the age key is loaded, which runs its exec: command and decrypts a passphrase-protected
+// key file.
+func ValidateConfig(ctx context.Context, config common.ClientModeConfig) []error {
+	config = common.CopyConfig(config)
+	var problems []error
+	for _, validate := range configValidators {
+		if err := validate(&config); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	problems = append(problems, checkClientDuplicates(config)...)
+	for _, dir := range outputDirectories(config) {
+		if err := common.CheckWritableDirectory(dir); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	problems = append(problems, checkServersReachable(ctx, config)...)
+	return problems
+}
+
+func checkClientDuplicates(config common.ClientModeConfig) []error {
+	var problems []error
+	domains := make(map[string]bool)
+	for _, certConfig := range config.Certificate {
+		if certConfig.Domain != "" && domains[certConfig.Domain] {
+			problems = append(problems, fmt.Errorf("certificate for domain %s is configured more than once", certConfig.Domain))
+		}
+		domains[certConfig.Domain] = true
+	}
+	artifacts := make(map[string]bool)
+	for _, artifactConfig := range config.Artifacts {
+		if artifactConfig.Name != "" && artifacts[artifactConfig.Name] {
+			problems = append(problems, fmt.Errorf("artifact %s is configured more than once", artifactConfig.Name))
+		}
+		artifacts[artifactConfig.Name] = true
+	}
+
+	directories := make(map[string]bool)
+	for _, dir := range outputDirectories(config) {
+		if directories[dir] {
+			problems = append(problems, fmt.Errorf("directory %s is used more than once", dir))
+		}
+		directories[dir] = true
+	}
+	return problems
+}
+
+// outputDirectories returns the directories the certificates and artifacts are written to.
+func outputDirectories(config common.ClientModeConfig) []string {
+	var directories []string
+	for _, certConfig := range config.Certificate {
+		if certConfig.Directory != "" {
+			directories = append(directories, filepath.Clean(certConfig.Directory))
+		}
+	}
+	for _, artifactConfig := range config.Artifacts {
+		if artifactConfig.Directory != "" {
+			directories = append(directories, filepath.Clean(artifactConfig.Directory))
+		}
+	}
+	return directories
+}
+
+// checkServersReachable reports servers which can't be reached. Servers answering with an
+// error, e.g. because they don't support the health endpoint, are reachable.
+func checkServersReachable(ctx context.Context, config common.ClientModeConfig) []error {
+	var problems []error
+	for _, url := range config.ConnectionDetails.ServerURLs() {
+		_, err := certdist.NewClient(url, nil, "").Health(ctx)
+		var serverErr *certdist.ServerError
+		if err != nil && !errors.As(err, &serverErr) {
+			problems = append(problems, fmt.Errorf("server %s is not reachable: %w", url, err))
+		}
+	}
+	return problems
+}
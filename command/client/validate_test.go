@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"go-certdist/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	privateKey, _ := common.NewAgeTestKey(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+
+	t.Run("valid config", func(t *testing.T) {
+		config := common.ClientModeConfig{
+			ConnectionDetails: common.ClientConnectionConfig{Server: srv.URL},
+			AgeKey:            common.AgeKeyConfig{PrivateKey: privateKey},
+			Certificate:       []common.CertificateConfig{{Domain: "example.com", Directory: filepath.Join(dir, "example.com")}},
+		}
+		assert.Empty(t, ValidateConfig(context.Background(), config))
+	})
+
+	t.Run("all problems are reported", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		unreachable := "http://" + listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		config := common.ClientModeConfig{
+			ConnectionDetails: common.ClientConnectionConfig{Servers: []string{srv.URL, unreachable}},
+			Certificate: []common.CertificateConfig{
+				{Domain: "example.com", Directory: filepath.Join(dir, "example.com")},
+				{Domain: "example.com", Directory: filepath.Join(dir, "example.com") + "/"},
+			},
+		}
+		problems := ValidateConfig(context.Background(), config)
+		var messages []string
+		for _, problem := range problems {
+			messages = append(messages, problem.Error())
+		}
+		require.Len(t, messages, 4, messages)
+		assert.Contains(t, messages[0], "age_key")
+		assert.Equal(t, "certificate for domain example.com is configured more than once", messages[1])
+		assert.Equal(t, "directory "+filepath.Join(dir, "example.com")+" is used more than once", messages[2])
+		assert.Contains(t, messages[3], "server "+unreachable+" is not reachable")
+	})
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultWatchTimeout = 55 * time.Second
+const watchRetryDelay = time.Minute
+
+// waitForNextRun blocks until the configured interval elapsed or the server reports a
+// changed certificate for one of the configured domains. If the server does not support
+// watching, it falls back to plain polling.
+func waitForNextRun(ctx context.Context, config common.ClientModeConfig, servers *serverPool, knownVersions map[string]string) {
+	interval := time.Duration(config.IntervalHours) * time.Hour
+	// Only certificates can be watched, artifacts are polled
+	if config.ConnectionDetails.DisableWatch || len(config.Certificate) == 0 {
+		log.Info().Int("hours", config.IntervalHours).Msg("Waiting until next execution")
+		time.Sleep(interval)
+		return
+	}
+
+	domains := make([]string, 0, len(config.Certificate))
+	for _, certConfig := range config.Certificate {
+		domains = append(domains, certConfig.Domain)
+	}
+
+	log.Info().Int("hours", config.IntervalHours).Msg("Watching for certificate changes until next execution")
+	deadline := time.Now().Add(interval)
+	failures := 0
+	for time.Now().Before(deadline) {
+		timeout := min(watchTimeout(config), time.Until(deadline))
+		client := servers.Primary()
+		reqCtx, logCtx := withRequestID(ctx)
+		logCtx.Debug().Str("server", client.ServerURL).Dur("timeout", timeout).Msg("Watching server for changes")
+		resp, err := client.Watch(reqCtx, domains, knownVersions, timeout)
+		if errors.Is(err, certdist.ErrWatchUnsupported) {
+			log.Info().Msg("Server does not support watching for changes, falling back to polling")
+			time.Sleep(time.Until(deadline))
+			return
+		}
+		if err != nil {
+			logCtx.Warn().Err(err).Str("server", client.ServerURL).Msg("Failed to watch for certificate changes, retrying")
+			// Try the other servers before waiting. Their versions can differ from the known
+			// ones, e.g. by the time of their OCSP responses, which at most causes an extra run.
+			servers.Rotate()
+			failures++
+			if failures%len(servers.clients) == 0 {
+				time.Sleep(min(watchRetryDelay, time.Until(deadline)))
+			}
+			continue
+		}
+		failures = 0
+
+		// The first response only establishes the versions the client currently has
+		baseline := len(knownVersions) == 0
+		for domain, version := range resp.Versions {
+			knownVersions[domain] = version
+		}
+		if !baseline && len(resp.Changed) > 0 {
+			log.Info().Strs("domains", resp.Changed).Msg("Server reported changed certificates")
+			return
+		}
+	}
+}
+
+func watchTimeout(config common.ClientModeConfig) time.Duration {
+	if config.ConnectionDetails.WatchTimeoutSeconds <= 0 {
+		return defaultWatchTimeout
+	}
+	return time.Duration(config.ConnectionDetails.WatchTimeoutSeconds) * time.Second
+}
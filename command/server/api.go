@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-certdist/common"
+	"math/rand"
+	"net/http"
+	"regexp"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// apiVersion defines how a handler reports errors: v1 as plain text, v2 as JSON.
+type apiVersion int
+
+const (
+	apiV1 apiVersion = 1
+	apiV2 apiVersion = 2
+)
+
+// requestIDPattern restricts client-provided request IDs, e.g. UUIDs, so they can't
+// inject anything into logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestID generates the ID a request is logged under and sets it in the response header.
+func requestID(w http.ResponseWriter) string {
+	reqID := fmt.Sprintf("%x", rand.Uint32())
+	w.Header().Set(common.RequestIDHeader, reqID)
+	return reqID
+}
+
+// requestLogger returns a logger with the request ID and, if valid, the ID the client sent
+// in the request header, so requests can be found by either of them.
+func requestLogger(reqID string, r *http.Request) zerolog.Logger {
+	logCtx := log.With().Str(common.LogKeyRequestId, reqID)
+	if clientID := r.Header.Get(common.RequestIDHeader); requestIDPattern.MatchString(clientID) {
+		logCtx = logCtx.Str(common.LogKeyClientRequestId, clientID)
+	}
+	return logCtx.Logger()
+}
+
+func (api apiVersion) writeError(w http.ResponseWriter, status int, code string, message string, reqID string) {
+	if api == apiV1 {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(common.APIError{Code: code, Message: message, RequestId: reqID})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to write error response")
+	}
+}
+
+// handleInfo advertises the version and the capabilities of the server.
+func (s *certificateServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiV2.writeError(w, http.StatusMethodNotAllowed, common.ErrorCodeMethodNotAllowed, "Only GET method is allowed", "")
+		return
+	}
+
+	info := common.ServerInfo{
+		Version:     common.Version,
+		APIVersions: []string{"v1", "v2"},
+		Formats:     []string{common.FormatZipAge},
+		Features:    []string{common.FeatureSharedBundles, common.FeatureSSHRecipients},
+	}
+	if s.store != nil {
+		info.Features = append(info.Features, common.FeatureWatch)
+	}
+	if s.stapler != nil {
+		info.Features = append(info.Features, common.FeatureOCSP)
+	}
+	if s.csr != nil {
+		info.Features = append(info.Features, common.FeatureCSR)
+	}
+	if len(s.config.Artifacts) > 0 {
+		info.Features = append(info.Features, common.FeatureArtifacts)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Error().Err(err).Msg("Failed to write info response")
+	}
+}
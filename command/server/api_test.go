@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-certdist/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteErrorV1IsPlainText(t *testing.T) {
+	rr := httptest.NewRecorder()
+	apiV1.writeError(rr, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized", "abc")
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "Public key not authorized\n", rr.Body.String())
+}
+
+func TestWriteErrorV2IsJSON(t *testing.T) {
+	rr := httptest.NewRecorder()
+	apiV2.writeError(rr, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized", "abc")
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var apiErr common.APIError
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+	assert.Equal(t, common.ErrorCodeForbidden, apiErr.Code)
+	assert.Equal(t, "Public key not authorized", apiErr.Message)
+	assert.Equal(t, "abc", apiErr.RequestId)
+}
+
+func TestHandleInfo(t *testing.T) {
+	rr := httptest.NewRecorder()
+	(&certificateServer{store: newCertificateStore(nil)}).handleInfo(rr, httptest.NewRequest(http.MethodGet, common.InfoEndpoint, nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var info common.ServerInfo
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, common.Version, info.Version)
+	assert.Contains(t, info.APIVersions, "v1")
+	assert.Contains(t, info.APIVersions, "v2")
+	assert.Contains(t, info.Formats, common.FormatZipAge)
+	assert.Contains(t, info.Features, common.FeatureWatch)
+}
+
+func TestHandleCertificateRequestV2ReturnsJSONErrors(t *testing.T) {
+	config := common.ServerModeConfig{PublicAgeKeys: []string{"age1allowed"}}
+	store := newCertificateStore(nil)
+	s := &certificateServer{config: config, source: store, store: store}
+
+	body := `{"domain":"example.com","age_public_key":"age1unknown"}`
+	rr := httptest.NewRecorder()
+	s.handleCertificateRequest(apiV2)(rr, httptest.NewRequest(http.MethodPost, common.CertificateRequestEndpointV2, strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	var apiErr common.APIError
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+	assert.Equal(t, common.ErrorCodeForbidden, apiErr.Code)
+	assert.NotEmpty(t, apiErr.RequestId)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	config := common.ServerModeConfig{PublicAgeKeys: []string{"age1allowed"}}
+	store := newCertificateStore(nil)
+	s := &certificateServer{config: config, source: store, store: store}
+	body := `{"domain":"example.com","age_public_key":"age1unknown"}`
+
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previous })
+
+	t.Run("client-provided ID is logged separately", func(t *testing.T) {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, common.CertificateRequestEndpointV2, strings.NewReader(body))
+		req.Header.Set(common.RequestIDHeader, "3f2c1a9e-client")
+		rr := httptest.NewRecorder()
+		s.handleCertificateRequest(apiV2)(rr, req)
+
+		reqID := rr.Header().Get(common.RequestIDHeader)
+		assert.NotEmpty(t, reqID)
+		assert.NotEqual(t, "3f2c1a9e-client", reqID)
+		var apiErr common.APIError
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+		assert.Equal(t, reqID, apiErr.RequestId)
+		assert.Contains(t, logs.String(), `"request_id":"`+reqID+`"`)
+		assert.Contains(t, logs.String(), `"client_request_id":"3f2c1a9e-client"`)
+	})
+
+	t.Run("invalid client ID is not logged", func(t *testing.T) {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, common.CertificateRequestEndpointV2, strings.NewReader(body))
+		req.Header.Set(common.RequestIDHeader, "bad id\nwith newline")
+		rr := httptest.NewRecorder()
+		s.handleCertificateRequest(apiV2)(rr, req)
+
+		assert.NotEmpty(t, rr.Header().Get(common.RequestIDHeader))
+		assert.NotContains(t, logs.String(), common.LogKeyClientRequestId)
+	})
+
+	t.Run("v1 returns the ID in the header only", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		s.handleCertificateRequest(apiV1)(rr, httptest.NewRequest(http.MethodPost, common.CertificateRequestEndpoint, strings.NewReader(body)))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.NotEmpty(t, rr.Header().Get(common.RequestIDHeader))
+	})
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// maxArtifactFileSize limits the size of a single artifact file, clients reject larger files.
+const maxArtifactFileSize = 1 << 20
+
+// findArtifact returns the configuration of the named artifact, nil if there is none.
+func findArtifact(config common.ServerModeConfig, name string) *common.ArtifactConfig {
+	for i := range config.Artifacts {
+		if config.Artifacts[i].Name == name {
+			return &config.Artifacts[i]
+		}
+	}
+	return nil
+}
+
+// authorizeArtifact checks whether the key may request the artifact. Keys in public_age_keys
+// may request all artifacts, group members only the artifacts listed by their groups.
+func authorizeArtifact(config common.ServerModeConfig, reqPublicKey string, name string) error {
+	reqPublicKey = common.NormalizePublicKey(reqPublicKey)
+	if containsKey(config.PublicAgeKeys, reqPublicKey) {
+		return nil
+	}
+	for _, group := range config.ClientGroups {
+		if !containsKey(group.Members, reqPublicKey) {
+			continue
+		}
+		for _, pattern := range group.Artifacts {
+			if matched, _ := path.Match(pattern, name); matched {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("public key not authorized for artifact %s", name)
+}
+
+// artifactFile identifies the state of an artifact file on disk.
+type artifactFile struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+type cachedArtifact struct {
+	stamps  []artifactFile
+	files   map[string][]byte
+	version string
+}
+
+// artifactCache keeps the files of artifacts, so they are only read and hashed again once
+// one of them changed its size or modification time, or files were added or removed.
+type artifactCache struct {
+	mu        sync.Mutex
+	artifacts map[string]cachedArtifact
+}
+
+func newArtifactCache() *artifactCache {
+	return &artifactCache{artifacts: make(map[string]cachedArtifact)}
+}
+
+// Load returns the files and the version of the artifact, a nil cache reads them every time.
+func (c *artifactCache) Load(artifact common.ArtifactConfig) (map[string][]byte, string, error) {
+	stamps, err := statArtifact(artifact)
+	if err != nil {
+		return nil, "", err
+	}
+	if c == nil {
+		return readArtifact(artifact, stamps)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.artifacts[artifact.Name]; ok && slices.Equal(cached.stamps, stamps) {
+		return cached.files, cached.version, nil
+	}
+	files, version, err := readArtifact(artifact, stamps)
+	if err != nil {
+		return nil, "", err
+	}
+	c.artifacts[artifact.Name] = cachedArtifact{stamps: stamps, files: files, version: version}
+	return files, version, nil
+}
+
+// statArtifact returns the current state of the files of the artifact.
+func statArtifact(artifact common.ArtifactConfig) ([]artifactFile, error) {
+	paths := artifact.Files
+	if artifact.Directory != "" {
+		entries, err := os.ReadDir(artifact.Directory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read artifact directory: %w", err)
+		}
+		paths = nil
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				paths = append(paths, filepath.Join(artifact.Directory, entry.Name()))
+			}
+		}
+	}
+
+	stamps := make([]artifactFile, 0, len(paths))
+	for _, file := range paths {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read artifact file: %w", err)
+		}
+		if info.Size() > maxArtifactFileSize {
+			return nil, fmt.Errorf("artifact file %s is larger than %d bytes", file, maxArtifactFileSize)
+		}
+		stamps = append(stamps, artifactFile{path: file, size: info.Size(), modTime: info.ModTime().UnixNano()})
+	}
+	if len(stamps) == 0 {
+		return nil, fmt.Errorf("artifact %s has no files", artifact.Name)
+	}
+	return stamps, nil
+}
+
+// readArtifact reads the files of the artifact. The version is derived from the names and
+// contents of the files, so it changes whenever one of them changes.
+func readArtifact(artifact common.ArtifactConfig, stamps []artifactFile) (map[string][]byte, string, error) {
+	files := make(map[string][]byte, len(stamps))
+	for _, stamp := range stamps {
+		data, err := os.ReadFile(stamp.path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read artifact file: %w", err)
+		}
+		if len(data) > maxArtifactFileSize {
+			return nil, "", fmt.Errorf("artifact file %s is larger than %d bytes", stamp.path, maxArtifactFileSize)
+		}
+		files[filepath.Base(stamp.path)] = data
+	}
+	return files, fingerprintFiles(files), nil
+}
+
+func (s *certificateServer) handleArtifactRequest(rw http.ResponseWriter, r *http.Request) {
+	reqID := requestID(rw)
+	logCtx := requestLogger(reqID, r)
+	logCtx.Info().Str("remoteAddr", r.RemoteAddr).Msg("Received artifact request from IP")
+
+	w := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	event := AuditEvent{RequestId: reqID, RemoteAddr: r.RemoteAddr}
+	defer s.audit(&event, w)
+
+	if r.Method != http.MethodPost {
+		apiV2.writeError(w, http.StatusMethodNotAllowed, common.ErrorCodeMethodNotAllowed, "Only POST method is allowed", reqID)
+		return
+	}
+
+	var req common.ArtifactRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		apiV2.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Failed to read request body", reqID)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		logCtx.Error().Err(err).Msg("Failed to unmarshal request body")
+		apiV2.writeError(w, http.StatusBadRequest, common.ErrorCodeInvalidRequest, "Invalid request body", reqID)
+		return
+	}
+	event.Artifact = req.Name
+	event.ClientKey = req.AgePublicKey
+	logCtx.Info().Str("artifact", req.Name).Str("age_public_key", req.AgePublicKey).Str("version", req.Version).Msg("Received artifact request")
+
+	if err := validateAgePublicKey(s.config, req.AgePublicKey); err != nil {
+		logCtx.Warn().Str("age_public_key", req.AgePublicKey).Msg("Public key not whitelisted")
+		s.webhooks.Dispatch(WebhookEvent{
+			Event:      eventUnauthorized,
+			RequestId:  reqID,
+			Artifact:   req.Name,
+			ClientKey:  req.AgePublicKey,
+			RemoteAddr: r.RemoteAddr,
+		})
+		apiV2.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized", reqID)
+		return
+	}
+	if err := authorizeArtifact(s.config, req.AgePublicKey, req.Name); err != nil {
+		logCtx.Warn().Str("age_public_key", req.AgePublicKey).Str("artifact", req.Name).Msg("Public key not authorized for artifact")
+		s.webhooks.Dispatch(WebhookEvent{
+			Event:      eventUnauthorized,
+			RequestId:  reqID,
+			Artifact:   req.Name,
+			ClientKey:  req.AgePublicKey,
+			RemoteAddr: r.RemoteAddr,
+		})
+		apiV2.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized for artifact", reqID)
+		return
+	}
+
+	if s.authorize != nil {
+		// Artifacts are passed to the hook as request without domain
+		certReq := common.CertificateRequest{AgePublicKey: req.AgePublicKey, ClientVersion: req.ClientVersion}
+		if err := s.authorize(r, certReq); err != nil {
+			logCtx.Warn().Err(err).Str("age_public_key", req.AgePublicKey).Str("artifact", req.Name).Msg("Request rejected by authorization hook")
+			apiV2.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Request not authorized", reqID)
+			return
+		}
+	}
+
+	s.inventory.RecordArtifactRequest(req, r.RemoteAddr)
+
+	artifact := findArtifact(s.config, req.Name)
+	if artifact == nil {
+		logCtx.Info().Str("artifact", req.Name).Msg("Artifact not found")
+		apiV2.writeError(w, http.StatusNotFound, common.ErrorCodeNotFound, "Artifact not found", reqID)
+		return
+	}
+	files, version, err := s.artifacts.Load(*artifact)
+	if err != nil {
+		logCtx.Error().Err(err).Str("artifact", req.Name).Msg("Failed to load artifact")
+		apiV2.writeError(w, http.StatusInternalServerError, common.ErrorCodeServerMisconfigured, "Failed to load artifact", reqID)
+		return
+	}
+
+	w.Header().Set(common.ArtifactVersionHeader, version)
+	if req.Version == version {
+		logCtx.Info().Msg("Client artifact is up to date. No action needed.")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	encryptedData, err := common.EncryptAndZipBundle(nil, files, req.AgePublicKey)
+	if err != nil {
+		logCtx.Error().Err(err).Msg("Failed to encrypt artifact")
+		apiV2.writeError(w, http.StatusInternalServerError, common.ErrorCodeServerMisconfigured, "Failed to bundle artifact", reqID)
+		return
+	}
+
+	logCtx.Info().Str("artifact", req.Name).Str("version", version).Msg("Sending artifact")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(encryptedData); err != nil {
+		logCtx.Error().Err(err).Msg("Failed to write response")
+	}
+}
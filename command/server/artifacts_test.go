@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newArtifactTestServer(t *testing.T, config common.ServerModeConfig) *httptest.Server {
+	t.Helper()
+	s := &certificateServer{config: config, source: staticSource{}, bundles: newBundleCache(), artifacts: newArtifactCache()}
+	srv := httptest.NewServer(s.routes())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestArtifactRequest(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ticket.key"), []byte("secret"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dhparam.pem"), []byte("not a certificate"), 0600))
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv := newArtifactTestServer(t, common.ServerModeConfig{
+		PublicAgeKeys: []string{identity.Recipient().String()},
+		Artifacts:     []common.ArtifactConfig{{Name: "tls-secrets", Directory: dir}},
+	})
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	artifact, err := client.FetchArtifact(context.Background(), "tls-secrets", "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"ticket.key": []byte("secret"), "dhparam.pem": []byte("not a certificate")}, artifact.Files)
+	assert.NotEmpty(t, artifact.Version)
+
+	// Unchanged files keep their version
+	_, err = client.FetchArtifact(context.Background(), "tls-secrets", artifact.Version)
+	assert.ErrorIs(t, err, certdist.ErrNotModified)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ticket.key"), []byte("rotated"), 0600))
+	rotated, err := client.FetchArtifact(context.Background(), "tls-secrets", artifact.Version)
+	require.NoError(t, err)
+	assert.NotEqual(t, artifact.Version, rotated.Version)
+	assert.Equal(t, []byte("rotated"), rotated.Files["ticket.key"])
+
+	_, err = client.FetchArtifact(context.Background(), "unknown", "")
+	assert.ErrorIs(t, err, certdist.ErrNotFound)
+}
+
+func TestArtifactRequestClientGroups(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dhparam.pem")
+	require.NoError(t, os.WriteFile(file, []byte("dhparam"), 0600))
+
+	member, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv := newArtifactTestServer(t, common.ServerModeConfig{
+		ClientGroups: []common.ClientGroupConfig{
+			{Name: "web", Members: []string{member.Recipient().String()}, Artifacts: []string{"dh*"}},
+			{Name: "mail", Members: []string{other.Recipient().String()}},
+		},
+		Artifacts: []common.ArtifactConfig{{Name: "dhparam", Files: []string{file}}},
+	})
+
+	_, err = certdist.NewClient(srv.URL, member, member.Recipient().String()).FetchArtifact(context.Background(), "dhparam", "")
+	assert.NoError(t, err)
+	// Groups without artifacts may not request any
+	_, err = certdist.NewClient(srv.URL, other, other.Recipient().String()).FetchArtifact(context.Background(), "dhparam", "")
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+}
+
+func TestArtifactRequestHooks(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dhparam.pem")
+	require.NoError(t, os.WriteFile(file, []byte("dhparam"), 0600))
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	var events []AuditEvent
+	rejected := false
+	handler, err := NewHandler(HandlerOptions{
+		Config: common.ServerModeConfig{
+			PublicAgeKeys: []string{identity.Recipient().String()},
+			Artifacts:     []common.ArtifactConfig{{Name: "dhparam", Files: []string{file}}},
+		},
+		Source: staticSource{},
+		Authorize: func(r *http.Request, req common.CertificateRequest) error {
+			if rejected {
+				return fmt.Errorf("rejected")
+			}
+			return nil
+		},
+		Audit: func(event AuditEvent) { events = append(events, event) },
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	_, err = client.FetchArtifact(context.Background(), "dhparam", "")
+	require.NoError(t, err)
+	rejected = true
+	_, err = client.FetchArtifact(context.Background(), "dhparam", "")
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+
+	require.Len(t, events, 2)
+	assert.Equal(t, "dhparam", events[0].Artifact)
+	assert.Empty(t, events[0].Domain)
+	assert.Equal(t, http.StatusOK, events[0].Status)
+	assert.Equal(t, identity.Recipient().String(), events[0].ClientKey)
+	assert.Equal(t, http.StatusForbidden, events[1].Status)
+}
+
+func TestArtifactCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ticket.key")
+	require.NoError(t, os.WriteFile(file, []byte("secret"), 0600))
+	artifact := common.ArtifactConfig{Name: "tls-secrets", Files: []string{file}}
+	cache := newArtifactCache()
+
+	files, version, err := cache.Load(artifact)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), files["ticket.key"])
+
+	// Files with unchanged size and modification time are not read again
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, []byte("SECRET"), 0600))
+	require.NoError(t, os.Chtimes(file, info.ModTime(), info.ModTime()))
+	files, cachedVersion, err := cache.Load(artifact)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), files["ticket.key"])
+	assert.Equal(t, version, cachedVersion)
+
+	require.NoError(t, os.Chtimes(file, info.ModTime().Add(time.Second), info.ModTime().Add(time.Second)))
+	files, changedVersion, err := cache.Load(artifact)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("SECRET"), files["ticket.key"])
+	assert.NotEqual(t, version, changedVersion)
+}
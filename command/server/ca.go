@@ -0,0 +1,266 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultCAValidityHours = 24
+
+// caRenewCheckInterval defines how often issued certificates are checked for renewal.
+const caRenewCheckInterval = 5 * time.Minute
+
+// caNamePattern matches the names the CA issues certificates for, lower case host names
+// with an optional leading wildcard.
+var caNamePattern = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// internalCA issues short-lived certificates into one directory per name. The directories
+// are served like any other certificate directory, so delivery and refresh work unchanged.
+type internalCA struct {
+	config common.CAConfig
+	store  *certificateStore
+	now    func() time.Time
+
+	cert  *x509.Certificate
+	key   crypto.Signer
+	chain []*x509.Certificate // above the issuing certificate
+
+	mu sync.Mutex // serializes issuance
+}
+
+func newInternalCA(config common.CAConfig, store *certificateStore) (*internalCA, error) {
+	if config.ValidityHours <= 0 {
+		config.ValidityHours = defaultCAValidityHours
+	}
+	certs, err := readCertificateFile(config.CertificateFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := common.ReadPrivateKeyFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if !certs[0].IsCA {
+		return nil, fmt.Errorf("ca.certificate_file is not a CA certificate")
+	}
+	if err := matchesKey(certs[0], key); err != nil {
+		return nil, err
+	}
+
+	chain := certs[1:]
+	if config.ChainFile != "" {
+		chainCerts, err := readCertificateFile(config.ChainFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, chainCerts...)
+	}
+	return &internalCA{config: config, store: store, now: time.Now, cert: certs[0], key: key, chain: chain}, nil
+}
+
+// Allowed reports whether the CA issues certificates for the name to the key.
+func (ca *internalCA) Allowed(reqPublicKey string, name string) bool {
+	if ca == nil || !caNamePattern.MatchString(name) {
+		return false
+	}
+	return clientAllowed(ca.config.Clients, reqPublicKey, name)
+}
+
+// clientAllowed reports whether one of the name patterns of the key matches the name.
+func clientAllowed(clients []common.CAClientConfig, reqPublicKey string, name string) bool {
+	reqPublicKey = common.NormalizePublicKey(reqPublicKey)
+	for _, client := range clients {
+		if !containsKey([]string{client.PublicKey}, reqPublicKey) {
+			continue
+		}
+		for _, pattern := range client.Names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ensure issues a certificate for the name unless there is one which doesn't need renewal.
+func (ca *internalCA) Ensure(name string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	dir := caDirectory(ca.config, name)
+	if current, err := readCertificateFile(filepath.Join(dir, "cert.pem")); err == nil && !ca.needsRenewal(current[0]) {
+		ca.store.AddDirectory(dir)
+		return nil
+	}
+	return ca.issue(name, dir)
+}
+
+// Run renews issued certificates half way through their validity, so watching clients
+// receive them without asking, until stop is closed.
+func (ca *internalCA) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(caRenewCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ca.RenewAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RenewAll renews all issued certificates which need renewal.
+func (ca *internalCA) RenewAll() {
+	for _, dir := range issuedDirectories(ca.config) {
+		current, err := readCertificateFile(filepath.Join(dir, "cert.pem"))
+		if err != nil || len(current[0].DNSNames) != 1 {
+			log.Warn().Err(err).Str("directory", dir).Msg("Failed to read issued certificate")
+			continue
+		}
+		if !ca.needsRenewal(current[0]) {
+			continue
+		}
+		if err := ca.Ensure(current[0].DNSNames[0]); err != nil {
+			log.Error().Err(err).Str("name", current[0].DNSNames[0]).Msg("Failed to renew issued certificate")
+		}
+	}
+}
+
+// needsRenewal reports whether the certificate is past half of its validity or was issued
+// by another CA, e.g. before the CA certificate was replaced.
+func (ca *internalCA) needsRenewal(cert *x509.Certificate) bool {
+	halfway := cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) / 2)
+	return !ca.now().Before(halfway) || cert.CheckSignatureFrom(ca.cert) != nil
+}
+
+func (ca *internalCA) issue(name string, dir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := ca.sign(name, &key.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	files := certificateFiles(der, ca.chainPEM())
+	files["privkey.pem"] = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.MkdirAll(ca.config.Directory, 0700); err != nil {
+		return err
+	}
+	if err := replaceDirectory(dir, &certdist.Bundle{Files: files}); err != nil {
+		return fmt.Errorf("failed to write certificate for %s: %w", name, err)
+	}
+	ca.store.AddDirectory(dir)
+	return nil
+}
+
+// sign issues a certificate for the name to the public key.
+func (ca *internalCA) sign(name string, publicKey crypto.PublicKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := ca.now()
+	notAfter := now.Add(time.Duration(ca.config.ValidityHours) * time.Hour)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-5 * time.Minute), // tolerate clock skew
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate for %s: %w", name, err)
+	}
+	log.Info().Str("name", name).Str("serial", serial.Text(16)).Time("expiration", notAfter).Msg("Issued certificate")
+	return der, nil
+}
+
+// chainPEM returns the issuing certificate followed by the certificates above it.
+func (ca *internalCA) chainPEM() []byte {
+	var chain []byte
+	for _, cert := range append([]*x509.Certificate{ca.cert}, ca.chain...) {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return chain
+}
+
+// certificateFiles returns cert.pem, chain.pem and fullchain.pem like certbot writes them.
+func certificateFiles(leafDER []byte, chain []byte) map[string][]byte {
+	leaf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	return map[string][]byte{
+		"cert.pem":      leaf,
+		"chain.pem":     chain,
+		"fullchain.pem": append(slices.Clip(leaf), chain...),
+	}
+}
+
+// caDirectory returns the directory of the certificate issued for the name.
+func caDirectory(config common.CAConfig, name string) string {
+	return filepath.Join(config.Directory, strings.Replace(name, "*", "_wildcard", 1))
+}
+
+// issuedDirectories returns the directories of all certificates issued so far.
+func issuedDirectories(config common.CAConfig) []string {
+	entries, err := os.ReadDir(config.Directory)
+	if err != nil {
+		return nil
+	}
+	var directories []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			directories = append(directories, filepath.Join(config.Directory, entry.Name()))
+		}
+	}
+	return directories
+}
+
+func readCertificateFile(file string) ([]*x509.Certificate, error) {
+	certs, err := parseCertificates(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return certs, nil
+}
+
+func matchesKey(cert *x509.Certificate, key crypto.Signer) error {
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return fmt.Errorf("ca.key_file does not belong to ca.certificate_file")
+	}
+	return nil
+}
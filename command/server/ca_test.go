@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCAConfig writes the certificate and key of a new CA and returns its configuration.
+func newTestCAConfig(t *testing.T, clients ...common.CAClientConfig) (common.CAConfig, *testCertificate) {
+	t.Helper()
+	ca := newTestChainCertificate(t, nil, caTemplate("Internal CA"))
+	dir := t.TempDir()
+	writePEM(t, filepath.Join(dir, "ca.pem"), ca)
+	keyDER, err := x509.MarshalECPrivateKey(ca.key)
+	require.NoError(t, err)
+	writePEMBlock(t, filepath.Join(dir, "ca.key"), "EC PRIVATE KEY", keyDER)
+	return common.CAConfig{
+		CertificateFile: filepath.Join(dir, "ca.pem"),
+		KeyFile:         filepath.Join(dir, "ca.key"),
+		Directory:       filepath.Join(dir, "issued"),
+		Clients:         clients,
+	}, ca
+}
+
+func TestInternalCAEnsure(t *testing.T) {
+	config, ca := newTestCAConfig(t)
+	store := newCertificateStore(nil)
+	internal, err := newInternalCA(config, store)
+	require.NoError(t, err)
+
+	require.NoError(t, internal.Ensure("db.internal"))
+	certs, err := readCertificateFile(filepath.Join(config.Directory, "db.internal", "cert.pem"))
+	require.NoError(t, err)
+	issued := certs[0]
+	assert.Equal(t, []string{"db.internal"}, issued.DNSNames)
+	assert.NoError(t, issued.CheckSignatureFrom(ca.cert))
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), issued.NotAfter, time.Minute)
+	found, err := store.FindCertificates("db.internal")
+	require.NoError(t, err)
+	assert.Len(t, found, 4)
+
+	// Still valid long enough, nothing is issued
+	require.NoError(t, internal.Ensure("db.internal"))
+	certs, err = readCertificateFile(filepath.Join(config.Directory, "db.internal", "cert.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, issued.SerialNumber, certs[0].SerialNumber)
+
+	// Half way through the validity, it is renewed
+	internal.now = func() time.Time { return time.Now().Add(13 * time.Hour) }
+	internal.RenewAll()
+	certs, err = readCertificateFile(filepath.Join(config.Directory, "db.internal", "cert.pem"))
+	require.NoError(t, err)
+	assert.NotEqual(t, issued.SerialNumber, certs[0].SerialNumber)
+}
+
+func TestInternalCAAllowed(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	config, _ := newTestCAConfig(t, common.CAClientConfig{PublicKey: identity.Recipient().String(), Names: []string{"*.internal"}})
+	internal, err := newInternalCA(config, newCertificateStore(nil))
+	require.NoError(t, err)
+
+	assert.True(t, internal.Allowed(identity.Recipient().String(), "db.internal"))
+	assert.False(t, internal.Allowed(identity.Recipient().String(), "example.com"))
+	assert.False(t, internal.Allowed(identity.Recipient().String(), "../etc.internal"))
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	assert.False(t, internal.Allowed(other.Recipient().String(), "db.internal"))
+
+	var nilCA *internalCA
+	assert.False(t, nilCA.Allowed(identity.Recipient().String(), "db.internal"))
+}
+
+func TestHandleCertificateRequestInternalCA(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	config, ca := newTestCAConfig(t, common.CAClientConfig{PublicKey: identity.Recipient().String(), Names: []string{"*.internal"}})
+	store := newCertificateStore(nil)
+	internal, err := newInternalCA(config, store)
+	require.NoError(t, err)
+	s := &certificateServer{
+		config:  common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}, CA: config},
+		source:  store,
+		store:   store,
+		bundles: newBundleCache(),
+		ca:      internal,
+	}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	bundle, err := client.Fetch(context.Background(), "db.internal", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db.internal"}, bundle.Certificate.DNSNames)
+	assert.NoError(t, bundle.Certificate.CheckSignatureFrom(ca.cert))
+	_, err = bundle.TLSCertificate()
+	assert.NoError(t, err)
+
+	// Up to date clients are not sent the certificate again
+	_, err = client.Fetch(context.Background(), "db.internal", bundle.Certificate.NotAfter)
+	assert.ErrorIs(t, err, certdist.ErrNotModified)
+
+	// Names not allowed for the key are not issued
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	assert.ErrorIs(t, err, certdist.ErrNotFound)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	chainPolicyWarn   = "warn"
+	chainPolicyRefuse = "refuse"
+	chainPolicyOff    = "off"
+)
+
+var chainPolicies = []string{chainPolicyWarn, chainPolicyRefuse, chainPolicyOff}
+
+// chainValidator checks certificates before they are delivered: the chain from the leaf
+// through the intermediates of the bundle has to verify against the roots, all
+// certificates have to be valid and the leaf has to be usable for TLS servers.
+type chainValidator struct {
+	policy string
+	roots  *x509.CertPool // nil uses the system roots
+	health *healthState
+	now    func() time.Time
+}
+
+func newChainValidator(config common.ChainValidationConfig, health *healthState) (*chainValidator, error) {
+	validator := &chainValidator{policy: config.Policy, health: health, now: time.Now}
+	if validator.policy == "" {
+		validator.policy = chainPolicyWarn
+	}
+	if len(config.RootFiles) > 0 {
+		validator.roots = x509.NewCertPool()
+		for _, file := range config.RootFiles {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read root file: %w", err)
+			}
+			if !validator.roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in root file %s", file)
+			}
+		}
+	}
+	return validator, nil
+}
+
+// Refuse reports whether invalid certificates must not be delivered.
+func (v *chainValidator) Refuse() bool {
+	return v != nil && v.policy == chainPolicyRefuse
+}
+
+// Validate returns all problems of the certificate files, nil if they are valid or
+// validation is disabled.
+func (v *chainValidator) Validate(certificates []*common.CertificateInfo) error {
+	if v == nil || v.policy == chainPolicyOff {
+		return nil
+	}
+
+	chain, leafIndex, err := loadChain(certificates)
+	if err != nil {
+		return err
+	}
+	leaf := chain[leafIndex]
+
+	now := v.now()
+	var problems []error
+	for _, c := range chain {
+		if now.Before(c.NotBefore) {
+			problems = append(problems, fmt.Errorf("certificate %s is not valid before %s", c.Subject, c.NotBefore.Format(time.RFC3339)))
+		}
+		if now.After(c.NotAfter) {
+			problems = append(problems, fmt.Errorf("certificate %s expired at %s", c.Subject, c.NotAfter.Format(time.RFC3339)))
+		}
+	}
+	if len(leaf.ExtKeyUsage) > 0 && !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth) && !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		problems = append(problems, fmt.Errorf("certificate %s is not valid for serverAuth", leaf.Subject))
+	}
+
+	intermediates := x509.NewCertPool()
+	for i, c := range chain {
+		if i != leafIndex {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	var invalidErr x509.CertificateInvalidError
+	if err != nil && !(errors.As(err, &invalidErr) && (invalidErr.Reason == x509.Expired || invalidErr.Reason == x509.IncompatibleUsage)) {
+		// expiration and usage are already reported above
+		problems = append(problems, fmt.Errorf("failed to verify chain: %w", err))
+	}
+	return errors.Join(problems...)
+}
+
+// CheckDirectories validates all directories, logs the problems and reports them in the health status.
+func (v *chainValidator) CheckDirectories(directories []common.DirectoryCertificates) {
+	for _, dir := range directories {
+		v.CheckDirectory(dir)
+	}
+}
+
+// CheckDirectory validates a single directory, e.g. after it changed.
+func (v *chainValidator) CheckDirectory(dir common.DirectoryCertificates) {
+	if v == nil || v.policy == chainPolicyOff || common.PrimaryCertificate(dir.Certificates) == nil {
+		return
+	}
+	component := "chain " + dir.FilePath
+	err := v.Validate(dir.Certificates)
+	if err == nil {
+		v.health.Set(component, nil)
+		return
+	}
+	log.Warn().Err(err).Str("directory", dir.FilePath).Str("policy", v.policy).Msg("Certificate chain is invalid")
+	var problems []string
+	for _, problem := range unjoin(err) {
+		problems = append(problems, problem.Error())
+	}
+	v.health.Set(component, problems)
+}
+
+// loadChain returns all distinct certificates of the files and the index of the leaf.
+func loadChain(certificates []*common.CertificateInfo) ([]*x509.Certificate, int, error) {
+	var chain []*x509.Certificate
+	for _, cert := range certificates {
+		if cert.FileType != common.FileTypePublicCertificate {
+			continue
+		}
+		parsed, err := parseCertificates(cert.FilePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, c := range parsed {
+			if !slices.ContainsFunc(chain, c.Equal) {
+				chain = append(chain, c)
+			}
+		}
+	}
+	leafIndex := slices.IndexFunc(chain, func(c *x509.Certificate) bool { return !c.IsCA })
+	if leafIndex < 0 {
+		return nil, 0, fmt.Errorf("no leaf certificate found")
+	}
+	return chain, leafIndex, nil
+}
+
+// issuerOf returns the certificate of the chain which signed the certificate, nil if the
+// issuer is not part of the chain.
+func issuerOf(chain []*x509.Certificate, cert *x509.Certificate) *x509.Certificate {
+	for _, c := range chain {
+		if !c.Equal(cert) && cert.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func parseCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certificates, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate in %s: %w", path, err)
+		}
+		certificates = append(certificates, cert)
+	}
+}
+
+// unjoin returns the errors combined by errors.Join.
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"go-certdist/common"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestChainCertificate signs a certificate with the CA, or self-signs it if ca is nil.
+func newTestChainCertificate(t *testing.T, ca *testCertificate, template *x509.Certificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.BasicConstraintsValid = true
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(30 * 24 * time.Hour)
+	}
+
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCertificate{cert: cert, key: key}
+}
+
+func writePEM(t *testing.T, path string, certs ...*testCertificate) {
+	t.Helper()
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func caTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: true, KeyUsage: x509.KeyUsageCertSign}
+}
+
+func leafTemplate() *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// newTestChain writes root.pem, and cert.pem plus fullchain.pem of a leaf issued by an
+// intermediate into a certificate directory.
+func newTestChain(t *testing.T, leaf *x509.Certificate) (rootFile string, certDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	root := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	intermediate := newTestChainCertificate(t, root, caTemplate("Test Intermediate"))
+	issued := newTestChainCertificate(t, intermediate, leaf)
+
+	rootFile = filepath.Join(dir, "root.pem")
+	writePEM(t, rootFile, root)
+	certDir = filepath.Join(dir, "example.com")
+	require.NoError(t, os.MkdirAll(certDir, 0700))
+	writePEM(t, filepath.Join(certDir, "cert.pem"), issued)
+	writePEM(t, filepath.Join(certDir, "fullchain.pem"), issued, intermediate)
+	return rootFile, certDir
+}
+
+func loadTestCertificates(t *testing.T, dir string) []*common.CertificateInfo {
+	return common.LoadCertificates([]string{dir})[0].Certificates
+}
+
+func TestChainValidatorValidChain(t *testing.T) {
+	rootFile, certDir := newTestChain(t, leafTemplate())
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, newHealthState())
+	require.NoError(t, err)
+
+	assert.NoError(t, validator.Validate(loadTestCertificates(t, certDir)))
+}
+
+func TestChainValidatorMissingIntermediate(t *testing.T) {
+	rootFile, certDir := newTestChain(t, leafTemplate())
+	require.NoError(t, os.Remove(filepath.Join(certDir, "fullchain.pem")))
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, newHealthState())
+	require.NoError(t, err)
+
+	err = validator.Validate(loadTestCertificates(t, certDir))
+	assert.ErrorContains(t, err, "failed to verify chain")
+}
+
+func TestChainValidatorUntrustedRoot(t *testing.T) {
+	_, certDir := newTestChain(t, leafTemplate())
+	otherRoot, _ := newTestChain(t, leafTemplate())
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{otherRoot}}, newHealthState())
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, validator.Validate(loadTestCertificates(t, certDir)), "failed to verify chain")
+}
+
+func TestChainValidatorValidityWindow(t *testing.T) {
+	expired := leafTemplate()
+	expired.NotBefore = time.Now().Add(-48 * time.Hour)
+	expired.NotAfter = time.Now().Add(-24 * time.Hour)
+	rootFile, certDir := newTestChain(t, expired)
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, newHealthState())
+	require.NoError(t, err)
+	err = validator.Validate(loadTestCertificates(t, certDir))
+	assert.ErrorContains(t, err, "expired")
+	assert.NotContains(t, err.Error(), "failed to verify chain")
+
+	notYetValid := leafTemplate()
+	notYetValid.NotBefore = time.Now().Add(24 * time.Hour)
+	rootFile, certDir = newTestChain(t, notYetValid)
+	validator, err = newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, newHealthState())
+	require.NoError(t, err)
+	assert.ErrorContains(t, validator.Validate(loadTestCertificates(t, certDir)), "not valid before")
+}
+
+func TestChainValidatorServerAuth(t *testing.T) {
+	clientOnly := leafTemplate()
+	clientOnly.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	rootFile, certDir := newTestChain(t, clientOnly)
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, newHealthState())
+	require.NoError(t, err)
+
+	err = validator.Validate(loadTestCertificates(t, certDir))
+	assert.ErrorContains(t, err, "serverAuth")
+	assert.NotContains(t, err.Error(), "failed to verify chain")
+}
+
+func TestChainValidatorPolicyOff(t *testing.T) {
+	_, certDir := newTestChain(t, leafTemplate())
+	validator, err := newChainValidator(common.ChainValidationConfig{Policy: chainPolicyOff}, newHealthState())
+	require.NoError(t, err)
+
+	assert.NoError(t, validator.Validate(loadTestCertificates(t, certDir)))
+}
+
+func TestChainValidatorHealth(t *testing.T) {
+	rootFile, certDir := newTestChain(t, leafTemplate())
+	health := newHealthState()
+	validator, err := newChainValidator(common.ChainValidationConfig{RootFiles: []string{rootFile}}, health)
+	require.NoError(t, err)
+
+	fullchain := filepath.Join(certDir, "fullchain.pem")
+	data, err := os.ReadFile(fullchain)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(fullchain))
+	validator.CheckDirectories(common.LoadCertificates([]string{certDir}))
+	problems := health.Problems()
+	require.Len(t, problems, 1)
+	assert.True(t, strings.HasPrefix(problems[0], "chain "+certDir+": failed to verify chain"))
+
+	// Fixed once the intermediate is back
+	require.NoError(t, os.WriteFile(fullchain, data, 0644))
+	validator.CheckDirectory(common.LoadCertificates([]string{certDir})[0])
+	assert.Empty(t, health.Problems())
+}
+
+func TestHandleCertificateRequestRefusesInvalidChain(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	rootFile, certDir := newTestChain(t, leafTemplate())
+	require.NoError(t, os.Remove(filepath.Join(certDir, "fullchain.pem")))
+
+	for _, policy := range []string{chainPolicyWarn, chainPolicyRefuse} {
+		t.Run(policy, func(t *testing.T) {
+			handler, err := NewHandler(HandlerOptions{
+				Config: common.ServerModeConfig{
+					PublicAgeKeys:   []string{publicKey},
+					ChainValidation: common.ChainValidationConfig{Policy: policy, RootFiles: []string{rootFile}},
+				},
+				Source: DirectorySource([]string{certDir}),
+			})
+			require.NoError(t, err)
+			defer func() { _ = handler.Close() }()
+
+			body := `{"domain":"example.com","age_public_key":"` + publicKey + `"}`
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, common.CertificateRequestEndpointV2, strings.NewReader(body)))
+			if policy == chainPolicyWarn {
+				assert.Equal(t, http.StatusOK, rr.Code)
+				return
+			}
+			assert.Equal(t, http.StatusInternalServerError, rr.Code)
+			var apiErr common.APIError
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+			assert.Equal(t, common.ErrorCodeInvalidCertificate, apiErr.Code)
+		})
+	}
+}
+
+func writePEMBlock(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
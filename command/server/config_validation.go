@@ -4,20 +4,54 @@ import (
 	"fmt"
 	"go-certdist/common"
 	"os"
-
-	"filippo.io/age"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
+// configValidators check the server configuration in this order. Replication and the
+// internal CA come first, they add the replicated and issued certificate directories.
+var configValidators = []func(config *common.ServerModeConfig) error{
+	validateReplication,
+	validateCA,
+	validateServerDetails,    // server connection and certificate directories
+	validateAgeKeys,          // authorized keys and client groups
+	validateWebhooks,         // webhook endpoints and their subscribed events
+	validateExpiryWatchdog,   // expiry watchdog thresholds
+	validateChainValidation,  // chain validation policy and roots
+	validateArtifacts,        // artifacts and their files
+	validateCSRAndRevocation, // CSR signing, OCSP and revocation checks
+}
+
 func validateConfig(config *common.ServerModeConfig) error {
-	// Validate that the server connection is configured
-	if err := validateServerDetails(config); err != nil {
-		return err
+	for _, validate := range configValidators {
+		if err := validate(config); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Validate age public and private key
-	if err := validateAgeKeys(config); err != nil {
+func validateCSRAndRevocation(config *common.ServerModeConfig) error {
+	if config.CSR.Enabled && config.CSR.Command == "" && config.CA.CertificateFile == "" {
+		return fmt.Errorf("csr.enabled requires csr.command or the internal ca")
+	}
+	if config.CSR.TimeoutSeconds < 0 {
+		return fmt.Errorf("csr.timeout_seconds must not be negative")
+	}
+	if config.CSR.Enabled && config.CSR.Command != "" && len(config.CSR.Clients) == 0 {
+		return fmt.Errorf("csr.command requires csr.clients")
+	}
+	if err := validateCAClients("csr client", config.CSR.Clients); err != nil {
 		return err
 	}
+	if config.OCSP.CheckIntervalMinutes < 0 {
+		return fmt.Errorf("ocsp.check_interval_minutes must not be negative")
+	}
+	if config.Revocation.CheckIntervalMinutes < 0 {
+		return fmt.Errorf("revocation.check_interval_minutes must not be negative")
+	}
 	return nil
 }
 
@@ -26,13 +60,27 @@ func validateServerDetails(config *common.ServerModeConfig) error {
 		config.ServerDetails.ListenAddress = "127.0.0.1"
 	}
 
-	if config.ServerDetails.Port == 0 {
-		return fmt.Errorf("server.port is not configured")
+	if config.ServerDetails.Port == 0 && len(config.ServerDetails.Listen) == 0 && !socketActivated() {
+		return fmt.Errorf("neither server.port nor server.listen is configured")
 	}
-	if len(config.ServerDetails.CertificateDirectory) == 0 {
+	for _, address := range config.ServerDetails.Listen {
+		if _, _, err := parseListenAddress(address); err != nil {
+			return err
+		}
+	}
+	if config.ServerDetails.SocketMode != "" {
+		if _, err := parseSocketMode(config.ServerDetails.SocketMode); err != nil {
+			return err
+		}
+	}
+	if len(config.ServerDetails.CertificateDirectory) == 0 && config.CA.CertificateFile == "" {
 		return fmt.Errorf("at least one server.certificate_directories must be configured")
 	}
+	replicas := replicaDirectories(config.Replication)
 	for _, dir := range config.ServerDetails.CertificateDirectory {
+		if slices.Contains(replicas, dir) {
+			continue // created when the replication starts
+		}
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			return fmt.Errorf("configured certificate directory does not exist: %s", dir)
 		}
@@ -41,13 +89,205 @@ func validateServerDetails(config *common.ServerModeConfig) error {
 }
 
 func validateAgeKeys(config *common.ServerModeConfig) error {
-	if len(config.PublicAgeKeys) == 0 {
+	if len(config.PublicAgeKeys) == 0 && len(config.ClientGroups) == 0 {
 		return fmt.Errorf("at least one public_age_key must be configured")
 	}
-	for _, key := range config.PublicAgeKeys {
-		if _, err := age.ParseX25519Recipient(key); err != nil {
+	for i, key := range config.PublicAgeKeys {
+		if _, err := common.ParseRecipient(key); err != nil {
 			return fmt.Errorf("invalid public_age_key configured: %s", key)
 		}
+		config.PublicAgeKeys[i] = common.NormalizePublicKey(key)
+	}
+	return validateClientGroups(config)
+}
+
+func validateClientGroups(config *common.ServerModeConfig) error {
+	names := make(map[string]bool)
+	for i, group := range config.ClientGroups {
+		if group.Name == "" {
+			return fmt.Errorf("client group %d: name is not configured", i)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("client group %s is configured more than once", group.Name)
+		}
+		names[group.Name] = true
+
+		if len(group.Members) == 0 {
+			return fmt.Errorf("client group %s: at least one member must be configured", group.Name)
+		}
+		for j, key := range group.Members {
+			if _, err := common.ParseRecipient(key); err != nil {
+				return fmt.Errorf("client group %s: invalid member key configured: %s", group.Name, key)
+			}
+			config.ClientGroups[i].Members[j] = common.NormalizePublicKey(key)
+		}
+		for _, pattern := range group.Domains {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("client group %s: invalid domain pattern %s", group.Name, pattern)
+			}
+		}
+		for _, pattern := range group.Artifacts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("client group %s: invalid artifact pattern %s", group.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func validateArtifacts(config *common.ServerModeConfig) error {
+	names := make(map[string]bool)
+	for i, artifact := range config.Artifacts {
+		if artifact.Name == "" {
+			return fmt.Errorf("artifact %d: name is not configured", i)
+		}
+		if names[artifact.Name] {
+			return fmt.Errorf("artifact %s is configured more than once", artifact.Name)
+		}
+		names[artifact.Name] = true
+
+		if (len(artifact.Files) == 0) == (artifact.Directory == "") {
+			return fmt.Errorf("artifact %s: exactly one of files and directory must be configured", artifact.Name)
+		}
+		baseNames := make(map[string]bool)
+		for _, file := range artifact.Files {
+			if baseNames[filepath.Base(file)] {
+				return fmt.Errorf("artifact %s: more than one file named %s", artifact.Name, filepath.Base(file))
+			}
+			baseNames[filepath.Base(file)] = true
+		}
+		if _, err := statArtifact(artifact); err != nil {
+			return fmt.Errorf("artifact %s: %w", artifact.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateWebhooks(config *common.ServerModeConfig) error {
+	for i, webhook := range config.Webhooks {
+		if !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+			return fmt.Errorf("webhook %d: url must start with http:// or https://", i)
+		}
+		for _, event := range webhook.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return fmt.Errorf("webhook %d: unknown event %s", i, event)
+			}
+		}
+		if webhook.MaxRetries < noWebhookRetries {
+			return fmt.Errorf("webhook %d: max_retries must be -1 (no retries) or larger", i)
+		}
+	}
+	return nil
+}
+
+func validateExpiryWatchdog(config *common.ServerModeConfig) error {
+	watchdog := config.ExpiryWatchdog
+	if watchdog.WarningDays < 0 || watchdog.CriticalDays < 0 || watchdog.CheckIntervalMinutes < 0 {
+		return fmt.Errorf("expiry_watchdog values must not be negative")
+	}
+	watchdog = expiryWatchdogDefaults(watchdog)
+	if watchdog.CriticalDays > watchdog.WarningDays {
+		return fmt.Errorf("expiry_watchdog.critical_days (%d) must not be larger than expiry_watchdog.warning_days (%d)", watchdog.CriticalDays, watchdog.WarningDays)
+	}
+	return nil
+}
+
+func validateReplication(config *common.ServerModeConfig) error {
+	if config.Replication.Primary == "" {
+		if len(config.Replication.Domains) > 0 {
+			return fmt.Errorf("replication.primary is not configured")
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(config.Replication.Primary, "http://") && !strings.HasPrefix(config.Replication.Primary, "https://") {
+		return fmt.Errorf("replication.primary must start with http:// or https://")
+	}
+	if config.Replication.Directory == "" {
+		return fmt.Errorf("replication.directory is not configured")
+	}
+	if len(config.Replication.Domains) == 0 {
+		return fmt.Errorf("at least one replication.domains must be configured")
+	}
+	if _, _, err := common.LoadAgeIdentity(config.Replication.AgeKey); err != nil {
+		return fmt.Errorf("invalid replication.age_key: %w", err)
+	}
+
+	// The directories are created when the replication starts
+	for _, dir := range replicaDirectories(config.Replication) {
+		if !slices.Contains(config.ServerDetails.CertificateDirectory, dir) {
+			config.ServerDetails.CertificateDirectory = append(config.ServerDetails.CertificateDirectory, dir)
+		}
+	}
+	return nil
+}
+
+func validateCA(config *common.ServerModeConfig) error {
+	ca := config.CA
+	if ca.CertificateFile == "" {
+		if ca.KeyFile != "" || ca.Directory != "" || len(ca.Clients) > 0 {
+			return fmt.Errorf("ca.certificate_file is not configured")
+		}
+		return nil
+	}
+	if ca.KeyFile == "" {
+		return fmt.Errorf("ca.key_file is not configured")
+	}
+	if ca.Directory == "" {
+		return fmt.Errorf("ca.directory is not configured")
+	}
+	if ca.ValidityHours < 0 {
+		return fmt.Errorf("ca.validity_hours must not be negative")
+	}
+	if _, err := newInternalCA(ca, nil); err != nil {
+		return fmt.Errorf("invalid ca: %w", err)
+	}
+	if err := validateCAClients("ca client", config.CA.Clients); err != nil {
+		return err
+	}
+
+	// The directory is created when the first certificate is issued
+	if info, err := os.Stat(ca.Directory); err == nil && !info.IsDir() {
+		return fmt.Errorf("ca.directory is not a directory: %s", ca.Directory)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("invalid ca.directory: %w", err)
+	}
+	for _, dir := range issuedDirectories(ca) {
+		if !slices.Contains(config.ServerDetails.CertificateDirectory, dir) {
+			config.ServerDetails.CertificateDirectory = append(config.ServerDetails.CertificateDirectory, dir)
+		}
+	}
+	return nil
+}
+
+// validateCAClients checks the keys and name patterns of the clients and normalizes the keys.
+func validateCAClients(prefix string, clients []common.CAClientConfig) error {
+	for i, client := range clients {
+		if _, err := common.ParseRecipient(client.PublicKey); err != nil {
+			return fmt.Errorf("%s %d: invalid public_key configured: %s", prefix, i, client.PublicKey)
+		}
+		clients[i].PublicKey = common.NormalizePublicKey(client.PublicKey)
+		if len(client.Names) == 0 {
+			return fmt.Errorf("%s %d: at least one name must be configured", prefix, i)
+		}
+		for _, pattern := range client.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s %d: invalid name pattern %s", prefix, i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func validateChainValidation(config *common.ServerModeConfig) error {
+	policy := config.ChainValidation.Policy
+	if policy != "" && !slices.Contains(chainPolicies, policy) {
+		return fmt.Errorf("chain_validation.policy must be one of %s", strings.Join(chainPolicies, ", "))
+	}
+	for _, file := range config.ChainValidation.RootFiles {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("chain_validation.root_files: %w", err)
+		}
 	}
 	return nil
 }
@@ -2,9 +2,13 @@ package server
 
 import (
 	"go-certdist/common"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"filippo.io/age"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidateServerDetails(t *testing.T) {
@@ -70,3 +74,173 @@ func TestValidateAgeKeys(t *testing.T) {
 		assert.Error(t, validateAgeKeys(config))
 	})
 }
+
+func TestValidateWebhooks(t *testing.T) {
+	t.Run("valid webhook", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			Webhooks: []common.WebhookConfig{{URL: "https://hooks.example.com", Events: []string{eventCertificateChanged}}},
+		}
+		assert.NoError(t, validateWebhooks(config))
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			Webhooks: []common.WebhookConfig{{URL: "hooks.example.com"}},
+		}
+		assert.Error(t, validateWebhooks(config))
+	})
+
+	t.Run("unknown event", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			Webhooks: []common.WebhookConfig{{URL: "https://hooks.example.com", Events: []string{"certificate.stolen"}}},
+		}
+		assert.Error(t, validateWebhooks(config))
+	})
+}
+
+func TestValidateExpiryWatchdog(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		assert.NoError(t, validateExpiryWatchdog(&common.ServerModeConfig{}))
+	})
+
+	t.Run("critical larger than warning", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			ExpiryWatchdog: common.ExpiryWatchdogConfig{WarningDays: 7, CriticalDays: 14},
+		}
+		assert.Error(t, validateExpiryWatchdog(config))
+	})
+
+	t.Run("critical larger than the default warning", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			ExpiryWatchdog: common.ExpiryWatchdogConfig{CriticalDays: 21},
+		}
+		assert.Error(t, validateExpiryWatchdog(config))
+	})
+}
+
+func TestValidateAgeKeysSSH(t *testing.T) {
+	_, sshPublicKey := common.NewSSHTestKey(t, t.TempDir())
+	config := &common.ServerModeConfig{
+		PublicAgeKeys: []string{sshPublicKey},
+	}
+	assert.NoError(t, validateAgeKeys(config))
+	assert.NoError(t, validateAgePublicKey(*config, common.NormalizePublicKey(sshPublicKey)))
+	assert.NoError(t, validateAgePublicKey(*config, sshPublicKey))
+}
+
+func TestValidateClientGroups(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+
+	t.Run("group without public_age_keys", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			ClientGroups: []common.ClientGroupConfig{{Name: "lb", Members: []string{publicKey}}},
+		}
+		assert.NoError(t, validateAgeKeys(config))
+	})
+
+	t.Run("duplicate group name", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			ClientGroups: []common.ClientGroupConfig{
+				{Name: "lb", Members: []string{publicKey}},
+				{Name: "lb", Members: []string{publicKey}},
+			},
+		}
+		assert.Error(t, validateClientGroups(config))
+	})
+
+	t.Run("invalid member key", func(t *testing.T) {
+		config := &common.ServerModeConfig{
+			ClientGroups: []common.ClientGroupConfig{{Name: "lb", Members: []string{"invalid-key"}}},
+		}
+		assert.Error(t, validateClientGroups(config))
+	})
+}
+
+func TestValidateChainValidation(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		assert.NoError(t, validateChainValidation(&common.ServerModeConfig{}))
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		config := &common.ServerModeConfig{ChainValidation: common.ChainValidationConfig{Policy: "ignore"}}
+		assert.Error(t, validateChainValidation(config))
+	})
+
+	t.Run("missing root file", func(t *testing.T) {
+		config := &common.ServerModeConfig{ChainValidation: common.ChainValidationConfig{RootFiles: []string{"/nonexistent/root.pem"}}}
+		assert.Error(t, validateChainValidation(config))
+	})
+}
+
+func TestValidateArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dhparam.pem")
+	require.NoError(t, os.WriteFile(file, []byte("dhparam"), 0600))
+
+	t.Run("valid", func(t *testing.T) {
+		config := &common.ServerModeConfig{Artifacts: []common.ArtifactConfig{
+			{Name: "dhparam", Files: []string{file}},
+			{Name: "tickets", Directory: dir},
+		}}
+		assert.NoError(t, validateArtifacts(config))
+	})
+
+	t.Run("files and directory", func(t *testing.T) {
+		config := &common.ServerModeConfig{Artifacts: []common.ArtifactConfig{{Name: "dhparam", Files: []string{file}, Directory: dir}}}
+		assert.Error(t, validateArtifacts(config))
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		config := &common.ServerModeConfig{Artifacts: []common.ArtifactConfig{
+			{Name: "dhparam", Files: []string{file}},
+			{Name: "dhparam", Directory: dir},
+		}}
+		assert.Error(t, validateArtifacts(config))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		config := &common.ServerModeConfig{Artifacts: []common.ArtifactConfig{{Name: "dhparam", Files: []string{filepath.Join(dir, "missing")}}}}
+		assert.Error(t, validateArtifacts(config))
+	})
+}
+
+func TestValidateCA(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		assert.NoError(t, validateCA(&common.ServerModeConfig{}))
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		identity, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		ca, _ := newTestCAConfig(t, common.CAClientConfig{PublicKey: identity.Recipient().String(), Names: []string{"*.internal"}})
+		config := &common.ServerModeConfig{CA: ca}
+		assert.NoError(t, validateCA(config))
+		assert.NoDirExists(t, ca.Directory)
+	})
+
+	t.Run("directory is a file", func(t *testing.T) {
+		ca, _ := newTestCAConfig(t)
+		require.NoError(t, os.WriteFile(ca.Directory, nil, 0600))
+		assert.Error(t, validateCA(&common.ServerModeConfig{CA: ca}))
+	})
+
+	t.Run("missing key file", func(t *testing.T) {
+		ca, _ := newTestCAConfig(t)
+		ca.KeyFile = ""
+		assert.Error(t, validateCA(&common.ServerModeConfig{CA: ca}))
+	})
+
+	t.Run("key of another CA", func(t *testing.T) {
+		ca, _ := newTestCAConfig(t)
+		other, _ := newTestCAConfig(t)
+		ca.KeyFile = other.KeyFile
+		assert.Error(t, validateCA(&common.ServerModeConfig{CA: ca}))
+	})
+
+	t.Run("client without names", func(t *testing.T) {
+		identity, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		ca, _ := newTestCAConfig(t, common.CAClientConfig{PublicKey: identity.Recipient().String()})
+		assert.Error(t, validateCA(&common.ServerModeConfig{CA: ca}))
+	})
+}
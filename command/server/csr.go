@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"go-certdist/common"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultCSRTimeout = 60 * time.Second
+
+// csrSigner signs the certificate signing requests of clients, which keep their private keys.
+type csrSigner struct {
+	config common.CSRConfig
+	ca     *internalCA // signs if no command is configured
+}
+
+func newCSRSigner(config common.CSRConfig, ca *internalCA) *csrSigner {
+	return &csrSigner{config: config, ca: ca}
+}
+
+// parseCSR parses the PEM encoded CSR, which has to be for exactly the domain.
+func parseCSR(data string, domain string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	if !slices.Equal(csr.DNSNames, []string{domain}) {
+		return nil, fmt.Errorf("certificate request must contain exactly the name %s", domain)
+	}
+	return csr, nil
+}
+
+// Allowed reports whether the key may request a certificate for the name, the internal CA
+// decides if no command is configured.
+func (s *csrSigner) Allowed(reqPublicKey string, name string) bool {
+	if s.config.Command == "" {
+		return s.ca.Allowed(reqPublicKey, name)
+	}
+	return clientAllowed(s.config.Clients, reqPublicKey, name)
+}
+
+// Sign returns cert.pem, chain.pem and fullchain.pem of the certificate signed for the CSR.
+func (s *csrSigner) Sign(ctx context.Context, domain string, csr *x509.CertificateRequest) (map[string][]byte, *x509.Certificate, error) {
+	if s.config.Command == "" {
+		der, err := s.ca.sign(domain, csr.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certificateFiles(der, s.ca.chainPEM()), leaf, nil
+	}
+
+	certs, err := s.runCommand(ctx, domain, csr)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf := certs[0]
+	if publicKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(csr.PublicKey) {
+		return nil, nil, fmt.Errorf("signing command returned a certificate for another key")
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return nil, nil, fmt.Errorf("signing command returned a certificate for another name: %w", err)
+	}
+	var chain []byte
+	for _, cert := range certs[1:] {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return certificateFiles(leaf.Raw, chain), leaf, nil
+}
+
+// runCommand passes the CSR to the signing command on stdin and reads the certificate
+// followed by its chain from stdout.
+func (s *csrSigner) runCommand(ctx context.Context, domain string, csr *x509.CertificateRequest) ([]*x509.Certificate, error) {
+	timeout := defaultCSRTimeout
+	if s.config.TimeoutSeconds > 0 {
+		timeout = time.Duration(s.config.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.config.Command)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "CERTDIST_DOMAIN="+domain)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("signing command failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var certs []*x509.Certificate
+	rest := stdout.Bytes()
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("signing command returned an invalid certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("signing command returned no certificate")
+	}
+	return certs, nil
+}
+
+// serveCSR answers a certificate request with CSR with the signed certificate and its chain.
+func (s *certificateServer) serveCSR(w http.ResponseWriter, r *http.Request, api apiVersion, req common.CertificateRequest, reqID string, logCtx zerolog.Logger, event *AuditEvent) {
+	if s.csr == nil {
+		logCtx.Warn().Str("domain", req.Domain).Msg("Received CSR, but signing is not enabled")
+		api.writeError(w, http.StatusBadRequest, common.ErrorCodeInvalidRequest, "Signing certificate requests is not enabled", reqID)
+		return
+	}
+	if !s.csr.Allowed(req.AgePublicKey, req.Domain) {
+		logCtx.Warn().Str("age_public_key", req.AgePublicKey).Str("domain", req.Domain).Msg("Signing certificates for the domain is not allowed for the key")
+		api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized for domain", reqID)
+		return
+	}
+	csr, err := parseCSR(req.CSR, req.Domain)
+	if err != nil {
+		logCtx.Warn().Err(err).Str("domain", req.Domain).Msg("Invalid certificate signing request")
+		api.writeError(w, http.StatusBadRequest, common.ErrorCodeInvalidRequest, "Invalid certificate signing request", reqID)
+		return
+	}
+
+	files, leaf, err := s.csr.Sign(r.Context(), req.Domain, csr)
+	if err != nil {
+		logCtx.Error().Err(err).Str("domain", req.Domain).Msg("Failed to sign certificate request")
+		api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Failed to sign certificate request", reqID)
+		return
+	}
+	encryptedData, err := common.EncryptAndZipBundle(nil, files, req.AgePublicKey)
+	if err != nil {
+		logCtx.Error().Err(err).Msg("Failed to encrypt certificates")
+		api.writeError(w, http.StatusInternalServerError, common.ErrorCodeServerMisconfigured, "Failed to bundle certificates", reqID)
+		return
+	}
+
+	serial := leaf.SerialNumber.Text(16)
+	logCtx.Info().Str("domain", req.Domain).Str("serial", serial).Time("expiration", leaf.NotAfter).Msg("Sending signed certificate")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(encryptedData); err != nil {
+		logCtx.Error().Err(err).Msg("Failed to write response")
+		return
+	}
+
+	event.SerialNumber = serial
+	s.inventory.RecordDelivery(req.AgePublicKey, req.Domain, serial)
+	s.webhooks.Dispatch(WebhookEvent{
+		Event:      eventCertificateDelivered,
+		RequestId:  reqID,
+		Domain:     req.Domain,
+		Expiration: leaf.NotAfter,
+		ClientKey:  req.AgePublicKey,
+		RemoteAddr: r.RemoteAddr,
+	})
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCSR(t *testing.T, key *ecdsa.PrivateKey, names ...string) []byte {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: names[0]}, DNSNames: names}, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestParseCSR(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, err = parseCSR(string(newTestCSR(t, key, "db.internal")), "db.internal")
+	assert.NoError(t, err)
+	_, err = parseCSR(string(newTestCSR(t, key, "db.internal", "example.com")), "db.internal")
+	assert.Error(t, err)
+	_, err = parseCSR("garbage", "db.internal")
+	assert.Error(t, err)
+}
+
+func TestHandleCertificateRequestCSR(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	config, ca := newTestCAConfig(t, common.CAClientConfig{PublicKey: identity.Recipient().String(), Names: []string{"*.internal"}})
+	store := newCertificateStore(nil)
+	internal, err := newInternalCA(config, store)
+	require.NoError(t, err)
+	s := &certificateServer{
+		config:  common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}, CA: config},
+		source:  store,
+		store:   store,
+		bundles: newBundleCache(),
+		ca:      internal,
+		csr:     newCSRSigner(common.CSRConfig{Enabled: true}, internal),
+	}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bundle, err := client.Do(context.Background(), certdist.Request{Domain: "db.internal", CSR: newTestCSR(t, key, "db.internal")})
+	require.NoError(t, err)
+	assert.Nil(t, bundle.PrivateKey)
+	assert.NotContains(t, bundle.Files, "privkey.pem")
+	assert.True(t, key.PublicKey.Equal(bundle.Certificate.PublicKey))
+	assert.NoError(t, bundle.Certificate.CheckSignatureFrom(ca.cert))
+	// The server never stores the certificate
+	assert.NoDirExists(t, filepath.Join(config.Directory, "db.internal"))
+
+	// Names the CA doesn't issue for the key are refused
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "example.com", CSR: newTestCSR(t, key, "example.com")})
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+
+	// The CSR has to match the requested domain
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "db.internal", CSR: newTestCSR(t, key, "web.internal")})
+	var serverErr *certdist.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, http.StatusBadRequest, serverErr.StatusCode)
+
+	// Without signer, CSRs are rejected
+	s.csr = nil
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "db.internal", CSR: newTestCSR(t, key, "db.internal")})
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, http.StatusBadRequest, serverErr.StatusCode)
+}
+
+func TestCSRSignerCommand(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("External CA"))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// The signing command is a stand-in for an external CA, it returns a prepared certificate
+	template := leafTemplate()
+	template.SerialNumber = big.NewInt(42)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	chainFile := filepath.Join(dir, "chain.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	require.NoError(t, os.WriteFile(chainFile, chain, 0600))
+
+	signer := newCSRSigner(common.CSRConfig{Enabled: true, Command: `test "$CERTDIST_DOMAIN" = example.com && grep -q "CERTIFICATE REQUEST" && cat ` + chainFile}, nil)
+	csr, err := parseCSR(string(newTestCSR(t, key, "example.com")), "example.com")
+	require.NoError(t, err)
+	files, leaf, err := signer.Sign(context.Background(), "example.com", csr)
+	require.NoError(t, err)
+	assert.True(t, key.PublicKey.Equal(leaf.PublicKey))
+	assert.Equal(t, chain, files["fullchain.pem"])
+
+	// Certificates for another key are rejected
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	csr, err = parseCSR(string(newTestCSR(t, otherKey, "example.com")), "example.com")
+	require.NoError(t, err)
+	_, _, err = signer.Sign(context.Background(), "example.com", csr)
+	assert.ErrorContains(t, err, "another key")
+
+	signer.config.Command = "exit 1"
+	_, _, err = signer.Sign(context.Background(), "example.com", csr)
+	assert.Error(t, err)
+}
+
+func TestHandleCertificateRequestCSRCommandNames(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	// The command fails, so a request reaching it is answered with an internal error
+	config := common.CSRConfig{
+		Enabled: true,
+		Command: "exit 1",
+		Clients: []common.CAClientConfig{{PublicKey: identity.Recipient().String(), Names: []string{"*.example.com"}}},
+	}
+	s := &certificateServer{
+		config: common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}, CSR: config},
+		csr:    newCSRSigner(config, nil),
+	}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "www.example.com", CSR: newTestCSR(t, key, "www.example.com")})
+	var serverErr *certdist.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, http.StatusInternalServerError, serverErr.StatusCode)
+
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "db.internal", CSR: newTestCSR(t, key, "db.internal")})
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+}
+
+func TestValidateCSR(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	config := &common.ServerModeConfig{CSR: common.CSRConfig{Enabled: true, Command: "/usr/local/bin/sign-csr"}}
+	assert.Error(t, validateCSRAndRevocation(config))
+
+	config.CSR.Clients = []common.CAClientConfig{{PublicKey: publicKey}}
+	assert.Error(t, validateCSRAndRevocation(config))
+
+	config.CSR.Clients[0].Names = []string{"*.example.com"}
+	assert.NoError(t, validateCSRAndRevocation(config))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"go-certdist/common"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// containsKey compares the key against all keys in constant time.
+func containsKey(keys []string, key string) bool {
+	found := false
+	for _, allowedKey := range keys {
+		if subtle.ConstantTimeCompare([]byte(common.NormalizePublicKey(allowedKey)), []byte(key)) == 1 {
+			found = true
+			// no break, constant time comparisons
+		}
+	}
+	return found
+}
+
+// domainAllowed reports whether the domain matches one of the group's domains.
+func domainAllowed(group common.ClientGroupConfig, domain string) bool {
+	if len(group.Domains) == 0 {
+		return true
+	}
+	for _, pattern := range group.Domains {
+		if matched, _ := path.Match(pattern, domain); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeDomain checks whether the key may request certificates for the domain. Keys in
+// public_age_keys may request all domains, group members only the domains of their groups.
+func authorizeDomain(config common.ServerModeConfig, reqPublicKey string, domain string) error {
+	reqPublicKey = common.NormalizePublicKey(reqPublicKey)
+	if containsKey(config.PublicAgeKeys, reqPublicKey) {
+		return nil
+	}
+	for _, group := range config.ClientGroups {
+		if containsKey(group.Members, reqPublicKey) && domainAllowed(group, domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("public key not authorized for domain %s", domain)
+}
+
+// sharedBundleGroup returns the first group with a shared bundle the key may use for the domain.
+func sharedBundleGroup(config common.ServerModeConfig, reqPublicKey string, domain string) *common.ClientGroupConfig {
+	reqPublicKey = common.NormalizePublicKey(reqPublicKey)
+	for i, group := range config.ClientGroups {
+		if group.SharedBundle && containsKey(group.Members, reqPublicKey) && domainAllowed(group, domain) {
+			return &config.ClientGroups[i]
+		}
+	}
+	return nil
+}
+
+type cachedBundle struct {
+	fingerprint string
+	data        []byte
+}
+
+// bundleCache keeps the bundles encrypted to all members of a group, so every member
+// receives the identical artifact until the certificates change.
+type bundleCache struct {
+	mu      sync.Mutex
+	bundles map[string]cachedBundle // group name + domain -> bundle
+}
+
+func newBundleCache() *bundleCache {
+	return &bundleCache{bundles: make(map[string]cachedBundle)}
+}
+
+// Get returns the cached bundle of the group for the domain, or encrypts a new one if the
+// certificates or the extra files changed since it was cached.
+func (c *bundleCache) Get(group common.ClientGroupConfig, domain string, certificates []*common.CertificateInfo, extraFiles map[string][]byte) ([]byte, error) {
+	fingerprint, err := common.FingerprintCertificates(certificates)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint += fingerprintFiles(extraFiles)
+
+	key := group.Name + "\x00" + domain
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bundle, ok := c.bundles[key]; ok && bundle.fingerprint == fingerprint {
+		return bundle.data, nil
+	}
+
+	data, err := common.EncryptAndZipBundle(certificates, extraFiles, group.Members...)
+	if err != nil {
+		return nil, err
+	}
+	c.bundles[key] = cachedBundle{fingerprint: fingerprint, data: data}
+	log.Info().Str("group", group.Name).Str("domain", domain).Msg("Encrypted shared bundle for client group")
+	return data, nil
+}
+
+func fingerprintFiles(files map[string][]byte) string {
+	names := slices.Sorted(maps.Keys(files))
+	hash := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hash, "%s\x00%d\x00", name, len(files[name]))
+		hash.Write(files[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// expandDomains returns the domains of the group, patterns are replaced by the matching
+// domains of the loaded certificates. Wildcard names of certificates are never returned.
+func expandDomains(group common.ClientGroupConfig, directoryCertificates []common.DirectoryCertificates) ([]string, error) {
+	var domains []string
+	for _, pattern := range group.Domains {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if !slices.Contains(domains, pattern) {
+				domains = append(domains, pattern)
+			}
+			continue
+		}
+		var matches []string
+		for _, dir := range directoryCertificates {
+			for _, cert := range dir.Certificates {
+				if cert.FileType != common.FileTypePublicCertificate {
+					continue
+				}
+				for _, domain := range cert.Domains {
+					if matched, _ := path.Match(pattern, domain); matched && !strings.Contains(domain, "*") && !slices.Contains(matches, domain) {
+						matches = append(matches, domain)
+					}
+				}
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no certificate found for domain pattern %s", pattern)
+		}
+		slices.Sort(matches)
+		for _, domain := range matches {
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains, nil
+}
+
+// WriteGroupBundles pre-generates the shared bundle of every domain of the group as
+// <domain>.age in the output directory, patterns are expanded to the domains of the
+// certificates they match. Like the served bundles, they contain the OCSP responses if
+// OCSP is enabled.
+func WriteGroupBundles(config common.ServerModeConfig, groupName string, outputDir string) error {
+	config = common.CopyConfig(config)
+	if err := validateAgeKeys(&config); err != nil {
+		return err
+	}
+	var group *common.ClientGroupConfig
+	for i := range config.ClientGroups {
+		if config.ClientGroups[i].Name == groupName {
+			group = &config.ClientGroups[i]
+		}
+	}
+	if group == nil {
+		return fmt.Errorf("client group %s is not configured", groupName)
+	}
+	if len(group.Domains) == 0 {
+		return fmt.Errorf("client group %s has no domains configured", groupName)
+	}
+
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return err
+	}
+	store := newCertificateStore(config.ServerDetails.CertificateDirectory)
+	directoryCertificates := store.Certificates()
+	domains, err := expandDomains(*group, directoryCertificates)
+	if err != nil {
+		return err
+	}
+	var stapler *ocspStapler
+	if config.OCSP.Enabled {
+		stapler = newOCSPStapler(config.OCSP, store, newHealthState())
+		stapler.Refresh()
+	}
+	for _, domain := range domains {
+		foundCerts := common.FindCertificate(directoryCertificates, domain)
+		primaryCert := common.PrimaryCertificate(foundCerts)
+		if primaryCert == nil {
+			return fmt.Errorf("no certificate found for domain %s", domain)
+		}
+		extraFiles := make(map[string][]byte)
+		if response := stapler.Response(foundCerts); response != nil {
+			extraFiles[ocspFileName(primaryCert)] = response.Raw
+		}
+		data, err := common.EncryptAndZipBundle(foundCerts, extraFiles, group.Members...)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt bundle for domain %s: %w", domain, err)
+		}
+		outputFile := filepath.Join(outputDir, domain+".age")
+		if err := os.WriteFile(outputFile, data, 0600); err != nil {
+			return err
+		}
+		log.Info().Str("group", group.Name).Str("domain", domain).Str("file", outputFile).Msg("Wrote shared bundle")
+	}
+	return nil
+}
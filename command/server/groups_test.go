@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"go-certdist/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeDomain(t *testing.T) {
+	_, adminKey := common.NewAgeTestKey(t)
+	_, memberKey := common.NewAgeTestKey(t)
+	_, otherKey := common.NewAgeTestKey(t)
+	config := common.ServerModeConfig{
+		PublicAgeKeys: []string{adminKey},
+		ClientGroups: []common.ClientGroupConfig{
+			{Name: "lb", Members: []string{memberKey}, Domains: []string{"*.example.com"}, SharedBundle: true},
+		},
+	}
+
+	assert.NoError(t, authorizeDomain(config, adminKey, "other.com"))
+	assert.NoError(t, authorizeDomain(config, memberKey, "www.example.com"))
+	assert.Error(t, authorizeDomain(config, memberKey, "other.com"))
+	assert.Error(t, authorizeDomain(config, otherKey, "www.example.com"))
+
+	assert.NoError(t, validateAgePublicKey(config, memberKey))
+	assert.Nil(t, sharedBundleGroup(config, adminKey, "www.example.com"))
+	require.NotNil(t, sharedBundleGroup(config, memberKey, "www.example.com"))
+	assert.Equal(t, "lb", sharedBundleGroup(config, memberKey, "www.example.com").Name)
+}
+
+func TestBundleCache(t *testing.T) {
+	privateKey1, publicKey1 := common.NewAgeTestKey(t)
+	privateKey2, publicKey2 := common.NewAgeTestKey(t)
+	group := common.ClientGroupConfig{Name: "lb", Members: []string{publicKey1, publicKey2}, SharedBundle: true}
+
+	certDir := t.TempDir()
+	common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(24*time.Hour))
+	certificates := common.FindCertificate(common.LoadCertificates([]string{certDir}), "example.com")
+
+	cache := newBundleCache()
+	bundle1, err := cache.Get(group, "example.com", certificates, nil)
+	require.NoError(t, err)
+	bundle2, err := cache.Get(group, "example.com", certificates, nil)
+	require.NoError(t, err)
+	assert.Equal(t, bundle1, bundle2, "every member receives the identical bundle")
+
+	for _, privateKey := range []string{privateKey1, privateKey2} {
+		identity, err := age.ParseX25519Identity(privateKey)
+		require.NoError(t, err)
+		_, err = age.Decrypt(bytes.NewReader(bundle1), identity)
+		assert.NoError(t, err)
+	}
+
+	t.Run("re-encrypted after renewal", func(t *testing.T) {
+		common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(48*time.Hour))
+		bundle3, err := cache.Get(group, "example.com", certificates, nil)
+		require.NoError(t, err)
+		assert.NotEqual(t, bundle1, bundle3)
+	})
+}
+
+func TestWriteGroupBundles(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	var directories []string
+	for _, domain := range []string{"www.example.com", "api.example.com", "example.org"} {
+		dir := filepath.Join(t.TempDir(), domain)
+		require.NoError(t, os.MkdirAll(dir, 0700))
+		common.NewTestCertificate(t, dir, domain, time.Now().Add(24*time.Hour))
+		directories = append(directories, dir)
+	}
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{CertificateDirectory: directories},
+		ClientGroups: []common.ClientGroupConfig{
+			{Name: "lb", Members: []string{publicKey}, Domains: []string{"*.example.com", "www.example.com"}},
+			{Name: "mail", Members: []string{publicKey}, Domains: []string{"*.example.net"}},
+		},
+	}
+
+	outputDir := t.TempDir()
+	require.NoError(t, WriteGroupBundles(config, "lb", outputDir))
+	entries, err := os.ReadDir(outputDir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"api.example.com.age", "www.example.com.age"}, names)
+
+	assert.ErrorContains(t, WriteGroupBundles(config, "mail", t.TempDir()), "no certificate found for domain pattern *.example.net")
+
+	// The config is validated like on startup
+	config.ClientGroups[0].Members = []string{"invalid"}
+	assert.ErrorContains(t, WriteGroupBundles(config, "lb", t.TempDir()), "invalid member key")
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"go-certdist/common"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CertificateSource provides the certificate files handed out by the server.
+type CertificateSource interface {
+	// FindCertificates returns all files belonging to the certificate of the domain, or
+	// none if there is no certificate for it.
+	FindCertificates(domain string) ([]*common.CertificateInfo, error)
+}
+
+// candidateSource is implemented by sources with alternative certificates for a domain,
+// e.g. in multiple directories.
+type candidateSource interface {
+	FindCandidates(domain string) ([][]*common.CertificateInfo, error)
+}
+
+// DirectorySource returns a source reading the certificate directories on every request,
+// like the standalone server does.
+func DirectorySource(directories []string) CertificateSource {
+	return newCertificateStore(directories)
+}
+
+// AuditEvent describes the outcome of a certificate or artifact request.
+type AuditEvent struct {
+	Time         time.Time
+	RequestId    string
+	RemoteAddr   string
+	Domain       string
+	Artifact     string // name of the requested artifact, Domain is empty then
+	ClientKey    string
+	Status       int    // HTTP status code sent to the client
+	SerialNumber string // of the delivered certificate, only set if one was sent
+}
+
+// HandlerOptions configures the handler returned by NewHandler.
+type HandlerOptions struct {
+	// Config provides the authorized keys, client groups and the chain validation policy,
+	// server details, webhooks and the expiry watchdog are not used by the handler.
+	Config common.ServerModeConfig
+	Source CertificateSource
+	// Authorize is called after the key of the client was accepted by the configured keys
+	// and groups. Returning an error rejects the request with 403. Artifact requests are
+	// passed without Domain.
+	Authorize func(r *http.Request, req common.CertificateRequest) error
+	// Audit is called after every certificate and artifact request.
+	Audit func(event AuditEvent)
+	// RefreshInterval defines how often a DirectorySource is reloaded to notify watching
+	// clients about changed certificates, defaults to 60 seconds.
+	RefreshInterval time.Duration
+}
+
+// Handler serves the API of the server. Close it to stop reloading the certificate
+// directories in the background.
+type Handler struct {
+	mux       *http.ServeMux
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close stops reloading the certificate directories, watching clients are then only
+// notified about changes found by certificate requests.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() { close(h.stop) })
+	return nil
+}
+
+// NewHandler returns the API of the server as http.Handler, so it can be mounted into an
+// existing server, e.g. with http.StripPrefix. Watching for changes is only supported with
+// a DirectorySource, which is reloaded in the background until the handler is closed.
+func NewHandler(options HandlerOptions) (*Handler, error) {
+	if options.Source == nil {
+		return nil, fmt.Errorf("a certificate source is required")
+	}
+	// The keys are normalized in place, the caller's config must not change
+	config := common.CopyConfig(options.Config)
+	if err := validateAgeKeys(&config); err != nil {
+		return nil, err
+	}
+
+	validator, err := newChainValidator(config.ChainValidation, newHealthState())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &certificateServer{
+		config:    config,
+		source:    options.Source,
+		validator: validator,
+		bundles:   newBundleCache(),
+		artifacts: newArtifactCache(),
+		authorize: options.Authorize,
+		auditHook: options.Audit,
+	}
+	handler := &Handler{stop: make(chan struct{})}
+	if store, ok := options.Source.(*certificateStore); ok {
+		s.store = store
+		interval := options.RefreshInterval
+		if interval <= 0 {
+			interval = defaultRefreshInterval
+		}
+		go store.Run(interval, handler.stop)
+	}
+	handler.mux = s.routes()
+	return handler, nil
+}
+
+// routes registers all API endpoints on a new mux.
+func (s *certificateServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.CertificateRequestEndpoint, s.handleCertificateRequest(apiV1))
+	mux.HandleFunc(common.CertificateRequestEndpointV2, s.handleCertificateRequest(apiV2))
+	if s.store != nil {
+		mux.HandleFunc(common.WatchEndpoint, s.handleWatchRequest(apiV1))
+		mux.HandleFunc(common.WatchEndpointV2, s.handleWatchRequest(apiV2))
+	}
+	mux.HandleFunc(common.InfoEndpoint, s.handleInfo)
+	mux.HandleFunc(common.ArtifactRequestEndpoint, s.handleArtifactRequest)
+	return mux
+}
+
+func (s *certificateServer) audit(event *AuditEvent, w *statusRecorder) {
+	if s.auditHook == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Status = w.status
+	s.auditHook(*event)
+}
+
+// statusRecorder remembers the status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
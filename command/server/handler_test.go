@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticSource serves the certificates of a single directory for any domain.
+type staticSource struct {
+	certificates []*common.CertificateInfo
+}
+
+func (s staticSource) FindCertificates(domain string) ([]*common.CertificateInfo, error) {
+	return s.certificates, nil
+}
+
+func TestNewHandlerRequiresSource(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	_, err := NewHandler(HandlerOptions{Config: common.ServerModeConfig{PublicAgeKeys: []string{publicKey}}})
+	assert.Error(t, err)
+}
+
+func TestNewHandlerKeepsConfig(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	keys := []string{" " + publicKey + "\n"}
+	members := []string{" " + publicKey + "\n"}
+	config := common.ServerModeConfig{
+		PublicAgeKeys: keys,
+		ClientGroups:  []common.ClientGroupConfig{{Name: "lb", Members: members, Domains: []string{"example.com"}}},
+	}
+
+	handler, err := NewHandler(HandlerOptions{Config: config, Source: staticSource{}})
+	require.NoError(t, err)
+	defer func() { _ = handler.Close() }()
+	// The keys were normalized in a copy only
+	assert.Equal(t, " "+publicKey+"\n", keys[0])
+	assert.Equal(t, " "+publicKey+"\n", members[0])
+}
+
+func TestNewHandlerMountedWithPrefix(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	common.NewTestCertificate(t, dir, "example.com", time.Now().Add(30*24*time.Hour))
+	source := staticSource{certificates: common.LoadCertificates([]string{dir})[0].Certificates}
+
+	var mu sync.Mutex
+	var events []AuditEvent
+	handler, err := NewHandler(HandlerOptions{
+		Config: common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}},
+		Source: source,
+		Authorize: func(r *http.Request, req common.CertificateRequest) error {
+			if req.Domain != "example.com" {
+				return fmt.Errorf("domain %s is not allowed", req.Domain)
+			}
+			return nil
+		},
+		Audit: func(event AuditEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		},
+	})
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/certdist/", http.StripPrefix("/certdist", handler))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := certdist.NewClient(srv.URL+"/certdist", identity, identity.Recipient().String())
+	info, err := client.Info(context.Background())
+	require.NoError(t, err)
+	assert.NotContains(t, info.Features, common.FeatureWatch)
+
+	bundle, err := client.Fetch(context.Background(), "example.com", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, bundle.Certificate.DNSNames)
+
+	_, err = client.Fetch(context.Background(), "other.example.com", time.Time{})
+	assert.ErrorIs(t, err, certdist.ErrForbidden)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 2)
+	assert.Equal(t, "example.com", events[0].Domain)
+	assert.Equal(t, http.StatusOK, events[0].Status)
+	assert.Equal(t, "539", events[0].SerialNumber)
+	assert.Equal(t, identity.Recipient().String(), events[0].ClientKey)
+	assert.Equal(t, "other.example.com", events[1].Domain)
+	assert.Equal(t, http.StatusForbidden, events[1].Status)
+	assert.Empty(t, events[1].SerialNumber)
+	assert.NotEmpty(t, events[1].RequestId)
+}
+
+func TestNewHandlerReloadsDirectorySource(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	certDir := t.TempDir()
+	common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(24*time.Hour))
+
+	handler, err := NewHandler(HandlerOptions{
+		Config:          common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}},
+		Source:          DirectorySource([]string{certDir}),
+		RefreshInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = handler.Close() }()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+	baseline, err := client.Watch(context.Background(), []string{"example.com"}, nil, time.Second)
+	require.NoError(t, err)
+	require.NotEmpty(t, baseline.Versions["example.com"])
+
+	renewedDir := t.TempDir()
+	renewedCert, _ := common.NewTestCertificate(t, renewedDir, "example.com", time.Now().Add(48*time.Hour))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = os.Rename(renewedCert, filepath.Join(certDir, "cert.pem"))
+	}()
+
+	// Nothing but the background reload notices the renewed certificate
+	resp, err := client.Watch(context.Background(), []string{"example.com"}, baseline.Versions, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, resp.Changed)
+	assert.NotEqual(t, baseline.Versions["example.com"], resp.Versions["example.com"])
+}
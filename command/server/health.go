@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// healthState collects the problems reported by the background jobs of the server.
+// The server is healthy as long as no component reports a problem.
+type healthState struct {
+	mu       sync.RWMutex
+	problems map[string][]string // component -> problems
+}
+
+func newHealthState() *healthState {
+	return &healthState{problems: make(map[string][]string)}
+}
+
+// Set replaces the problems of the given component, an empty list marks it healthy.
+func (h *healthState) Set(component string, problems []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(problems) == 0 {
+		delete(h.problems, component)
+		return
+	}
+	h.problems[component] = problems
+}
+
+// Problems returns all reported problems, sorted by component.
+func (h *healthState) Problems() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	components := make([]string, 0, len(h.problems))
+	for component := range h.problems {
+		components = append(components, component)
+	}
+	slices.Sort(components)
+
+	var result []string
+	for _, component := range components {
+		for _, problem := range h.problems[component] {
+			result = append(result, fmt.Sprintf("%s: %s", component, problem))
+		}
+	}
+	return result
+}
+
+func handleHealthCheck(health *healthState) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		problems := health.Problems()
+		w.WriteHeader(http.StatusOK)
+		if len(problems) == 0 {
+			_, _ = fmt.Fprintln(w, "OK")
+			return
+		}
+
+		// Still serving certificates, so the server is degraded but not down
+		_, _ = fmt.Fprintln(w, "DEGRADED")
+		for _, problem := range problems {
+			_, _ = fmt.Fprintln(w, problem)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-certdist/common"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ClientRecord is what the server remembers about a client, identified by its public key.
+type ClientRecord struct {
+	PublicKey     string                   `json:"public_key"`
+	LastSeen      time.Time                `json:"last_seen"`
+	RemoteAddr    string                   `json:"remote_addr"`
+	ClientVersion string                   `json:"client_version,omitempty"`
+	Domains       map[string]*DomainRecord `json:"domains"`
+}
+
+// DomainRecord tracks the certificate of one domain requested by a client.
+type DomainRecord struct {
+	LastRequested   time.Time `json:"last_requested"`
+	SerialNumber    string    `json:"serial_number,omitempty"` // reported by the client
+	Expiration      time.Time `json:"expiration,omitzero"`     // reported by the client
+	DeliveredSerial string    `json:"delivered_serial,omitempty"`
+	DeliveredAt     time.Time `json:"delivered_at,omitzero"`
+}
+
+// inventoryFlushInterval defines how often changes of the inventory are written to its file.
+const inventoryFlushInterval = 30 * time.Second
+
+// clientInventory keeps track of all clients and persists them to a JSON file, if configured.
+// Changes are written by Run in the flush interval and by Flush, e.g. on shutdown.
+type clientInventory struct {
+	path string
+
+	mu      sync.Mutex
+	clients map[string]*ClientRecord
+	dirty   bool // changed since the last flush
+}
+
+func newClientInventory(path string) (*clientInventory, error) {
+	inventory := &clientInventory{path: path, clients: make(map[string]*ClientRecord)}
+	if path == "" {
+		return inventory, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inventory, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory file: %w", err)
+	}
+	if err := json.Unmarshal(data, &inventory.clients); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory file %s: %w", path, err)
+	}
+	return inventory, nil
+}
+
+// RecordRequest stores the details of a certificate request of an authorized client.
+func (i *clientInventory) RecordRequest(req common.CertificateRequest, remoteAddr string) {
+	i.update(req.AgePublicKey, req.Domain, func(client *ClientRecord, domain *DomainRecord) {
+		client.RemoteAddr = remoteAddr
+		client.ClientVersion = req.ClientVersion
+		domain.LastRequested = client.LastSeen
+		domain.SerialNumber = req.SerialNumber
+		domain.Expiration = req.Expiration
+	})
+}
+
+// RecordArtifactRequest stores the details of an artifact request of an authorized client.
+func (i *clientInventory) RecordArtifactRequest(req common.ArtifactRequest, remoteAddr string) {
+	i.update(req.AgePublicKey, "", func(client *ClientRecord, _ *DomainRecord) {
+		client.RemoteAddr = remoteAddr
+		client.ClientVersion = req.ClientVersion
+	})
+}
+
+// RecordDelivery stores which certificate was sent to the client.
+func (i *clientInventory) RecordDelivery(publicKey, domainName, serialNumber string) {
+	i.update(publicKey, domainName, func(client *ClientRecord, domain *DomainRecord) {
+		domain.DeliveredSerial = serialNumber
+		domain.DeliveredAt = client.LastSeen
+	})
+}
+
+func (i *clientInventory) update(publicKey, domainName string, apply func(client *ClientRecord, domain *DomainRecord)) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	client, ok := i.clients[publicKey]
+	if !ok {
+		client = &ClientRecord{PublicKey: publicKey, Domains: make(map[string]*DomainRecord)}
+		i.clients[publicKey] = client
+	}
+	// Requests without domain, e.g. of artifacts, only update the client
+	var domain *DomainRecord
+	if domainName != "" {
+		var ok bool
+		if domain, ok = client.Domains[domainName]; !ok {
+			domain = &DomainRecord{}
+			client.Domains[domainName] = domain
+		}
+	}
+	client.LastSeen = time.Now().UTC()
+	apply(client, domain)
+	i.dirty = true
+}
+
+// Run flushes the inventory in the flush interval and a last time when stop is closed.
+func (i *clientInventory) Run(stop <-chan struct{}) {
+	if i == nil || i.path == "" {
+		return
+	}
+	ticker := time.NewTicker(inventoryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			i.flushOrLog()
+			return
+		}
+		i.flushOrLog()
+	}
+}
+
+// Flush writes the inventory to its file if it changed since the last flush.
+func (i *clientInventory) Flush() error {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.dirty {
+		return nil
+	}
+	if err := i.save(); err != nil {
+		return err
+	}
+	i.dirty = false
+	return nil
+}
+
+func (i *clientInventory) flushOrLog() {
+	if err := i.Flush(); err != nil {
+		log.Error().Err(err).Str("path", i.path).Msg("Failed to persist client inventory")
+	}
+}
+
+// save writes the inventory atomically, callers have to hold the lock.
+func (i *clientInventory) save() error {
+	if i.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(i.clients, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(i.path), ".inventory-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), i.path)
+}
+
+// Clients returns a copy of all client records, sorted by public key.
+func (i *clientInventory) Clients() []ClientRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	result := make([]ClientRecord, 0, len(i.clients))
+	for _, client := range i.clients {
+		record := *client
+		record.Domains = make(map[string]*DomainRecord, len(client.Domains))
+		for name, domain := range client.Domains {
+			domainCopy := *domain
+			record.Domains[name] = &domainCopy
+		}
+		result = append(result, record)
+	}
+	slices.SortFunc(result, func(a, b ClientRecord) int {
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+	return result
+}
+
+// PrintInventory lists all known clients of the server, flagging clients that have not
+// checked in within staleAfter and clients still holding an outdated certificate.
+func PrintInventory(config common.ServerModeConfig, staleAfter time.Duration) error {
+	if config.ServerDetails.InventoryFile == "" {
+		return fmt.Errorf("server.inventory_file is not configured")
+	}
+	inventory, err := newClientInventory(config.ServerDetails.InventoryFile)
+	if err != nil {
+		return err
+	}
+	directoryCertificates := common.LoadCertificates(config.ServerDetails.CertificateDirectory)
+
+	for _, client := range inventory.Clients() {
+		status := "active"
+		if time.Since(client.LastSeen) > staleAfter {
+			status = "STALE"
+		}
+		fmt.Printf("%s\n", client.PublicKey)
+		fmt.Printf("  status:     %s\n", status)
+		fmt.Printf("  last seen:  %s (%s ago)\n", client.LastSeen.Format(time.RFC3339), time.Since(client.LastSeen).Round(time.Minute))
+		fmt.Printf("  address:    %s\n", client.RemoteAddr)
+		fmt.Printf("  version:    %s\n", client.ClientVersion)
+
+		domains := make([]string, 0, len(client.Domains))
+		for name := range client.Domains {
+			domains = append(domains, name)
+		}
+		slices.Sort(domains)
+		for _, name := range domains {
+			domain := client.Domains[name]
+			fmt.Printf("  domain:     %s serial=%s %s\n", name, domain.SerialNumber, certificateStatus(directoryCertificates, name, domain))
+		}
+	}
+	return nil
+}
+
+func certificateStatus(directoryCertificates []common.DirectoryCertificates, domainName string, domain *DomainRecord) string {
+	current := common.PrimaryCertificate(common.FindCertificate(directoryCertificates, domainName))
+	switch {
+	case current == nil:
+		return "(no certificate on server)"
+	case domain.SerialNumber == "":
+		return "(no certificate on client)"
+	case domain.SerialNumber == current.SerialNumber:
+		return "(current)"
+	default:
+		return fmt.Sprintf("(OUTDATED, server has %s)", current.SerialNumber)
+	}
+}
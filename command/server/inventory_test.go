@@ -0,0 +1,66 @@
+package server
+
+import (
+	"go-certdist/common"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	_, publicKey := common.NewAgeTestKey(t)
+
+	inventory, err := newClientInventory(path)
+	require.NoError(t, err)
+
+	inventory.RecordRequest(common.CertificateRequest{
+		Domain:        "example.com",
+		AgePublicKey:  publicKey,
+		SerialNumber:  "1",
+		ClientVersion: "1.2.3",
+	}, "192.0.2.1:1234")
+	inventory.RecordDelivery(publicKey, "example.com", "2")
+	// Requests only change the inventory in memory
+	assert.NoFileExists(t, path)
+	require.NoError(t, inventory.Flush())
+
+	t.Run("persisted and reloaded", func(t *testing.T) {
+		reloaded, err := newClientInventory(path)
+		require.NoError(t, err)
+
+		clients := reloaded.Clients()
+		require.Len(t, clients, 1)
+		assert.Equal(t, publicKey, clients[0].PublicKey)
+		assert.Equal(t, "192.0.2.1:1234", clients[0].RemoteAddr)
+		assert.Equal(t, "1.2.3", clients[0].ClientVersion)
+		assert.WithinDuration(t, time.Now(), clients[0].LastSeen, time.Minute)
+		require.Contains(t, clients[0].Domains, "example.com")
+		assert.Equal(t, "1", clients[0].Domains["example.com"].SerialNumber)
+		assert.Equal(t, "2", clients[0].Domains["example.com"].DeliveredSerial)
+	})
+
+	t.Run("flushed when stopped", func(t *testing.T) {
+		inventory.RecordDelivery(publicKey, "example.com", "3")
+		stop := make(chan struct{})
+		close(stop)
+		inventory.Run(stop)
+
+		reloaded, err := newClientInventory(path)
+		require.NoError(t, err)
+		assert.Equal(t, "3", reloaded.Clients()[0].Domains["example.com"].DeliveredSerial)
+	})
+
+	t.Run("certificate status", func(t *testing.T) {
+		certDir := t.TempDir()
+		common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(24*time.Hour))
+		directoryCertificates := common.LoadCertificates([]string{certDir})
+
+		assert.Equal(t, "(current)", certificateStatus(directoryCertificates, "example.com", &DomainRecord{SerialNumber: "539"}))
+		assert.Contains(t, certificateStatus(directoryCertificates, "example.com", &DomainRecord{SerialNumber: "1"}), "OUTDATED")
+		assert.Contains(t, certificateStatus(directoryCertificates, "unknown.com", &DomainRecord{SerialNumber: "1"}), "no certificate on server")
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// First file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+const systemdListenFdsStart = 3
+
+// openListeners opens all listeners of the server. Sockets inherited via systemd socket
+// activation take precedence over the configured addresses.
+func openListeners(details common.ServerDetailsConfig) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		log.Info().Int("count", len(listeners)).Msg("Using listeners inherited via systemd socket activation")
+		return listeners, nil
+	}
+
+	for _, address := range listenAddresses(details) {
+		listener, err := openListener(address, details.SocketMode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenAddresses returns all configured addresses, including listen_address and port.
+func listenAddresses(details common.ServerDetailsConfig) []string {
+	addresses := append([]string{}, details.Listen...)
+	if details.Port != 0 {
+		addresses = append(addresses, fmt.Sprintf("tcp:%s:%d", details.ListenAddress, details.Port))
+	}
+	return addresses
+}
+
+// parseListenAddress splits an address into network and address, addresses without a
+// network prefix are TCP addresses.
+func parseListenAddress(address string) (network string, addr string, err error) {
+	network, addr, found := strings.Cut(address, ":")
+	if found && (network == "unix" || network == "tcp") {
+		if addr == "" {
+			return "", "", fmt.Errorf("listen address %s is missing the address", address)
+		}
+		return network, addr, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %s: %w", address, err)
+	}
+	return "tcp", address, nil
+}
+
+func openListener(address string, socketMode string) (net.Listener, error) {
+	network, addr, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		// Remove a stale socket of a previous run, but never a regular file
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket %s: %w", addr, err)
+			}
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	if network == "unix" && socketMode != "" {
+		mode, err := parseSocketMode(socketMode)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		if err := os.Chmod(addr, mode); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to change permissions of socket %s: %w", addr, err)
+		}
+	}
+	return listener, nil
+}
+
+func parseSocketMode(socketMode string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid server.socket_mode %s, expected an octal mode like 0660", socketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// systemdListeners returns the listeners passed via systemd socket activation, if any.
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to renew commands started by the server
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close() // FileListener duplicates the descriptor
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("failed to use socket %d passed by systemd: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// socketActivated reports whether the server was started via systemd socket activation.
+func socketActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != ""
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Warn().Err(err).Str("address", listener.Addr().String()).Msg("Failed to close listener")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"go-certdist/common"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{address: "unix:/run/certdist.sock", network: "unix", addr: "/run/certdist.sock"},
+		{address: "tcp:0.0.0.0:8080", network: "tcp", addr: "0.0.0.0:8080"},
+		{address: "127.0.0.1:8080", network: "tcp", addr: "127.0.0.1:8080"},
+		{address: "[::1]:8080", network: "tcp", addr: "[::1]:8080"},
+		{address: "unix:", wantErr: true},
+		{address: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			network, addr, err := parseListenAddress(tt.address)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.network, network)
+			assert.Equal(t, tt.addr, addr)
+		})
+	}
+}
+
+func TestListenAddressesYaml(t *testing.T) {
+	var details common.ServerDetailsConfig
+	require.NoError(t, yaml.Unmarshal([]byte("listen: unix:/run/certdist.sock"), &details))
+	assert.Equal(t, common.ListenAddresses{"unix:/run/certdist.sock"}, details.Listen)
+
+	require.NoError(t, yaml.Unmarshal([]byte("listen: [\"unix:/run/certdist.sock\", \"tcp:127.0.0.1:8080\"]"), &details))
+	assert.Equal(t, common.ListenAddresses{"unix:/run/certdist.sock", "tcp:127.0.0.1:8080"}, details.Listen)
+}
+
+func TestOpenListeners(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "certdist.sock")
+	details := common.ServerDetailsConfig{
+		Listen:     common.ListenAddresses{"unix:" + socketPath, "tcp:127.0.0.1:0"},
+		SocketMode: "0600",
+	}
+
+	listeners, err := openListeners(details)
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, "unix", listeners[0].Addr().Network())
+	assert.Equal(t, "tcp", listeners[1].Addr().Network())
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	closeListeners(listeners)
+}
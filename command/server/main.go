@@ -1,47 +1,170 @@
 package server
 
 import (
-	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"go-certdist/common"
 	"io"
-	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// certificateServer holds the state shared by the request handlers.
+type certificateServer struct {
+	config     common.ServerModeConfig
+	source     CertificateSource
+	store      *certificateStore // nil if the source is not a directory store
+	webhooks   *webhookDispatcher
+	inventory  *clientInventory
+	bundles    *bundleCache
+	artifacts  *artifactCache
+	health     *healthState
+	validator  *chainValidator
+	stapler    *ocspStapler       // nil if OCSP is disabled
+	revocation *revocationChecker // nil if revocation checks are disabled
+	ca         *internalCA        // nil if the server doesn't issue certificates
+	csr        *csrSigner         // nil if signing CSRs is disabled
+
+	// hooks of embedding applications
+	authorize func(r *http.Request, req common.CertificateRequest) error
+	auditHook func(event AuditEvent)
+}
+
 func StartServer(config common.ServerModeConfig) {
 	if err := validateConfig(&config); err != nil {
 		log.Fatal().Err(err).Msg("Server configuration validation failed")
 	}
 
-	http.HandleFunc(common.CertificateRequestEndpoint, handleCertificateRequest(config))
-	http.HandleFunc(common.HealthEndpoint, handleHealthCheck)
+	inventory, err := newClientInventory(config.ServerDetails.InventoryFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load client inventory")
+	}
+
+	health := newHealthState()
+	validator, err := newChainValidator(config.ChainValidation, health)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load chain validation roots")
+	}
+
+	var replication *replicator
+	if config.Replication.Primary != "" {
+		// Creates the replica directories before the store loads them
+		replication, err = newReplicator(config.Replication, health)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start replication")
+		}
+	}
 
-	addr := fmt.Sprintf("%s:%d", config.ServerDetails.ListenAddress, config.ServerDetails.Port)
-	log.Info().Str("address", addr).Msg("Starting server")
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	store := newCertificateStore(config.ServerDetails.CertificateDirectory)
+	s := &certificateServer{
+		config:    config,
+		source:    store,
+		store:     store,
+		webhooks:  newWebhookDispatcher(config.Webhooks),
+		inventory: inventory,
+		bundles:   newBundleCache(),
+		artifacts: newArtifactCache(),
+		health:    health,
+		validator: validator,
+	}
+	s.validator.CheckDirectories(s.store.Certificates())
+	s.store.onChange = func(dir common.DirectoryCertificates) {
+		s.validator.CheckDirectory(dir)
+		s.webhooks.CertificatesChanged(dir)
+	}
+	go s.store.Run(refreshInterval(config), nil)
+	go newExpiryWatchdog(config.ExpiryWatchdog, s.store, s.webhooks, s.health).Run(nil)
+	if config.OCSP.Enabled {
+		s.stapler = newOCSPStapler(config.OCSP, s.store, s.health)
+		go s.stapler.Run(nil)
+	}
+	if config.Revocation.OCSP || config.Revocation.CRL {
+		// Without stapling, the revocation checker fetches the OCSP responses by itself
+		stapler := s.stapler
+		if stapler == nil && config.Revocation.OCSP {
+			stapler = newOCSPStapler(config.OCSP, s.store, s.health)
+		}
+		s.revocation = newRevocationChecker(config.Revocation, s.store, stapler, s.health)
+		go s.revocation.Run(nil)
+	}
+	if config.CA.CertificateFile != "" {
+		s.ca, err = newInternalCA(config.CA, s.store)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load CA")
+		}
+		go s.ca.Run(nil)
+	}
+	if config.CSR.Enabled {
+		s.csr = newCSRSigner(config.CSR, s.ca)
+	}
+	if replication != nil {
+		replication.store = s.store
+		log.Info().Str("primary", config.Replication.Primary).Strs("domains", config.Replication.Domains).Msg("Replicating certificates from primary")
+		go replication.Run(nil)
+	}
+
+	mux := s.routes()
+	mux.HandleFunc(common.HealthEndpoint, handleHealthCheck(s.health))
+	mux.HandleFunc(common.MetricsEndpoint, s.handleMetrics)
+
+	listeners, err := openListeners(config.ServerDetails)
+	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
+
+	stopInventory := make(chan struct{})
+	inventoryStopped := make(chan struct{})
+	go func() {
+		s.inventory.Run(stopInventory)
+		close(inventoryStopped)
+	}()
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		log.Info().Str("address", listener.Addr().String()).Str("network", listener.Addr().Network()).Msg("Starting server")
+		go func() {
+			errs <- http.Serve(listener, mux)
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		s.inventory.flushOrLog()
+		log.Fatal().Err(err).Msg("Failed to start server")
+	case sig := <-signals:
+		log.Info().Str("signal", sig.String()).Msg("Shutting down server")
+		// The inventory is flushed a last time
+		close(stopInventory)
+		<-inventoryStopped
+	}
 }
 
-func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = fmt.Fprintln(w, "OK")
+func refreshInterval(config common.ServerModeConfig) time.Duration {
+	if config.ServerDetails.RefreshIntervalSeconds <= 0 {
+		return defaultRefreshInterval
+	}
+	return time.Duration(config.ServerDetails.RefreshIntervalSeconds) * time.Second
 }
 
-func handleCertificateRequest(config common.ServerModeConfig) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Generate a random request ID
-		reqID := fmt.Sprintf("%x", rand.Uint32())
-		logCtx := log.With().Str(common.LogKeyRequestId, reqID).Logger()
+func (s *certificateServer) handleCertificateRequest(api apiVersion) func(w http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		reqID := requestID(rw)
+		logCtx := requestLogger(reqID, r)
 		logCtx.Info().Str("remoteAddr", r.RemoteAddr).Msg("Received request from IP")
 
+		w := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		event := AuditEvent{RequestId: reqID, RemoteAddr: r.RemoteAddr}
+		defer s.audit(&event, w)
+
 		if r.Method != http.MethodPost {
 			logCtx.Warn().Msg("Only POST method is allowed")
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			api.writeError(w, http.StatusMethodNotAllowed, common.ErrorCodeMethodNotAllowed, "Only POST method is allowed", reqID)
 			return
 		}
 
@@ -49,55 +172,136 @@ func handleCertificateRequest(config common.ServerModeConfig) func(w http.Respon
 		var req common.CertificateRequest
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Failed to read request body", reqID)
 			return
 		}
 		logCtx.Debug().RawJSON("request_body", body).Msg("Received request body")
 		if err := json.Unmarshal(body, &req); err != nil {
 			logCtx.Error().Err(err).Msg("Failed to unmarshal request body")
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			api.writeError(w, http.StatusBadRequest, common.ErrorCodeInvalidRequest, "Invalid request body", reqID)
 			return
 		}
 
+		event.Domain = req.Domain
+		event.ClientKey = req.AgePublicKey
 		logCtx.Info().
 			Str("domain", req.Domain).
 			Str("age_public_key", req.AgePublicKey).
 			Time("expiration", req.Expiration).
 			Msg("Received certificate request")
 
-		// (Re-)Load certificates
-		directoryCertificates := common.LoadCertificates(config.ServerDetails.CertificateDirectory)
-		common.DebugPrintCertificates(directoryCertificates)
-		foundCerts := common.FindCertificate(directoryCertificates, req.Domain)
-		if len(foundCerts) == 0 {
+		if err := validateAgePublicKey(s.config, req.AgePublicKey); err != nil {
+			logCtx.Warn().Str("age_public_key", req.AgePublicKey).Msg("Public key not whitelisted")
+			s.webhooks.Dispatch(WebhookEvent{
+				Event:      eventUnauthorized,
+				RequestId:  reqID,
+				Domain:     req.Domain,
+				ClientKey:  req.AgePublicKey,
+				RemoteAddr: r.RemoteAddr,
+			})
+			api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized", reqID)
+			return
+		}
+
+		if err := authorizeDomain(s.config, req.AgePublicKey, req.Domain); err != nil {
+			logCtx.Warn().Str("age_public_key", req.AgePublicKey).Str("domain", req.Domain).Msg("Public key not authorized for domain")
+			s.webhooks.Dispatch(WebhookEvent{
+				Event:      eventUnauthorized,
+				RequestId:  reqID,
+				Domain:     req.Domain,
+				ClientKey:  req.AgePublicKey,
+				RemoteAddr: r.RemoteAddr,
+			})
+			api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized for domain", reqID)
+			return
+		}
+
+		if s.authorize != nil {
+			if err := s.authorize(r, req); err != nil {
+				logCtx.Warn().Err(err).Str("age_public_key", req.AgePublicKey).Str("domain", req.Domain).Msg("Request rejected by authorization hook")
+				api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Request not authorized", reqID)
+				return
+			}
+		}
+
+		s.inventory.RecordRequest(req, r.RemoteAddr)
+
+		// Clients keeping their private key only get a certificate signed for their CSR
+		if req.CSR != "" {
+			s.serveCSR(w, r, api, req, reqID, logCtx, &event)
+			return
+		}
+
+		// Certificates of the internal CA are issued on demand and then served like all others
+		if s.ca.Allowed(req.AgePublicKey, req.Domain) {
+			if err := s.ca.Ensure(req.Domain); err != nil {
+				logCtx.Error().Err(err).Str("domain", req.Domain).Msg("Failed to issue certificate")
+				api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Failed to issue certificate", reqID)
+				return
+			}
+		}
+
+		foundCerts, revoked, err := s.findCertificates(req.Domain)
+		if err != nil {
+			logCtx.Error().Err(err).Str("domain", req.Domain).Msg("Failed to load certificates")
+			api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Failed to load certificates", reqID)
+			return
+		}
+		for _, reason := range revoked {
+			logCtx.Error().Str("domain", req.Domain).Str("reason", reason).Msg("Skipping revoked certificate")
+		}
+		primaryCert := common.PrimaryCertificate(foundCerts)
+		if primaryCert == nil && len(revoked) > 0 {
+			s.revocation.refused.Add(1)
+			api.writeError(w, http.StatusInternalServerError, common.ErrorCodeCertificateRevoked, "Certificate on server is revoked", reqID)
+			return
+		}
+		if primaryCert == nil {
 			logCtx.Info().Str("domain", req.Domain).Msg("Certificate not found for domain")
-			http.Error(w, "Certificate not found", http.StatusNotFound)
+			api.writeError(w, http.StatusNotFound, common.ErrorCodeNotFound, "Certificate not found", reqID)
 			return
 		}
 
-		// Validate expiration date
+		// The OCSP response is delivered with the certificate
+		extraFiles := make(map[string][]byte)
+		var ocspThisUpdate time.Time
+		if response := s.stapler.Response(foundCerts); response != nil {
+			extraFiles[ocspFileName(primaryCert)] = response.Raw
+			ocspThisUpdate = response.ThisUpdate
+		}
+
+		// Validate expiration date, clients supporting OCSP also get newer OCSP responses
 		if !req.Expiration.IsZero() {
-			serverCertExpiration := foundCerts[0].Expiration
-			if !serverCertExpiration.After(req.Expiration) {
+			serverCertExpiration := primaryCert.Expiration
+			ocspUpdated := req.OCSP && ocspThisUpdate.After(req.OCSPThisUpdate)
+			if !serverCertExpiration.After(req.Expiration) && !ocspUpdated {
 				logCtx.Info().Msg("Client certificate is up to date. No action needed.")
 				w.WriteHeader(http.StatusNotModified)
 				return
 			}
 		}
 
+		if err := s.validator.Validate(foundCerts); err != nil {
+			logCtx.Warn().Err(err).Str("domain", req.Domain).Msg("Certificate chain is invalid")
+			if s.validator.Refuse() {
+				api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInvalidCertificate, "Certificate on server is invalid", reqID)
+				return
+			}
+		}
+
 		logCtx.Info().Msg("Sending certificate")
 
-		if err := validateAgePublicKey(config, req.AgePublicKey); err != nil {
-			logCtx.Warn().Str("age_public_key", req.AgePublicKey).Msg("Public key not whitelisted")
-			http.Error(w, "Public key not authorized", http.StatusForbidden)
-			return
+		// Encrypt the certificates, members of a group with a shared bundle all get the same one
+		var encryptedData []byte
+		if group := sharedBundleGroup(s.config, req.AgePublicKey, req.Domain); group != nil {
+			logCtx.Info().Str("group", group.Name).Msg("Sending shared bundle of client group")
+			encryptedData, err = s.bundles.Get(*group, req.Domain, foundCerts, extraFiles)
+		} else {
+			encryptedData, err = common.EncryptAndZipBundle(foundCerts, extraFiles, req.AgePublicKey)
 		}
-
-		// Encrypt the certificates
-		encryptedData, err := common.EncryptAndZipCertificates(foundCerts, req.AgePublicKey)
 		if err != nil {
 			logCtx.Error().Err(err).Msg("Failed to encrypt certificates")
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			api.writeError(w, http.StatusInternalServerError, common.ErrorCodeServerMisconfigured, "Failed to bundle certificates", reqID)
 			return
 		}
 
@@ -105,20 +309,61 @@ func handleCertificateRequest(config common.ServerModeConfig) func(w http.Respon
 		_, err = w.Write(encryptedData)
 		if err != nil {
 			logCtx.Error().Err(err).Msg("Failed to write response")
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			api.writeError(w, http.StatusInternalServerError, common.ErrorCodeInternal, "Internal server error", reqID)
 			return
 		}
+
+		event.SerialNumber = primaryCert.SerialNumber
+		s.inventory.RecordDelivery(req.AgePublicKey, req.Domain, primaryCert.SerialNumber)
+		s.webhooks.Dispatch(WebhookEvent{
+			Event:      eventCertificateDelivered,
+			RequestId:  reqID,
+			Domain:     req.Domain,
+			Expiration: primaryCert.Expiration,
+			ClientKey:  req.AgePublicKey,
+			RemoteAddr: r.RemoteAddr,
+		})
+	}
+}
+
+// findCertificates returns the certificate files of the domain. With revocation checks,
+// every alternative certificate of the domain is considered and revoked ones are skipped,
+// their revocation reasons are returned.
+func (s *certificateServer) findCertificates(domain string) ([]*common.CertificateInfo, []string, error) {
+	candidates, ok := s.source.(candidateSource)
+	if s.revocation == nil || !ok {
+		certificates, err := s.source.FindCertificates(domain)
+		if err == nil && s.revocation != nil {
+			if isRevoked, reason := s.revocation.Revoked(certificates); isRevoked {
+				return nil, []string{reason}, nil
+			}
+		}
+		return certificates, nil, err
+	}
+
+	alternatives, err := candidates.FindCandidates(domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	var revoked []string
+	for _, certificates := range alternatives {
+		if isRevoked, reason := s.revocation.Revoked(certificates); isRevoked {
+			revoked = append(revoked, reason)
+			continue
+		}
+		return certificates, revoked, nil
 	}
+	return nil, revoked, nil
 }
 
 func validateAgePublicKey(config common.ServerModeConfig, reqPublicKey string) error {
 	// Secure comparison, always compare everything
 
-	found := false
-	for _, allowedKey := range config.PublicAgeKeys {
-		if subtle.ConstantTimeCompare([]byte(allowedKey), []byte(reqPublicKey)) == 1 {
+	reqPublicKey = common.NormalizePublicKey(reqPublicKey)
+	found := containsKey(config.PublicAgeKeys, reqPublicKey)
+	for _, group := range config.ClientGroups {
+		if containsKey(group.Members, reqPublicKey) {
 			found = true
-			// no break, constant time comparisons
 		}
 	}
 
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// handleMetrics exposes a few gauges in the Prometheus text format.
+func (s *certificateServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "certdist_certificate_expiry_timestamp_seconds", "gauge", "Expiration of the certificate in the directory.")
+	for _, dir := range s.store.Certificates() {
+		if primaryCert := common.PrimaryCertificate(dir.Certificates); primaryCert != nil {
+			_, _ = fmt.Fprintf(w, "certdist_certificate_expiry_timestamp_seconds{directory=\"%s\"} %d\n", escapeLabel(dir.FilePath), primaryCert.Expiration.Unix())
+		}
+	}
+
+	if s.revocation != nil {
+		revoked := s.revocation.RevokedDirectories()
+		writeMetricHeader(w, "certdist_certificate_revoked", "gauge", "Whether the certificate in the directory is revoked.")
+		for _, dir := range s.store.Certificates() {
+			if common.PrimaryCertificate(dir.Certificates) == nil {
+				continue
+			}
+			value := 0
+			if _, ok := revoked[dir.FilePath]; ok {
+				value = 1
+			}
+			_, _ = fmt.Fprintf(w, "certdist_certificate_revoked{directory=\"%s\"} %d\n", escapeLabel(dir.FilePath), value)
+		}
+		writeMetricHeader(w, "certdist_revoked_requests_total", "counter", "Requests refused because the certificate was revoked.")
+		_, _ = fmt.Fprintf(w, "certdist_revoked_requests_total %d\n", s.revocation.refused.Load())
+	}
+
+	if s.webhooks != nil {
+		writeMetricHeader(w, "certdist_webhook_dropped_events_total", "counter", "Webhook deliveries dropped because the queue was full.")
+		_, _ = fmt.Fprintf(w, "certdist_webhook_dropped_events_total %d\n", s.webhooks.Dropped())
+	}
+
+	writeMetricHeader(w, "certdist_health_problems", "gauge", "Number of problems reported by the health endpoint.")
+	_, _ = fmt.Fprintf(w, "certdist_health_problems %d\n", len(s.health.Problems()))
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
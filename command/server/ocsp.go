@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const defaultOCSPCheckIntervalMinutes = 60
+
+const ocspRequestTimeout = 30 * time.Second
+
+// ocspStapler fetches OCSP responses of all indexed certificates from the OCSP server in
+// their AIA extension, so clients without access to the CA can staple them.
+type ocspStapler struct {
+	config     common.OCSPConfig
+	store      *certificateStore
+	health     *healthState
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu        sync.RWMutex
+	responses map[string]*ocsp.Response // leaf serial number -> response
+}
+
+func newOCSPStapler(config common.OCSPConfig, store *certificateStore, health *healthState) *ocspStapler {
+	if config.CheckIntervalMinutes <= 0 {
+		config.CheckIntervalMinutes = defaultOCSPCheckIntervalMinutes
+	}
+	return &ocspStapler{
+		config:     config,
+		store:      store,
+		health:     health,
+		httpClient: &http.Client{Timeout: ocspRequestTimeout},
+		now:        time.Now,
+		responses:  make(map[string]*ocsp.Response),
+	}
+}
+
+// Run refreshes the responses immediately and then in the configured interval.
+func (o *ocspStapler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(o.config.CheckIntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		o.Refresh()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Refresh fetches a new response for every certificate without one or whose response
+// passed half of its validity, so responses are replaced well before NextUpdate.
+func (o *ocspStapler) Refresh() {
+	var problems []string
+	for _, dir := range o.store.Certificates() {
+		if common.PrimaryCertificate(dir.Certificates) == nil {
+			continue
+		}
+		if err := o.refreshDirectory(dir); err != nil {
+			log.Warn().Err(err).Str("directory", dir.FilePath).Msg("Failed to fetch OCSP response")
+			problems = append(problems, fmt.Sprintf("%s: %v", dir.FilePath, err))
+		}
+	}
+	o.health.Set("ocsp", problems)
+}
+
+func (o *ocspStapler) refreshDirectory(dir common.DirectoryCertificates) error {
+	chain, leafIndex, err := loadChain(dir.Certificates)
+	if err != nil {
+		return err
+	}
+	leaf := chain[leafIndex]
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+	key := leaf.SerialNumber.Text(16)
+	if current := o.cached(key); current != nil && o.now().Before(refreshTime(current)) {
+		return nil
+	}
+
+	issuer := issuerOf(chain, leaf)
+	if issuer == nil {
+		return fmt.Errorf("issuer of %s is missing in the certificate files", leaf.Subject)
+	}
+	response, err := o.fetch(leaf, issuer)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.responses[key] = response
+	o.mu.Unlock()
+	o.store.Notify()
+	log.Info().Str("directory", dir.FilePath).Str("serial", key).Time("next_update", response.NextUpdate).Msg("Fetched OCSP response")
+	return nil
+}
+
+func (o *ocspStapler) fetch(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	resp, err := o.httpClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("failed to request OCSP response: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned status %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	return response, nil
+}
+
+func (o *ocspStapler) cached(serial string) *ocsp.Response {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.responses[serial]
+}
+
+// Response returns the cached response of the leaf of the certificate files, nil if there
+// is none or it expired.
+func (o *ocspStapler) Response(certificates []*common.CertificateInfo) *ocsp.Response {
+	if o == nil {
+		return nil
+	}
+	chain, leafIndex, err := loadChain(certificates)
+	if err != nil {
+		return nil
+	}
+	response := o.cached(chain[leafIndex].SerialNumber.Text(16))
+	if response == nil || (!response.NextUpdate.IsZero() && o.now().After(response.NextUpdate)) {
+		return nil
+	}
+	return response
+}
+
+// refreshTime returns when a response should be replaced, half way to its NextUpdate.
+func refreshTime(response *ocsp.Response) time.Time {
+	if response.NextUpdate.IsZero() {
+		// The responder has newer information at any time
+		return response.ThisUpdate
+	}
+	return response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+}
+
+// ocspFileName returns the name of the OCSP response in the bundle, named after the
+// certificate file like HAProxy expects it.
+func ocspFileName(primaryCert *common.CertificateInfo) string {
+	return filepath.Base(primaryCert.FilePath) + common.OCSPFileSuffix
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestOCSPResponder is a stand-in for the OCSP responder of a CA, it answers with the
+// given status for every certificate issued by the CA.
+func newTestOCSPResponder(t *testing.T, ca *testCertificate, status int, thisUpdate *time.Time) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   *thisUpdate,
+			NextUpdate:   thisUpdate.Add(7 * 24 * time.Hour),
+		}
+		if status == ocsp.Revoked {
+			template.RevokedAt = thisUpdate.Add(-time.Hour)
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+		response, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// newOCSPTestDirectory writes cert.pem, fullchain.pem and privkey.pem of a leaf whose AIA
+// points to the responder.
+func newOCSPTestDirectory(t *testing.T, ca *testCertificate, responderURL string) string {
+	t.Helper()
+	template := leafTemplate()
+	template.OCSPServer = []string{responderURL}
+	leaf := newTestChainCertificate(t, ca, template)
+
+	dir := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	writePEM(t, filepath.Join(dir, "cert.pem"), leaf)
+	writePEM(t, filepath.Join(dir, "fullchain.pem"), leaf, ca)
+	keyDER, err := x509.MarshalECPrivateKey(leaf.key)
+	require.NoError(t, err)
+	writePEMBlock(t, filepath.Join(dir, "privkey.pem"), "EC PRIVATE KEY", keyDER)
+	return dir
+}
+
+func TestOCSPStaplerRefresh(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	responder, requests := newTestOCSPResponder(t, ca, ocsp.Good, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+
+	store := newCertificateStore([]string{dir})
+	health := newHealthState()
+	stapler := newOCSPStapler(common.OCSPConfig{Enabled: true}, store, health)
+
+	stapler.Refresh()
+	assert.Empty(t, health.Problems())
+	assert.EqualValues(t, 1, requests.Load())
+	response := stapler.Response(store.Certificates()[0].Certificates)
+	require.NotNil(t, response)
+	assert.Equal(t, ocsp.Good, response.Status)
+	assert.True(t, thisUpdate.Equal(response.ThisUpdate))
+
+	// Still fresh, no new request
+	stapler.Refresh()
+	assert.EqualValues(t, 1, requests.Load())
+
+	// Half way to NextUpdate the response is replaced
+	stapler.now = func() time.Time { return thisUpdate.Add(4 * 24 * time.Hour) }
+	stapler.Refresh()
+	assert.EqualValues(t, 2, requests.Load())
+
+	// Expired responses are not delivered
+	stapler.now = func() time.Time { return thisUpdate.Add(8 * 24 * time.Hour) }
+	assert.Nil(t, stapler.Response(store.Certificates()[0].Certificates))
+}
+
+func TestOCSPStaplerResponderDown(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now()
+	responder, _ := newTestOCSPResponder(t, ca, ocsp.Good, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+	responder.Close()
+
+	health := newHealthState()
+	stapler := newOCSPStapler(common.OCSPConfig{Enabled: true}, newCertificateStore([]string{dir}), health)
+	stapler.Refresh()
+	assert.Len(t, health.Problems(), 1)
+}
+
+func TestCertificateRequestWithOCSP(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	responder, _ := newTestOCSPResponder(t, ca, ocsp.Good, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	store := newCertificateStore([]string{dir})
+	s := &certificateServer{
+		config:  common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}},
+		source:  store,
+		store:   store,
+		bundles: newBundleCache(),
+		stapler: newOCSPStapler(common.OCSPConfig{Enabled: true}, store, newHealthState()),
+	}
+	s.stapler.Refresh()
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	bundle, err := client.Fetch(context.Background(), "example.com", time.Time{})
+	require.NoError(t, err)
+	assert.Contains(t, bundle.Files, "cert.pem.ocsp")
+	require.NotNil(t, bundle.OCSP)
+	tlsCert, err := bundle.TLSCertificate()
+	require.NoError(t, err)
+	assert.Equal(t, bundle.OCSP.Raw, tlsCert.OCSPStaple)
+
+	// Fetch doesn't ask for OCSP responses
+	_, err = client.Fetch(context.Background(), "example.com", bundle.Certificate.NotAfter)
+	assert.ErrorIs(t, err, certdist.ErrNotModified)
+
+	// Up to date certificate, but the client has no OCSP response yet
+	expiry := bundle.Certificate.NotAfter
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "example.com", CurrentExpiry: expiry, OCSP: true})
+	assert.NoError(t, err)
+
+	// Up to date certificate and OCSP response
+	_, err = client.Do(context.Background(), certdist.Request{Domain: "example.com", CurrentExpiry: expiry, OCSP: true, CurrentOCSPUpdate: bundle.OCSP.ThisUpdate})
+	assert.ErrorIs(t, err, certdist.ErrNotModified)
+
+	// Newer OCSP response on the server
+	thisUpdate = thisUpdate.Add(30 * time.Minute)
+	s.stapler.now = func() time.Time { return time.Now().Add(4 * 24 * time.Hour) }
+	s.stapler.Refresh()
+	s.stapler.now = time.Now
+	updated, err := client.Do(context.Background(), certdist.Request{Domain: "example.com", CurrentExpiry: expiry, OCSP: true, CurrentOCSPUpdate: bundle.OCSP.ThisUpdate})
+	require.NoError(t, err)
+	assert.True(t, updated.OCSP.ThisUpdate.After(bundle.OCSP.ThisUpdate))
+}
+
+func TestWatchNotifiedOnOCSPUpdate(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	responder, _ := newTestOCSPResponder(t, ca, ocsp.Good, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	store := newCertificateStore([]string{dir})
+	s := &certificateServer{
+		config:  common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}},
+		source:  store,
+		store:   store,
+		bundles: newBundleCache(),
+		stapler: newOCSPStapler(common.OCSPConfig{Enabled: true}, store, newHealthState()),
+	}
+	s.stapler.Refresh()
+	s.stapler.now = func() time.Time { return time.Now().Add(4 * 24 * time.Hour) }
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	baseline, err := client.Watch(context.Background(), []string{"example.com"}, nil, time.Second)
+	require.NoError(t, err)
+
+	// Newer OCSP response for the unchanged certificate
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		thisUpdate = thisUpdate.Add(30 * time.Minute)
+		s.stapler.Refresh()
+	}()
+	resp, err := client.Watch(context.Background(), []string{"example.com"}, baseline.Versions, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, resp.Changed)
+	assert.Equal(t, store.Version("example.com")+"-"+strconv.FormatInt(thisUpdate.Unix(), 10), resp.Versions["example.com"])
+}
+
+func TestWriteGroupBundlesWithOCSP(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	responder, _ := newTestOCSPResponder(t, ca, ocsp.Good, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{CertificateDirectory: []string{dir}},
+		ClientGroups:  []common.ClientGroupConfig{{Name: "lb", Members: []string{identity.Recipient().String()}, Domains: []string{"example.com"}}},
+		OCSP:          common.OCSPConfig{Enabled: true},
+	}
+	outputDir := t.TempDir()
+	require.NoError(t, WriteGroupBundles(config, "lb", outputDir))
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "example.com.age"))
+	require.NoError(t, err)
+	bundle, err := certdist.NewClient("", identity, identity.Recipient().String()).DecryptBundle("example.com", data)
+	require.NoError(t, err)
+	require.NotNil(t, bundle.OCSP)
+	assert.True(t, thisUpdate.Equal(bundle.OCSP.ThisUpdate))
+}
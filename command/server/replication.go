@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultReplicationIntervalSeconds = 60
+
+// replicationRequestTimeout bounds the request of a single domain, so a hanging primary
+// doesn't stop the replication.
+const replicationRequestTimeout = 30 * time.Second
+
+// replicator keeps the certificates of a read-only replica in sync with the primary. The
+// primary has to authorize the replica's key for all replicated domains.
+type replicator struct {
+	config common.ReplicationConfig
+	client *certdist.Client
+	store  *certificateStore // reloaded after changes, has to be set before Run
+	health *healthState
+}
+
+// newReplicator creates the directories of the replicated domains, so the certificate
+// store can load them before the first certificate was replicated.
+func newReplicator(config common.ReplicationConfig, health *healthState) (*replicator, error) {
+	identity, publicKey, err := common.LoadAgeIdentity(config.AgeKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replication.age_key: %w", err)
+	}
+	for _, dir := range replicaDirectories(config) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create replication directory: %w", err)
+		}
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = defaultReplicationIntervalSeconds
+	}
+	return &replicator{
+		config: config,
+		client: certdist.NewClient(config.Primary, identity, publicKey),
+		health: health,
+	}, nil
+}
+
+// replicaDirectories returns the directory of every replicated domain.
+func replicaDirectories(config common.ReplicationConfig) []string {
+	directories := make([]string, 0, len(config.Domains))
+	for _, domain := range config.Domains {
+		directories = append(directories, filepath.Join(config.Directory, domain))
+	}
+	return directories
+}
+
+// Run syncs immediately and then in the configured interval until stop is closed.
+func (r *replicator) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(r.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		r.Sync(context.Background())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Sync pulls all domains with a newer certificate on the primary and reloads the store
+// if anything changed.
+func (r *replicator) Sync(ctx context.Context) {
+	var problems []string
+	changed := false
+	for _, domain := range r.config.Domains {
+		updated, err := r.syncDomain(ctx, domain)
+		if err != nil {
+			log.Error().Err(err).Str("primary", r.config.Primary).Str("domain", domain).Msg("Failed to replicate certificate")
+			problems = append(problems, fmt.Sprintf("%s: %v", domain, err))
+			continue
+		}
+		changed = changed || updated
+	}
+	r.health.Set("replication", problems)
+	if changed {
+		r.store.Reload()
+	}
+}
+
+func (r *replicator) syncDomain(ctx context.Context, domain string) (bool, error) {
+	dir := filepath.Join(r.config.Directory, domain)
+	request := certdist.Request{Domain: domain, OCSP: true}
+	if current := common.PrimaryCertificate(common.FindCertificate(common.LoadCertificates([]string{dir}), domain)); current != nil {
+		request.CurrentExpiry = current.Expiration
+		request.CurrentSerial = current.SerialNumber
+		request.CurrentOCSPUpdate = common.OCSPThisUpdate(dir)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replicationRequestTimeout)
+	defer cancel()
+	bundle, err := r.client.Do(ctx, request)
+	if errors.Is(err, certdist.ErrNotModified) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := replaceDirectory(dir, bundle); err != nil {
+		return false, fmt.Errorf("failed to write certificates: %w", err)
+	}
+	log.Info().Str("domain", domain).Str("serial", bundle.Certificate.SerialNumber.Text(16)).Msg("Replicated certificate from primary")
+	return true, nil
+}
+
+// replaceDirectory writes the bundle to a new directory and swaps it with the existing one,
+// so clients never receive a mix of old and new files. Between the two renames dir doesn't
+// exist, a reload of the store in this moment misses the domain until Sync reloads it.
+func replaceDirectory(dir string, bundle *certdist.Bundle) error {
+	staging, err := os.MkdirTemp(filepath.Dir(dir), ".staging-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(staging) }()
+	if err := bundle.WriteFiles(staging); err != nil {
+		return err
+	}
+
+	previous := staging + ".previous"
+	if err := os.Rename(dir, previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		_ = os.Rename(previous, dir)
+		return err
+	}
+	return os.RemoveAll(previous)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"go-certdist/common"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicatorSync(t *testing.T) {
+	privateKey, publicKey := common.NewAgeTestKey(t)
+	primaryDir := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, os.MkdirAll(primaryDir, 0700))
+	common.NewTestCertificate(t, primaryDir, "example.com", time.Now().Add(30*24*time.Hour))
+
+	handler, err := NewHandler(HandlerOptions{
+		Config: common.ServerModeConfig{PublicAgeKeys: []string{publicKey}},
+		Source: DirectorySource([]string{primaryDir}),
+	})
+	require.NoError(t, err)
+	defer func() { _ = handler.Close() }()
+	primary := httptest.NewServer(handler)
+	defer primary.Close()
+
+	config := common.ServerModeConfig{
+		Replication: common.ReplicationConfig{
+			Primary:   primary.URL,
+			AgeKey:    common.AgeKeyConfig{PrivateKey: privateKey},
+			Domains:   []string{"example.com"},
+			Directory: t.TempDir(),
+		},
+	}
+	require.NoError(t, validateReplication(&config))
+	replicaDir := filepath.Join(config.Replication.Directory, "example.com")
+	assert.Equal(t, []string{replicaDir}, config.ServerDetails.CertificateDirectory)
+
+	assert.NoDirExists(t, replicaDir)
+	health := newHealthState()
+	replicator, err := newReplicator(config.Replication, health)
+	require.NoError(t, err)
+	assert.DirExists(t, replicaDir)
+	store := newCertificateStore(config.ServerDetails.CertificateDirectory)
+	replicator.store = store
+	assert.Empty(t, store.Version("example.com"))
+
+	replicator.Sync(context.Background())
+	assert.Empty(t, health.Problems())
+	for _, name := range []string{"cert.pem", "privkey.pem"} {
+		expected, err := os.ReadFile(filepath.Join(primaryDir, name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(replicaDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	// The replica serves the same version as the primary
+	primaryStore := newCertificateStore([]string{primaryDir})
+	assert.Equal(t, primaryStore.Version("example.com"), store.Version("example.com"))
+
+	// Primary unreachable, the replica keeps its certificates
+	primary.Close()
+	replicator.Sync(context.Background())
+	assert.Len(t, health.Problems(), 1)
+	assert.Equal(t, primaryStore.Version("example.com"), store.Version("example.com"))
+}
+
+func TestValidateReplication(t *testing.T) {
+	privateKey, _ := common.NewAgeTestKey(t)
+	valid := func() common.ServerModeConfig {
+		return common.ServerModeConfig{
+			Replication: common.ReplicationConfig{
+				Primary:   "https://primary.example.com",
+				AgeKey:    common.AgeKeyConfig{PrivateKey: privateKey},
+				Domains:   []string{"example.com"},
+				Directory: t.TempDir(),
+			},
+		}
+	}
+
+	config := common.ServerModeConfig{}
+	assert.NoError(t, validateReplication(&config))
+
+	config = valid()
+	assert.NoError(t, validateReplication(&config))
+
+	config = valid()
+	config.Replication.Primary = "primary.example.com"
+	assert.Error(t, validateReplication(&config))
+
+	config = valid()
+	config.Replication.Domains = nil
+	assert.Error(t, validateReplication(&config))
+
+	config = valid()
+	config.Replication.AgeKey = common.AgeKeyConfig{}
+	assert.Error(t, validateReplication(&config))
+
+	config = common.ServerModeConfig{Replication: common.ReplicationConfig{Domains: []string{"example.com"}}}
+	assert.Error(t, validateReplication(&config))
+}
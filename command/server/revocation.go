@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const defaultRevocationCheckIntervalMinutes = 60
+
+// maxCRLSize limits the size of downloaded CRLs.
+const maxCRLSize = 50 << 20
+
+// revocationChecker checks certificates against the CRLs and OCSP responses of their CAs.
+// Requests are only checked against cached data, which is refreshed in the background.
+type revocationChecker struct {
+	config     common.RevocationConfig
+	store      *certificateStore
+	stapler    *ocspStapler // nil if OCSP checks are disabled
+	health     *healthState
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu      sync.RWMutex
+	crls    map[string]*x509.RevocationList // distribution point -> CRL
+	revoked map[string]string               // directory -> reason, as of the last check
+
+	refused atomic.Int64 // requests not served because the certificate was revoked
+}
+
+func newRevocationChecker(config common.RevocationConfig, store *certificateStore, stapler *ocspStapler, health *healthState) *revocationChecker {
+	if config.CheckIntervalMinutes <= 0 {
+		config.CheckIntervalMinutes = defaultRevocationCheckIntervalMinutes
+	}
+	if !config.OCSP {
+		stapler = nil
+	}
+	return &revocationChecker{
+		config:     config,
+		store:      store,
+		stapler:    stapler,
+		health:     health,
+		httpClient: &http.Client{Timeout: ocspRequestTimeout},
+		now:        time.Now,
+		crls:       make(map[string]*x509.RevocationList),
+		revoked:    make(map[string]string),
+	}
+}
+
+// Run checks all certificates immediately and then in the configured interval.
+func (c *revocationChecker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(c.config.CheckIntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		c.Check()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check refreshes the CRLs and the OCSP responses of all certificates and reports revoked
+// certificates in the logs and the health status.
+func (c *revocationChecker) Check() {
+	if c.stapler != nil {
+		c.stapler.Refresh()
+	}
+
+	var problems []string
+	revoked := make(map[string]string)
+	for _, dir := range c.store.Certificates() {
+		if common.PrimaryCertificate(dir.Certificates) == nil {
+			continue
+		}
+		if c.config.CRL {
+			if err := c.refreshCRLs(dir.Certificates); err != nil {
+				log.Warn().Err(err).Str("directory", dir.FilePath).Msg("Failed to fetch CRL")
+				problems = append(problems, fmt.Sprintf("%s: %v", dir.FilePath, err))
+			}
+		}
+		if isRevoked, reason := c.Revoked(dir.Certificates); isRevoked {
+			log.Error().Str("directory", dir.FilePath).Str("reason", reason).Msg("Certificate is revoked")
+			problems = append(problems, fmt.Sprintf("%s: revoked, %s", dir.FilePath, reason))
+			revoked[dir.FilePath] = reason
+		}
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.mu.Unlock()
+	c.health.Set("revocation", problems)
+}
+
+// Revoked reports whether the leaf of the certificate files is revoked according to the
+// cached OCSP response or CRL.
+func (c *revocationChecker) Revoked(certificates []*common.CertificateInfo) (bool, string) {
+	if c == nil {
+		return false, ""
+	}
+	chain, leafIndex, err := loadChain(certificates)
+	if err != nil {
+		return false, ""
+	}
+	leaf := chain[leafIndex]
+
+	if response := c.stapler.Response(certificates); response != nil && response.Status == ocsp.Revoked {
+		return true, fmt.Sprintf("OCSP reports revocation at %s (reason %d)", response.RevokedAt.Format(time.RFC3339), response.RevocationReason)
+	}
+
+	if c.config.CRL {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for _, distributionPoint := range leaf.CRLDistributionPoints {
+			crl := c.crls[distributionPoint]
+			if crl == nil {
+				continue
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+					return true, fmt.Sprintf("CRL %s lists revocation at %s (reason %d)", distributionPoint, entry.RevocationTime.Format(time.RFC3339), entry.ReasonCode)
+				}
+			}
+		}
+	}
+	return false, ""
+}
+
+// RevokedDirectories returns the revoked directories of the last check.
+func (c *revocationChecker) RevokedDirectories() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]string, len(c.revoked))
+	for dir, reason := range c.revoked {
+		result[dir] = reason
+	}
+	return result
+}
+
+// refreshCRLs fetches the CRLs of the leaf which passed their NextUpdate.
+func (c *revocationChecker) refreshCRLs(certificates []*common.CertificateInfo) error {
+	chain, leafIndex, err := loadChain(certificates)
+	if err != nil {
+		return err
+	}
+	leaf := chain[leafIndex]
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return nil
+	}
+	issuer := issuerOf(chain, leaf)
+	if issuer == nil {
+		return fmt.Errorf("issuer of %s is missing in the certificate files", leaf.Subject)
+	}
+
+	for _, distributionPoint := range leaf.CRLDistributionPoints {
+		c.mu.RLock()
+		current := c.crls[distributionPoint]
+		c.mu.RUnlock()
+		if current != nil && c.now().Before(current.NextUpdate) {
+			continue
+		}
+
+		crl, err := c.fetchCRL(distributionPoint, issuer)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.crls[distributionPoint] = crl
+		c.mu.Unlock()
+		log.Info().Str("crl", distributionPoint).Int("entries", len(crl.RevokedCertificateEntries)).Time("next_update", crl.NextUpdate).Msg("Fetched CRL")
+	}
+	return nil
+}
+
+func (c *revocationChecker) fetchCRL(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	resp, err := c.httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download CRL: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRL %s returned status %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download CRL: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL %s: %w", url, err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("CRL %s is not signed by %s: %w", url, issuer.Subject, err)
+	}
+	return crl, nil
+}
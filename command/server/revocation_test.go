@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"go-certdist/common"
+	"go-certdist/pkg/certdist"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCRL is a stand-in for the CRL distribution point of a CA.
+type testCRL struct {
+	ca  *testCertificate
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	revoked []*big.Int
+}
+
+func newTestCRL(t *testing.T, ca *testCertificate) *testCRL {
+	t.Helper()
+	crl := &testCRL{ca: ca}
+	crl.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crl.mu.Lock()
+		template := &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Hour),
+			NextUpdate: time.Now().Add(24 * time.Hour),
+		}
+		for _, serial := range crl.revoked {
+			template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+				SerialNumber:   serial,
+				RevocationTime: time.Now().Add(-time.Hour),
+				ReasonCode:     1,
+			})
+		}
+		crl.mu.Unlock()
+		der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(der)
+	}))
+	t.Cleanup(crl.srv.Close)
+	return crl
+}
+
+func (c *testCRL) Revoke(cert *testCertificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revoked = append(c.revoked, cert.cert.SerialNumber)
+}
+
+func newCRLTestCA(t *testing.T) *testCertificate {
+	template := caTemplate("Test Root")
+	template.KeyUsage |= x509.KeyUsageCRLSign
+	return newTestChainCertificate(t, nil, template)
+}
+
+// newCRLTestDirectory writes the files of a leaf whose CRL distribution point is the test CRL.
+func newCRLTestDirectory(t *testing.T, ca *testCertificate, crl *testCRL, name string) (string, *testCertificate) {
+	t.Helper()
+	template := leafTemplate()
+	template.CRLDistributionPoints = []string{crl.srv.URL}
+	leaf := newTestChainCertificate(t, ca, template)
+
+	dir := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	writePEM(t, filepath.Join(dir, "cert.pem"), leaf)
+	writePEM(t, filepath.Join(dir, "fullchain.pem"), leaf, ca)
+	keyDER, err := x509.MarshalECPrivateKey(leaf.key)
+	require.NoError(t, err)
+	writePEMBlock(t, filepath.Join(dir, "privkey.pem"), "EC PRIVATE KEY", keyDER)
+	return dir, leaf
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	ca := newTestChainCertificate(t, nil, caTemplate("Test Root"))
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	responder, _ := newTestOCSPResponder(t, ca, ocsp.Revoked, &thisUpdate)
+	dir := newOCSPTestDirectory(t, ca, responder.URL)
+
+	store := newCertificateStore([]string{dir})
+	health := newHealthState()
+	stapler := newOCSPStapler(common.OCSPConfig{}, store, health)
+	checker := newRevocationChecker(common.RevocationConfig{OCSP: true}, store, stapler, health)
+
+	checker.Check()
+	revoked, reason := checker.Revoked(store.Certificates()[0].Certificates)
+	assert.True(t, revoked)
+	assert.Contains(t, reason, "OCSP")
+	assert.Contains(t, checker.RevokedDirectories(), dir)
+	assert.Len(t, health.Problems(), 1)
+}
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	ca := newCRLTestCA(t)
+	crl := newTestCRL(t, ca)
+	dir, leaf := newCRLTestDirectory(t, ca, crl, "example.com")
+
+	store := newCertificateStore([]string{dir})
+	health := newHealthState()
+	checker := newRevocationChecker(common.RevocationConfig{CRL: true}, store, nil, health)
+
+	checker.Check()
+	revoked, _ := checker.Revoked(store.Certificates()[0].Certificates)
+	assert.False(t, revoked)
+	assert.Empty(t, health.Problems())
+
+	// The CRL is cached until its NextUpdate
+	crl.Revoke(leaf)
+	checker.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	checker.Check()
+	revoked, reason := checker.Revoked(store.Certificates()[0].Certificates)
+	assert.True(t, revoked)
+	assert.Contains(t, reason, "CRL")
+	assert.Len(t, health.Problems(), 1)
+}
+
+func TestRevocationCheckerCRLWrongIssuer(t *testing.T) {
+	ca := newCRLTestCA(t)
+	crl := newTestCRL(t, newCRLTestCA(t))
+	dir, _ := newCRLTestDirectory(t, ca, crl, "example.com")
+
+	health := newHealthState()
+	checker := newRevocationChecker(common.RevocationConfig{CRL: true}, newCertificateStore([]string{dir}), nil, health)
+	checker.Check()
+	require.Len(t, health.Problems(), 1)
+	assert.Contains(t, health.Problems()[0], "not signed by")
+}
+
+func TestHandleCertificateRequestSkipsRevoked(t *testing.T) {
+	ca := newCRLTestCA(t)
+	crl := newTestCRL(t, ca)
+	revokedDir, revokedLeaf := newCRLTestDirectory(t, ca, crl, "revoked")
+	goodDir, goodLeaf := newCRLTestDirectory(t, ca, crl, "good")
+	crl.Revoke(revokedLeaf)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	store := newCertificateStore([]string{revokedDir, goodDir})
+	s := &certificateServer{
+		config:     common.ServerModeConfig{PublicAgeKeys: []string{identity.Recipient().String()}},
+		source:     store,
+		store:      store,
+		bundles:    newBundleCache(),
+		health:     newHealthState(),
+		revocation: newRevocationChecker(common.RevocationConfig{CRL: true}, store, nil, newHealthState()),
+	}
+	s.revocation.Check()
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	client := certdist.NewClient(srv.URL, identity, identity.Recipient().String())
+
+	// The non-revoked alternative is delivered
+	bundle, err := client.Fetch(context.Background(), "example.com", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, goodLeaf.cert.SerialNumber, bundle.Certificate.SerialNumber)
+
+	// Without alternative, the request is refused
+	crl.Revoke(goodLeaf)
+	s.revocation.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	s.revocation.Check()
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	var serverErr *certdist.ServerError
+	require.ErrorAs(t, err, &serverErr)
+	assert.Equal(t, http.StatusInternalServerError, serverErr.StatusCode)
+	assert.Equal(t, common.ErrorCodeCertificateRevoked, serverErr.Code)
+	assert.EqualValues(t, 1, s.revocation.refused.Load())
+}
+
+func TestHandleMetrics(t *testing.T) {
+	ca := newCRLTestCA(t)
+	crl := newTestCRL(t, ca)
+	dir, leaf := newCRLTestDirectory(t, ca, crl, "example.com")
+	crl.Revoke(leaf)
+
+	store := newCertificateStore([]string{dir})
+	s := &certificateServer{
+		store:      store,
+		health:     newHealthState(),
+		revocation: newRevocationChecker(common.RevocationConfig{CRL: true}, store, nil, newHealthState()),
+	}
+	s.revocation.Check()
+	s.revocation.refused.Add(2)
+
+	recorder := httptest.NewRecorder()
+	s.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, common.MetricsEndpoint, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `certdist_certificate_revoked{directory="`+dir+`"} 1`)
+	assert.Contains(t, string(body), "certdist_revoked_requests_total 2")
+	assert.Contains(t, string(body), "certdist_certificate_expiry_timestamp_seconds{directory=")
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"go-certdist/common"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultRefreshInterval = 60 * time.Second
+
+// certificateStore keeps the server's current view of the certificate directories
+// and notifies waiting watchers whenever one of the directories changes.
+type certificateStore struct {
+	directories []string
+
+	// onChange is called for every directory whose contents changed after the initial load
+	onChange func(dir common.DirectoryCertificates)
+
+	mu           sync.RWMutex
+	loaded       bool
+	certificates []common.DirectoryCertificates
+	fingerprints map[string]string
+	changed      chan struct{} // closed and replaced on every change
+}
+
+func newCertificateStore(directories []string) *certificateStore {
+	store := &certificateStore{
+		directories:  directories,
+		fingerprints: make(map[string]string),
+		changed:      make(chan struct{}),
+	}
+	store.Reload()
+	return store
+}
+
+// Reload (re-)loads all certificate directories, notifies watchers if anything
+// changed and returns the loaded certificates.
+func (s *certificateStore) Reload() []common.DirectoryCertificates {
+	s.mu.RLock()
+	directories := slices.Clone(s.directories)
+	s.mu.RUnlock()
+	certificates := common.LoadCertificates(directories)
+
+	fingerprints := make(map[string]string, len(certificates))
+	for _, dir := range certificates {
+		fingerprint, err := common.FingerprintCertificates(dir.Certificates)
+		if err != nil {
+			log.Warn().Err(err).Str("directory", dir.FilePath).Msg("Failed to fingerprint certificate directory")
+			continue
+		}
+		fingerprints[dir.FilePath] = fingerprint
+	}
+
+	var changedDirectories []common.DirectoryCertificates
+	s.mu.Lock()
+	s.certificates = certificates
+	if !maps.Equal(s.fingerprints, fingerprints) {
+		if s.loaded {
+			for _, dir := range certificates {
+				if fingerprint, ok := fingerprints[dir.FilePath]; ok && s.fingerprints[dir.FilePath] != fingerprint {
+					changedDirectories = append(changedDirectories, dir)
+				}
+			}
+		}
+		s.fingerprints = fingerprints
+		s.notifyLocked()
+	}
+	s.loaded = true
+	s.mu.Unlock()
+
+	if s.onChange != nil {
+		for _, dir := range changedDirectories {
+			log.Info().Str("directory", dir.FilePath).Msg("Certificate directory changed")
+			s.onChange(dir)
+		}
+	}
+	return certificates
+}
+
+// AddDirectory adds a certificate directory, which is loaded with the next reload.
+func (s *certificateStore) AddDirectory(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.directories, dir) {
+		s.directories = append(s.directories, dir)
+	}
+}
+
+// Certificates returns the certificates of the last reload.
+func (s *certificateStore) Certificates() []common.DirectoryCertificates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certificates
+}
+
+// FindCertificates reloads the directories and returns the files of the domain's certificate.
+func (s *certificateStore) FindCertificates(domain string) ([]*common.CertificateInfo, error) {
+	directoryCertificates := s.Reload()
+	common.DebugPrintCertificates(directoryCertificates)
+	return common.FindCertificate(directoryCertificates, domain), nil
+}
+
+// FindCandidates reloads the directories and returns the files of every directory with a
+// certificate of the domain.
+func (s *certificateStore) FindCandidates(domain string) ([][]*common.CertificateInfo, error) {
+	var candidates [][]*common.CertificateInfo
+	for _, dir := range common.FindCertificateDirectories(s.Reload(), domain) {
+		candidates = append(candidates, dir.Certificates)
+	}
+	return candidates, nil
+}
+
+// Changed returns a channel which is closed on the next change of the certificates.
+func (s *certificateStore) Changed() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changed
+}
+
+// Notify wakes the watchers without a change of the certificates, e.g. after a new OCSP
+// response was fetched.
+func (s *certificateStore) Notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifyLocked()
+}
+
+func (s *certificateStore) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Version returns the current version of the certificate for the given domain
+// or an empty string if no certificate is available.
+func (s *certificateStore) Version(domain string) string {
+	foundCerts := common.FindCertificate(s.Certificates(), domain)
+	if len(foundCerts) == 0 {
+		return ""
+	}
+	version, err := common.FingerprintCertificates(foundCerts)
+	if err != nil {
+		log.Warn().Err(err).Str("domain", domain).Msg("Failed to fingerprint certificates")
+		return ""
+	}
+	return version
+}
+
+// Run reloads the certificates periodically until stop is closed.
+func (s *certificateStore) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"go-certdist/common"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ValidateConfig runs all checks of the server configuration and some deeper ones, e.g.
+// whether every certificate directory contains a valid certificate. Unlike StartServer it
+// returns all problems instead of stopping at the first one. The checks run on a copy of
+// the configuration. Like on startup the replication key is loaded, which runs its exec:
+// command and decrypts a passphrase-protected key file.
+func ValidateConfig(config common.ServerModeConfig) []error {
+	config = common.CopyConfig(config)
+	var problems []error
+	for _, validate := range configValidators {
+		if err := validate(&config); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	problems = append(problems, checkServerDuplicates(config)...)
+	problems = append(problems, checkServerOutputDirectories(config)...)
+	problems = append(problems, checkServerCertificates(config, time.Now())...)
+	return problems
+}
+
+func checkServerDuplicates(config common.ServerModeConfig) []error {
+	var problems []error
+	keys := make(map[string]bool)
+	for _, key := range config.PublicAgeKeys {
+		key = common.NormalizePublicKey(key)
+		if keys[key] {
+			problems = append(problems, fmt.Errorf("public_age_keys: %s is configured more than once", key))
+		}
+		keys[key] = true
+	}
+	directories := make(map[string]bool)
+	for _, dir := range config.ServerDetails.CertificateDirectory {
+		if directories[filepath.Clean(dir)] {
+			problems = append(problems, fmt.Errorf("certificate directory %s is configured more than once", dir))
+		}
+		directories[filepath.Clean(dir)] = true
+	}
+	for _, group := range config.ClientGroups {
+		members := make(map[string]bool)
+		for _, member := range group.Members {
+			member = common.NormalizePublicKey(member)
+			if members[member] {
+				problems = append(problems, fmt.Errorf("client group %s: member %s is configured more than once", group.Name, member))
+			}
+			members[member] = true
+		}
+	}
+	return problems
+}
+
+func checkServerOutputDirectories(config common.ServerModeConfig) []error {
+	var directories []string
+	if config.ServerDetails.InventoryFile != "" {
+		directories = append(directories, filepath.Dir(config.ServerDetails.InventoryFile))
+	}
+	if config.Replication.Directory != "" {
+		directories = append(directories, config.Replication.Directory)
+	}
+	if config.CA.Directory != "" {
+		directories = append(directories, config.CA.Directory)
+	}
+
+	var problems []error
+	for _, dir := range directories {
+		if err := common.CheckWritableDirectory(dir); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// checkServerCertificates reports directories without certificate, expired certificates and
+// domains of client groups for which no certificate is found. Replicated domains are skipped,
+// their certificates are only present once the replication ran.
+func checkServerCertificates(config common.ServerModeConfig, now time.Time) []error {
+	var problems []error
+	replicas := replicaDirectories(config.Replication)
+	var directories []string
+	for _, dir := range config.ServerDetails.CertificateDirectory {
+		if !slices.Contains(replicas, dir) {
+			directories = append(directories, dir)
+		}
+	}
+	directoryCertificates := common.LoadCertificates(directories)
+	for _, dir := range directoryCertificates {
+		primaryCert := common.PrimaryCertificate(dir.Certificates)
+		switch {
+		case primaryCert == nil:
+			problems = append(problems, fmt.Errorf("certificate directory %s contains no certificate", dir.FilePath))
+		case primaryCert.Expiration.Before(now):
+			problems = append(problems, fmt.Errorf("certificate in %s expired at %s", dir.FilePath, primaryCert.Expiration.Format(time.RFC3339)))
+		}
+	}
+
+	for _, group := range config.ClientGroups {
+		for _, domain := range group.Domains {
+			if strings.ContainsAny(domain, "*?[") || slices.Contains(config.Replication.Domains, domain) {
+				continue // patterns, not domains, or replicated
+			}
+			if len(common.FindCertificate(directoryCertificates, domain)) == 0 {
+				problems = append(problems, fmt.Errorf("client group %s: no certificate found for domain %s", group.Name, domain))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"go-certdist/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfigReportsAllProblems(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	valid := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, os.MkdirAll(valid, 0700))
+	common.NewTestCertificate(t, valid, "example.com", time.Now().Add(24*time.Hour))
+	expired := filepath.Join(t.TempDir(), "expired.example.com")
+	require.NoError(t, os.MkdirAll(expired, 0700))
+	common.NewTestCertificate(t, expired, "expired.example.com", time.Now().Add(-time.Hour))
+
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{
+			Port:                 8080,
+			CertificateDirectory: []string{valid, expired, valid},
+		},
+		PublicAgeKeys: []string{publicKey, publicKey},
+		ClientGroups: []common.ClientGroupConfig{{
+			Name:    "lb",
+			Members: []string{publicKey},
+			Domains: []string{"example.com", "missing.example.com", "*.example.com"},
+		}},
+		Webhooks: []common.WebhookConfig{{}},
+	}
+
+	problems := ValidateConfig(config)
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Len(t, messages, 5, messages)
+	assert.Contains(t, messages, "public_age_keys: "+publicKey+" is configured more than once")
+	assert.Contains(t, messages, "certificate directory "+valid+" is configured more than once")
+	assert.Contains(t, messages, "client group lb: no certificate found for domain missing.example.com")
+}
+
+func TestValidateConfigValid(t *testing.T) {
+	_, publicKey := common.NewAgeTestKey(t)
+	dir := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	common.NewTestCertificate(t, dir, "example.com", time.Now().Add(24*time.Hour))
+
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{
+			Port:                 8080,
+			CertificateDirectory: []string{dir},
+			InventoryFile:        filepath.Join(t.TempDir(), "state", "inventory.json"),
+		},
+		PublicAgeKeys: []string{publicKey},
+	}
+	assert.Empty(t, ValidateConfig(config))
+}
+
+func TestValidateConfigReplica(t *testing.T) {
+	privateKey, publicKey := common.NewAgeTestKey(t)
+	replicaDir := t.TempDir()
+
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{Port: 8080},
+		PublicAgeKeys: []string{publicKey},
+		ClientGroups:  []common.ClientGroupConfig{{Name: "lb", Members: []string{publicKey}, Domains: []string{"example.com"}}},
+		Replication: common.ReplicationConfig{
+			Primary:   "https://primary.example.com",
+			AgeKey:    common.AgeKeyConfig{PrivateKey: privateKey},
+			Domains:   []string{"example.com"},
+			Directory: replicaDir,
+		},
+	}
+	// The replica directories are neither created nor reported before the first replication
+	assert.Empty(t, ValidateConfig(config))
+	assert.NoDirExists(t, filepath.Join(replicaDir, "example.com"))
+}
+
+func TestValidateConfigKeepsConfig(t *testing.T) {
+	privateKey, publicKey := common.NewAgeTestKey(t)
+	dir := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	common.NewTestCertificate(t, dir, "example.com", time.Now().Add(24*time.Hour))
+
+	directories := make([]string, 1, 2)
+	directories[0] = dir
+	config := common.ServerModeConfig{
+		ServerDetails: common.ServerDetailsConfig{Port: 8080, CertificateDirectory: directories},
+		PublicAgeKeys: []string{publicKey},
+		Replication: common.ReplicationConfig{
+			Primary:   "https://primary.example.com",
+			AgeKey:    common.AgeKeyConfig{PrivateKey: privateKey},
+			Domains:   []string{"replica.example.com"},
+			Directory: t.TempDir(),
+		},
+	}
+	assert.Empty(t, ValidateConfig(config))
+	// The replica directory was added to a copy only
+	assert.Equal(t, []string{dir}, config.ServerDetails.CertificateDirectory)
+	assert.Equal(t, "", directories[:2][1])
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"go-certdist/common"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const maxWatchTimeout = 5 * time.Minute
+
+// handleWatchRequest long-polls until the version of one of the requested domains
+// differs from the version the client knows, or the requested timeout elapses.
+func (s *certificateServer) handleWatchRequest(api apiVersion) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqID := requestID(w)
+		logCtx := requestLogger(reqID, r)
+
+		if r.Method != http.MethodPost {
+			api.writeError(w, http.StatusMethodNotAllowed, common.ErrorCodeMethodNotAllowed, "Only POST method is allowed", reqID)
+			return
+		}
+
+		var req common.WatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logCtx.Error().Err(err).Msg("Failed to unmarshal watch request body")
+			api.writeError(w, http.StatusBadRequest, common.ErrorCodeInvalidRequest, "Invalid request body", reqID)
+			return
+		}
+
+		if err := validateAgePublicKey(s.config, req.AgePublicKey); err != nil {
+			logCtx.Warn().Str("age_public_key", req.AgePublicKey).Msg("Public key not whitelisted")
+			s.webhooks.Dispatch(WebhookEvent{
+				Event:      eventUnauthorized,
+				RequestId:  reqID,
+				Domains:    req.Domains,
+				ClientKey:  req.AgePublicKey,
+				RemoteAddr: r.RemoteAddr,
+			})
+			api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized", reqID)
+			return
+		}
+		for _, domain := range req.Domains {
+			if err := authorizeDomain(s.config, req.AgePublicKey, domain); err != nil {
+				logCtx.Warn().Str("age_public_key", req.AgePublicKey).Str("domain", domain).Msg("Public key not authorized for domain")
+				s.webhooks.Dispatch(WebhookEvent{
+					Event:      eventUnauthorized,
+					RequestId:  reqID,
+					Domain:     domain,
+					ClientKey:  req.AgePublicKey,
+					RemoteAddr: r.RemoteAddr,
+				})
+				api.writeError(w, http.StatusForbidden, common.ErrorCodeForbidden, "Public key not authorized for domain", reqID)
+				return
+			}
+		}
+
+		// Without timeout the current versions are returned immediately
+		timeout := time.Duration(max(req.TimeoutSeconds, 0)) * time.Second
+		if timeout > maxWatchTimeout {
+			timeout = maxWatchTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		logCtx.Debug().Strs("domains", req.Domains).Dur("timeout", timeout).Msg("Received watch request")
+
+		for {
+			// Fetch the channel before computing the versions, so no change is missed in between
+			changed := s.store.Changed()
+			resp := s.compareVersions(req)
+			if len(resp.Changed) > 0 {
+				logCtx.Info().Strs("changed", resp.Changed).Msg("Notifying client about changed certificates")
+				writeWatchResponse(w, resp)
+				return
+			}
+
+			select {
+			case <-changed:
+				continue
+			case <-timer.C:
+				writeWatchResponse(w, resp)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *certificateServer) compareVersions(req common.WatchRequest) common.WatchResponse {
+	resp := common.WatchResponse{Versions: make(map[string]string, len(req.Domains))}
+	for _, domain := range req.Domains {
+		version := s.watchVersion(domain)
+		resp.Versions[domain] = version
+		if known, ok := req.Versions[domain]; !ok || known != version {
+			resp.Changed = append(resp.Changed, domain)
+		}
+	}
+	return resp
+}
+
+// watchVersion returns the version of the domain's certificate. It includes the ThisUpdate of
+// the stapled OCSP response, so watchers also re-fetch the bundle for a new response.
+func (s *certificateServer) watchVersion(domain string) string {
+	version := s.store.Version(domain)
+	if version == "" {
+		return ""
+	}
+	if response := s.stapler.Response(common.FindCertificate(s.store.Certificates(), domain)); response != nil {
+		version += "-" + strconv.FormatInt(response.ThisUpdate.Unix(), 10)
+	}
+	return version
+}
+
+func writeWatchResponse(w http.ResponseWriter, resp common.WatchResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error().Err(err).Msg("Failed to write watch response")
+	}
+}
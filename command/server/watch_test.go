@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-certdist/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleWatchRequest(t *testing.T) {
+	certDir := t.TempDir()
+	common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(24*time.Hour))
+	_, publicKey := common.NewAgeTestKey(t)
+
+	config := common.ServerModeConfig{PublicAgeKeys: []string{publicKey}}
+	store := newCertificateStore([]string{certDir})
+	handler := (&certificateServer{config: config, store: store}).handleWatchRequest(apiV1)
+
+	watch := func(req common.WatchRequest) (*httptest.ResponseRecorder, common.WatchResponse) {
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, common.WatchEndpoint, bytes.NewReader(body)))
+		var resp common.WatchResponse
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		}
+		return recorder, resp
+	}
+
+	_, baseline := watch(common.WatchRequest{Domains: []string{"example.com"}, AgePublicKey: publicKey})
+	require.NotEmpty(t, baseline.Versions["example.com"])
+	assert.Equal(t, []string{"example.com"}, baseline.Changed)
+
+	t.Run("unauthorized key", func(t *testing.T) {
+		_, otherKey := common.NewAgeTestKey(t)
+		recorder, _ := watch(common.WatchRequest{Domains: []string{"example.com"}, AgePublicKey: otherKey})
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("timeout without change", func(t *testing.T) {
+		recorder, resp := watch(common.WatchRequest{
+			Domains:        []string{"example.com"},
+			AgePublicKey:   publicKey,
+			Versions:       baseline.Versions,
+			TimeoutSeconds: 1,
+		})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, resp.Changed)
+	})
+
+	t.Run("no timeout", func(t *testing.T) {
+		start := time.Now()
+		recorder, resp := watch(common.WatchRequest{
+			Domains:      []string{"example.com"},
+			AgePublicKey: publicKey,
+			Versions:     baseline.Versions,
+		})
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, resp.Changed)
+		assert.Equal(t, baseline.Versions, resp.Versions)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("notified on change", func(t *testing.T) {
+		renewedDir := t.TempDir()
+		renewedCert, _ := common.NewTestCertificate(t, renewedDir, "example.com", time.Now().Add(48*time.Hour))
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_ = os.Rename(renewedCert, filepath.Join(certDir, "cert.pem"))
+			store.Reload()
+		}()
+
+		_, resp := watch(common.WatchRequest{
+			Domains:        []string{"example.com"},
+			AgePublicKey:   publicKey,
+			Versions:       baseline.Versions,
+			TimeoutSeconds: 10,
+		})
+		assert.Equal(t, []string{"example.com"}, resp.Changed)
+		assert.NotEqual(t, baseline.Versions["example.com"], resp.Versions["example.com"])
+	})
+}
+
+func TestHandleWatchRequestClientGroups(t *testing.T) {
+	certDir := t.TempDir()
+	common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(24*time.Hour))
+	_, memberKey := common.NewAgeTestKey(t)
+
+	config := common.ServerModeConfig{
+		ClientGroups: []common.ClientGroupConfig{{Name: "lb", Members: []string{memberKey}, Domains: []string{"example.com"}}},
+	}
+	handler := (&certificateServer{config: config, store: newCertificateStore([]string{certDir})}).handleWatchRequest(apiV2)
+
+	for domain, status := range map[string]int{"example.com": http.StatusOK, "other.example.org": http.StatusForbidden} {
+		body, err := json.Marshal(common.WatchRequest{Domains: []string{domain}, AgePublicKey: memberKey})
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, common.WatchEndpointV2, bytes.NewReader(body)))
+		assert.Equal(t, status, recorder.Code, domain)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"go-certdist/common"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultWarningDays          = 14
+	defaultCriticalDays         = 7
+	defaultCheckIntervalMinutes = 60
+)
+
+// expiryLevel describes how close a certificate is to its expiration.
+type expiryLevel int
+
+const (
+	expiryOk expiryLevel = iota
+	expiryWarning
+	expiryCritical
+)
+
+func (l expiryLevel) String() string {
+	switch l {
+	case expiryWarning:
+		return "warning"
+	case expiryCritical:
+		return "critical"
+	default:
+		return "ok"
+	}
+}
+
+type expiryState struct {
+	expiration time.Time
+	level      expiryLevel
+}
+
+// expiryWatchdog regularly checks all indexed certificates against the configured
+// thresholds, so certificates that upstream failed to renew do not go unnoticed.
+type expiryWatchdog struct {
+	config   common.ExpiryWatchdogConfig
+	store    *certificateStore
+	webhooks *webhookDispatcher
+	health   *healthState
+
+	mu     sync.Mutex
+	states map[string]expiryState // certificate file -> last seen state
+}
+
+// expiryWatchdogDefaults returns the configuration with the defaults of unset values.
+func expiryWatchdogDefaults(config common.ExpiryWatchdogConfig) common.ExpiryWatchdogConfig {
+	if config.WarningDays <= 0 {
+		config.WarningDays = defaultWarningDays
+	}
+	if config.CriticalDays <= 0 {
+		config.CriticalDays = defaultCriticalDays
+	}
+	if config.CheckIntervalMinutes <= 0 {
+		config.CheckIntervalMinutes = defaultCheckIntervalMinutes
+	}
+	return config
+}
+
+func newExpiryWatchdog(config common.ExpiryWatchdogConfig, store *certificateStore, webhooks *webhookDispatcher, health *healthState) *expiryWatchdog {
+	return &expiryWatchdog{
+		config:   expiryWatchdogDefaults(config),
+		store:    store,
+		webhooks: webhooks,
+		health:   health,
+		states:   make(map[string]expiryState),
+	}
+}
+
+// Run checks the certificates immediately and then in the configured interval.
+func (w *expiryWatchdog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(w.config.CheckIntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		w.Check()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check evaluates every certificate of the store and runs the configured command if a
+// certificate crossed a threshold since the last check.
+func (w *expiryWatchdog) Check() {
+	if crossed := w.evaluate(); crossed && w.config.Command != "" && w.runCommand() {
+		// Pick up renewed certificates right away instead of waiting for the next check
+		w.store.Reload()
+		w.evaluate()
+	}
+}
+
+// evaluate updates the health state and reports certificates which crossed a threshold.
+func (w *expiryWatchdog) evaluate() bool {
+	var problems []string
+	crossed := false
+
+	w.mu.Lock()
+	states := make(map[string]expiryState)
+	for _, dir := range w.store.Certificates() {
+		for _, cert := range dir.Certificates {
+			if cert.FileType != common.FileTypePublicCertificate {
+				continue
+			}
+			level := w.level(cert.Expiration)
+			states[cert.FilePath] = expiryState{expiration: cert.Expiration, level: level}
+			if level == expiryOk {
+				continue
+			}
+
+			remaining := time.Until(cert.Expiration).Round(time.Minute)
+			problems = append(problems, fmt.Sprintf("%s (%s) expires in %s [%s]",
+				cert.FilePath, strings.Join(cert.Domains, ", "), remaining, level))
+
+			previous := w.states[cert.FilePath]
+			if previous.expiration.Equal(cert.Expiration) && previous.level >= level {
+				continue // already reported
+			}
+			crossed = true
+
+			event := log.Warn()
+			if level == expiryCritical {
+				event = log.Error()
+			}
+			event.Str("file", cert.FilePath).
+				Str("domains", strings.Join(cert.Domains, ", ")).
+				Time("expiration", cert.Expiration).
+				Str("level", level.String()).
+				Msg("Certificate is about to expire")
+			w.webhooks.Dispatch(WebhookEvent{
+				Event:      eventCertificateExpiring,
+				Domains:    cert.Domains,
+				Directory:  dir.FilePath,
+				Expiration: cert.Expiration,
+				Level:      level.String(),
+			})
+		}
+	}
+	w.states = states
+	w.mu.Unlock()
+
+	w.health.Set("expiry", problems)
+	return crossed
+}
+
+func (w *expiryWatchdog) level(expiration time.Time) expiryLevel {
+	remaining := time.Until(expiration)
+	switch {
+	case remaining <= time.Duration(w.config.CriticalDays)*24*time.Hour:
+		return expiryCritical
+	case remaining <= time.Duration(w.config.WarningDays)*24*time.Hour:
+		return expiryWarning
+	default:
+		return expiryOk
+	}
+}
+
+func (w *expiryWatchdog) runCommand() bool {
+	log.Info().Str("command", w.config.Command).Msg("Executing expiry watchdog command")
+	output, err := exec.Command("sh", "-c", w.config.Command).CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		log.Info().Str("command", w.config.Command).Str("line", line).Msg("Command output")
+	}
+	if err != nil {
+		log.Error().Err(err).Str("command", w.config.Command).Msg("Expiry watchdog command failed")
+		return false
+	}
+	return true
+}
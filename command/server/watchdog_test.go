@@ -0,0 +1,57 @@
+package server
+
+import (
+	"go-certdist/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryWatchdog(t *testing.T) {
+	certDir := t.TempDir()
+	common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(10*24*time.Hour))
+	store := newCertificateStore([]string{certDir})
+
+	receiver, received := newWebhookReceiver(t, 0)
+	webhooks := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL}})
+	health := newHealthState()
+
+	marker := filepath.Join(t.TempDir(), "renewed")
+	watchdog := newExpiryWatchdog(common.ExpiryWatchdogConfig{Command: "echo run >> " + marker}, store, webhooks, health)
+
+	t.Run("warning threshold crossed", func(t *testing.T) {
+		watchdog.Check()
+
+		webhook := awaitWebhook(t, received)
+		assert.Equal(t, eventCertificateExpiring, webhook.event.Event)
+		assert.Equal(t, "warning", webhook.event.Level)
+		require.Len(t, health.Problems(), 1)
+		assert.Contains(t, health.Problems()[0], "[warning]")
+
+		output, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "run\n", string(output))
+	})
+
+	t.Run("already reported", func(t *testing.T) {
+		watchdog.Check()
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Empty(t, received)
+		output, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "run\n", string(output))
+	})
+
+	t.Run("renewed certificate is healthy", func(t *testing.T) {
+		common.NewTestCertificate(t, certDir, "example.com", time.Now().Add(90*24*time.Hour))
+		store.Reload()
+		watchdog.Check()
+
+		assert.Empty(t, health.Problems())
+	})
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-certdist/common"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	eventCertificateChanged   = "certificate.changed"
+	eventCertificateExpiring  = "certificate.expiring"
+	eventCertificateDelivered = "certificate.delivered"
+	eventUnauthorized         = "unauthorized"
+)
+
+var webhookEvents = []string{
+	eventCertificateChanged,
+	eventCertificateExpiring,
+	eventCertificateDelivered,
+	eventUnauthorized,
+}
+
+const (
+	webhookEventHeader     = "X-Certdist-Event"
+	webhookSignatureHeader = "X-Certdist-Signature"
+)
+
+const (
+	defaultWebhookRetries = 5
+	// noWebhookRetries as max_retries delivers events only once
+	noWebhookRetries = -1
+)
+
+const (
+	// webhookQueueSize bounds the deliveries waiting for a worker, further events are dropped
+	webhookQueueSize = 100
+	webhookWorkers   = 4
+)
+
+// WebhookEvent is the JSON payload posted to the configured webhooks.
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	Timestamp  time.Time `json:"timestamp"`
+	RequestId  string    `json:"request_id,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	Domains    []string  `json:"domains,omitempty"`
+	Artifact   string    `json:"artifact,omitempty"`
+	Directory  string    `json:"directory,omitempty"`
+	Expiration time.Time `json:"expiration,omitzero"`
+	Level      string    `json:"level,omitempty"`
+	ClientKey  string    `json:"client_key,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// webhookDelivery is an event waiting to be posted to one webhook.
+type webhookDelivery struct {
+	webhook common.WebhookConfig
+	event   string
+	payload []byte
+}
+
+// webhookDispatcher delivers events asynchronously to all webhooks subscribed to them, a
+// fixed number of workers posts them from a bounded queue. A nil dispatcher silently drops
+// all events.
+type webhookDispatcher struct {
+	webhooks    []common.WebhookConfig
+	client      *http.Client
+	backoffBase time.Duration
+	queue       chan webhookDelivery
+	dropped     atomic.Int64 // deliveries dropped because the queue was full
+}
+
+func newWebhookDispatcher(webhooks []common.WebhookConfig) *webhookDispatcher {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	d := &webhookDispatcher{
+		webhooks:    webhooks,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		backoffBase: time.Second,
+		queue:       make(chan webhookDelivery, webhookQueueSize),
+	}
+	for range webhookWorkers {
+		go d.work()
+	}
+	return d
+}
+
+func (d *webhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.deliver(delivery.webhook, delivery.event, delivery.payload)
+	}
+}
+
+// Dropped returns the number of deliveries dropped because the queue was full.
+func (d *webhookDispatcher) Dropped() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.dropped.Load()
+}
+
+// Dispatch queues the event for every subscribed webhook without blocking the caller. If
+// the queue is full, e.g. because a webhook doesn't respond, the event is dropped.
+func (d *webhookDispatcher) Dispatch(event WebhookEvent) {
+	if d == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("event", event.Event).Msg("Failed to marshal webhook event")
+		return
+	}
+	for _, webhook := range d.webhooks {
+		if len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event.Event) {
+			continue
+		}
+		select {
+		case d.queue <- webhookDelivery{webhook: webhook, event: event.Event, payload: payload}:
+		default:
+			d.dropped.Add(1)
+			log.Warn().Str("url", webhook.URL).Str("event", event.Event).Msg("Webhook queue is full, dropping event")
+		}
+	}
+}
+
+func (d *webhookDispatcher) deliver(webhook common.WebhookConfig, event string, payload []byte) {
+	retries := webhook.MaxRetries
+	switch retries {
+	case 0:
+		retries = defaultWebhookRetries
+	case noWebhookRetries:
+		retries = 0
+	}
+
+	backoff := d.backoffBase
+	for attempt := 0; ; attempt++ {
+		err := d.post(webhook, event, payload)
+		if err == nil {
+			log.Debug().Str("url", webhook.URL).Str("event", event).Msg("Delivered webhook")
+			return
+		}
+		if attempt >= retries {
+			log.Error().Err(err).Str("url", webhook.URL).Str("event", event).Msg("Giving up delivering webhook")
+			return
+		}
+		log.Warn().Err(err).Str("url", webhook.URL).Str("event", event).Dur("backoff", backoff).Msg("Failed to deliver webhook, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(webhook common.WebhookConfig, event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	if webhook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhookPayload(webhook.Secret, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhookPayload returns the value of the signature header for the given payload,
+// receivers recompute it with the shared secret to verify the origin of an event.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CertificatesChanged reports every changed certificate directory.
+func (d *webhookDispatcher) CertificatesChanged(dir common.DirectoryCertificates) {
+	for _, cert := range dir.Certificates {
+		if cert.FileType != common.FileTypePublicCertificate {
+			continue
+		}
+		d.Dispatch(WebhookEvent{
+			Event:      eventCertificateChanged,
+			Domains:    cert.Domains,
+			Directory:  dir.FilePath,
+			Expiration: cert.Expiration,
+		})
+	}
+}
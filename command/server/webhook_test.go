@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedWebhook struct {
+	event     WebhookEvent
+	signature string
+	body      []byte
+}
+
+// newWebhookReceiver starts a local webhook endpoint which fails the first failures requests.
+func newWebhookReceiver(t *testing.T, failures int32) (*httptest.Server, <-chan receivedWebhook) {
+	t.Helper()
+	received := make(chan receivedWebhook, 10)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		_ = json.Unmarshal(body, &event)
+		received <- receivedWebhook{event: event, signature: r.Header.Get(webhookSignatureHeader), body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func awaitWebhook(t *testing.T, received <-chan receivedWebhook) receivedWebhook {
+	t.Helper()
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "webhook was not delivered")
+		return receivedWebhook{}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	t.Run("signed delivery", func(t *testing.T) {
+		receiver, received := newWebhookReceiver(t, 0)
+		dispatcher := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL, Secret: "s3cret"}})
+
+		dispatcher.Dispatch(WebhookEvent{Event: eventCertificateDelivered, Domain: "example.com", ClientKey: "age1client"})
+
+		webhook := awaitWebhook(t, received)
+		assert.Equal(t, eventCertificateDelivered, webhook.event.Event)
+		assert.Equal(t, "example.com", webhook.event.Domain)
+		assert.False(t, webhook.event.Timestamp.IsZero())
+		assert.Equal(t, signWebhookPayload("s3cret", webhook.body), webhook.signature)
+	})
+
+	t.Run("retries with backoff", func(t *testing.T) {
+		receiver, received := newWebhookReceiver(t, 2)
+		dispatcher := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL}})
+		dispatcher.backoffBase = 10 * time.Millisecond
+
+		dispatcher.Dispatch(WebhookEvent{Event: eventUnauthorized})
+
+		webhook := awaitWebhook(t, received)
+		assert.Equal(t, eventUnauthorized, webhook.event.Event)
+		assert.Empty(t, webhook.signature)
+	})
+
+	t.Run("only subscribed events", func(t *testing.T) {
+		receiver, received := newWebhookReceiver(t, 0)
+		dispatcher := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL, Events: []string{eventCertificateChanged}}})
+
+		dispatcher.Dispatch(WebhookEvent{Event: eventUnauthorized})
+		dispatcher.Dispatch(WebhookEvent{Event: eventCertificateChanged})
+
+		webhook := awaitWebhook(t, received)
+		assert.Equal(t, eventCertificateChanged, webhook.event.Event)
+		assert.Empty(t, received)
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		receiver, received := newWebhookReceiver(t, 1)
+		dispatcher := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL, MaxRetries: noWebhookRetries}})
+		dispatcher.backoffBase = 10 * time.Millisecond
+
+		dispatcher.Dispatch(WebhookEvent{Event: eventUnauthorized})
+
+		time.Sleep(200 * time.Millisecond)
+		assert.Empty(t, received)
+	})
+
+	t.Run("drops events when the queue is full", func(t *testing.T) {
+		release := make(chan struct{})
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer receiver.Close()
+		defer close(release)
+		dispatcher := newWebhookDispatcher([]common.WebhookConfig{{URL: receiver.URL}})
+
+		for range webhookWorkers + webhookQueueSize + 10 {
+			dispatcher.Dispatch(WebhookEvent{Event: eventUnauthorized})
+		}
+		assert.GreaterOrEqual(t, dispatcher.Dropped(), int64(10))
+	})
+}
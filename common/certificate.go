@@ -1,15 +1,20 @@
 package common
 
 import (
+	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
 )
 
 // FileType is an enum for the different types of files we can parse.
@@ -35,10 +40,11 @@ func (ft FileType) String() string {
 
 // CertificateInfo holds the extracted details of a certificate.
 type CertificateInfo struct {
-	Domains    []string
-	Expiration time.Time
-	FilePath   string
-	FileType   FileType // e.g., "Public Certificate", "Private Key"
+	Domains      []string
+	Expiration   time.Time
+	SerialNumber string // hex encoded, only set for public certificates
+	FilePath     string
+	FileType     FileType // e.g., "Public Certificate", "Private Key"
 }
 
 type DirectoryCertificates struct {
@@ -72,6 +78,7 @@ func parseCertificateFile(filePath string) (*CertificateInfo, error) {
 		info.FileType = FileTypePublicCertificate
 		info.Domains = cert.DNSNames
 		info.Expiration = cert.NotAfter
+		info.SerialNumber = cert.SerialNumber.Text(16)
 	} else if strings.Contains(block.Type, "PRIVATE KEY") {
 		info.FileType = FileTypePrivateKey
 		// Private keys don't have domain or expiration info in them.
@@ -90,7 +97,7 @@ func parseCertificateFile(filePath string) (*CertificateInfo, error) {
 func LoadCertificates(directories []string) []DirectoryCertificates {
 	var result []DirectoryCertificates
 	for _, dir := range directories {
-		log.Info().Str("directory", dir).Msg("Parsing certificate directory")
+		log.Debug().Str("directory", dir).Msg("Parsing certificate directory")
 		files, err := os.ReadDir(dir)
 		if err != nil {
 			log.Error().Err(err).Str("directory", dir).Msg("Failed to read certificate directory")
@@ -121,13 +128,12 @@ func LoadCertificates(directories []string) []DirectoryCertificates {
 }
 
 // DebugPrintCertificates logs the certificates found in the given directories,
-// including their expiration dates, types, and domains. This is meant for
-// debugging purposes only.
+// including their expiration dates, types, and domains, at debug level.
 func DebugPrintCertificates(certificates []DirectoryCertificates) {
 	for _, dir := range certificates {
-		log.Info().Str("directory", dir.FilePath).Msg("Certificates found in directory")
+		log.Debug().Str("directory", dir.FilePath).Msg("Certificates found in directory")
 		for _, cert := range dir.Certificates {
-			log.Info().
+			log.Debug().
 				Str("expiration", cert.Expiration.Format(time.RFC3339)).
 				Str("file", cert.FilePath).
 				Str("type", cert.FileType.String()).
@@ -139,6 +145,16 @@ func DebugPrintCertificates(certificates []DirectoryCertificates) {
 
 func FindCertificate(certificateDirectories []DirectoryCertificates, domain string) []*CertificateInfo {
 	var result []*CertificateInfo
+	for _, dir := range FindCertificateDirectories(certificateDirectories, domain) {
+		result = append(result, dir.Certificates...)
+	}
+	return result
+}
+
+// FindCertificateDirectories returns every directory with a certificate for the domain,
+// each one is an alternative certificate for it.
+func FindCertificateDirectories(certificateDirectories []DirectoryCertificates, domain string) []DirectoryCertificates {
+	var result []DirectoryCertificates
 	for _, dir := range certificateDirectories {
 		found := false
 		for _, cert := range dir.Certificates {
@@ -154,10 +170,96 @@ func FindCertificate(certificateDirectories []DirectoryCertificates, domain stri
 			}
 		}
 		if found {
-			for _, cert := range dir.Certificates {
-				result = append(result, cert)
-			}
+			result = append(result, dir)
 		}
 	}
 	return result
 }
+
+// PrimaryCertificate returns the public certificate of the given files, which defines the
+// expiration and serial number of the whole set, or nil if there is none.
+func PrimaryCertificate(certificates []*CertificateInfo) *CertificateInfo {
+	for _, cert := range certificates {
+		if cert.FileType == FileTypePublicCertificate {
+			return cert
+		}
+	}
+	return nil
+}
+
+// FingerprintCertificates returns a hash over the names and contents of the given files.
+// It changes whenever one of the files is replaced, e.g. on renewal or re-issuance.
+func FingerprintCertificates(certificates []*CertificateInfo) (string, error) {
+	paths := make([]string, 0, len(certificates))
+	for _, cert := range certificates {
+		paths = append(paths, cert.FilePath)
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %s: %w", path, err)
+		}
+		_, _ = fmt.Fprintf(hash, "%s\x00%d\x00", filepath.Base(path), len(data))
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// OCSPThisUpdate returns the newest ThisUpdate of the OCSP responses in the directory.
+func OCSPThisUpdate(dir string) time.Time {
+	var newest time.Time
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+OCSPFileSuffix))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		response, err := ocsp.ParseResponse(data, nil)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("Failed to parse OCSP response")
+			continue
+		}
+		if response.ThisUpdate.After(newest) {
+			newest = response.ThisUpdate
+		}
+	}
+	return newest
+}
+
+// ReadPrivateKeyFile reads the PEM encoded private key of the file.
+func ReadPrivateKeyFile(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("no PEM encoded private key in %s", file)
+	}
+	key, err := ParsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", file, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey parses a DER encoded PKCS #8, PKCS #1 or EC private key.
+func ParsePrivateKey(der []byte) (crypto.Signer, error) {
+	var key any
+	var err error
+	if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+		if key, err = x509.ParseECPrivateKey(der); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+				return nil, err
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -68,6 +69,7 @@ func TestParseCertificateFile(t *testing.T) {
 		assert.Equal(t, FileTypePublicCertificate, info.FileType)
 		assert.Contains(t, info.Domains, domain)
 		assert.WithinDuration(t, time.Now().Add(time.Hour*24*30), info.Expiration, time.Second*5)
+		assert.Equal(t, "539", info.SerialNumber)
 	})
 
 	t.Run("Valid Private Key", func(t *testing.T) {
@@ -131,3 +133,32 @@ func TestFindCertificate(t *testing.T) {
 		assert.Len(t, found, 0)
 	})
 }
+
+func TestReadPrivateKeyFile(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for name, block := range map[string]*pem.Block{
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"ec.pem":    {Type: "EC PRIVATE KEY", Bytes: sec1},
+		"rsa.pem":   {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+	} {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(block), 0600))
+		key, err := ReadPrivateKeyFile(file)
+		require.NoError(t, err, name)
+		assert.NotNil(t, key.Public(), name)
+	}
+
+	file := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")}), 0600))
+	_, err = ReadPrivateKeyFile(file)
+	assert.Error(t, err)
+}
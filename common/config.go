@@ -1,37 +1,360 @@
 package common
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
 
-func LoadServerConfig(path string) ServerModeConfig {
+// EnvPrefix is the prefix of environment variables overriding configuration values,
+// e.g. CERTDIST_SERVER_PORT or CERTDIST_CERTIFICATE_0_DOMAIN.
+const EnvPrefix = "CERTDIST"
+
+// ConfigFragmentDirectory is the directory next to the configuration file whose *.yml
+// fragments are merged into the configuration in lexical order.
+const ConfigFragmentDirectory = "conf.d"
+
+// LoadServerConfig loads the server configuration with all fragments and environment overrides.
+func LoadServerConfig(path string) (ServerModeConfig, error) {
 	var c ServerModeConfig
-	data, err := os.ReadFile(path)
+	err := loadLayeredConfig(path, &c)
+	return c, err
+}
+
+// LoadClientConfig loads the client configuration with all fragments and environment overrides.
+func LoadClientConfig(path string) (ClientModeConfig, error) {
+	var c ClientModeConfig
+	err := loadLayeredConfig(path, &c)
+	return c, err
+}
+
+// loadLayeredConfig merges the base file, the conf.d fragments and the environment
+// variables into out. Maps are merged recursively, lists are appended and scalar values
+// of later layers replace earlier ones.
+func loadLayeredConfig(path string, out any) error {
+	merged, err := readConfigLayer(path)
+	if err != nil {
+		return err
+	}
+
+	fragments, err := configFragments(path)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		log.Debug().Str("path", fragment).Msg("Merging configuration fragment")
+		layer, err := readConfigLayer(fragment)
+		if err != nil {
+			return err
+		}
+		merged = mergeConfigLayers(merged, layer).(map[string]any)
+	}
+
+	data, err := yaml.Marshal(merged)
 	if err != nil {
-		log.Fatal().Err(err).Str("path", path).Msg("Failed to read config file")
+		return fmt.Errorf("failed to merge configuration: %w", err)
 	}
-	if err := yaml.Unmarshal(data, &c); err != nil {
-		log.Fatal().Err(err).Msg("Whoops, something is wrong with your config!")
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("whoops, something is wrong with your config: %w", err)
 	}
 
-	return c
+	return applyEnvOverrides(reflect.ValueOf(out).Elem(), EnvPrefix)
 }
 
-func LoadClientConfig(path string) ClientModeConfig {
-	var c ClientModeConfig
+// CheckConfigLayers decodes the base file and every conf.d fragment on its own into a new
+// value of the type of config, rejecting unknown fields like misspelled keys. It returns
+// all problems found instead of stopping at the first one.
+func CheckConfigLayers(path string, config any) []error {
+	fragments, err := configFragments(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	var problems []error
+	for _, layer := range append([]string{path}, fragments...) {
+		data, err := os.ReadFile(layer)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("failed to read config file %s: %w", layer, err))
+			continue
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(reflect.New(reflect.TypeOf(config).Elem()).Interface())
+		var typeErr *yaml.TypeError
+		switch {
+		case errors.As(err, &typeErr):
+			for _, problem := range typeErr.Errors {
+				problems = append(problems, fmt.Errorf("%s: %s", layer, problem))
+			}
+		case err != nil && !errors.Is(err, io.EOF):
+			problems = append(problems, fmt.Errorf("%s: %w", layer, err))
+		}
+	}
+	return problems
+}
+
+// CheckWritableDirectory checks whether files can be created in the directory, or whether
+// it can be created if it doesn't exist yet.
+func CheckWritableDirectory(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		break
+	}
+	file, err := os.CreateTemp(dir, ".certdist-validate-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+func readConfigLayer(path string) (map[string]any, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal().Err(err).Str("path", path).Msg("Failed to read config file")
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
 	}
-	if err := yaml.Unmarshal(data, &c); err != nil {
-		log.Fatal().Err(err).Msg("Whoops, something is wrong with your config!")
+	layer := make(map[string]any)
+	if err := yaml.Unmarshal(data, &layer); err != nil {
+		return nil, fmt.Errorf("whoops, something is wrong with your config %s: %w", path, err)
 	}
+	return layer, nil
+}
 
-	return c
+func configFragments(path string) ([]string, error) {
+	dir := filepath.Join(filepath.Dir(path), ConfigFragmentDirectory)
+	var fragments []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, matches...)
+	}
+	sort.Strings(fragments)
+	return fragments, nil
+}
+
+func mergeConfigLayers(base, overlay any) any {
+	switch overlayValue := overlay.(type) {
+	case map[string]any:
+		baseMap, ok := base.(map[string]any)
+		if !ok {
+			return overlayValue
+		}
+		for key, value := range overlayValue {
+			baseMap[key] = mergeConfigLayers(baseMap[key], value)
+		}
+		return baseMap
+	case []any:
+		if baseList, ok := base.([]any); ok {
+			return append(baseList, overlayValue...)
+		}
+		return overlayValue
+	default:
+		return overlayValue
+	}
+}
+
+// applyEnvOverrides sets every field for which an environment variable named after the
+// YAML path exists. Lists of strings are comma separated, elements of lists of structs
+// are addressed by their index.
+func applyEnvOverrides(v reflect.Value, prefix string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if err := applyEnvOverrides(v.Field(i), prefix+"_"+strings.ToUpper(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len() || hasEnvPrefix(fmt.Sprintf("%s_%d_", prefix, i)); i++ {
+				if i >= v.Len() {
+					v.Set(reflect.Append(v, reflect.New(v.Type().Elem()).Elem()))
+				}
+				if err := applyEnvOverrides(v.Index(i), fmt.Sprintf("%s_%d", prefix, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	value, ok := os.LookupEnv(prefix)
+	if !ok {
+		return nil
+	}
+	if err := setFromString(v, value); err != nil {
+		return fmt.Errorf("invalid value of environment variable %s: %w", prefix, err)
+	}
+	return nil
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFromString(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item))
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// redactedValue replaces the values of secret fields in PrintEffectiveConfig.
+const redactedValue = "<redacted>"
+
+// PrintEffectiveConfig prints the configuration after merging all layers. Fields tagged
+// secret:"true" are redacted, unless they reference an environment variable.
+func PrintEffectiveConfig(config any) error {
+	return writeEffectiveConfig(os.Stdout, config)
+}
+
+func writeEffectiveConfig(out io.Writer, config any) error {
+	v := reflect.New(reflect.TypeOf(config)).Elem()
+	v.Set(reflect.ValueOf(config))
+	copyReferences(v)
+	redactSecrets(v)
+	data, err := yaml.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// CopyConfig returns a deep copy of the configuration, so it can be changed, e.g. by
+// validators, without changing the slices of the original.
+func CopyConfig[T any](config T) T {
+	v := reflect.ValueOf(&config).Elem()
+	copyReferences(v)
+	return config
+}
+
+// copyReferences replaces the slices, maps and pointers in v by copies.
+func copyReferences(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			copied := reflect.New(v.Type().Elem())
+			copied.Elem().Set(v.Elem())
+			copyReferences(copied.Elem())
+			v.Set(copied)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				copyReferences(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(copied, v)
+		for i := 0; i < copied.Len(); i++ {
+			copyReferences(copied.Index(i))
+		}
+		v.Set(copied)
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			copyReferences(value)
+			copied.SetMapIndex(iter.Key(), value)
+		}
+		v.Set(copied)
+	}
+}
+
+// redactSecrets masks the secret fields of the configuration in place, v has to be a copy.
+func redactSecrets(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			redactSecrets(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" && v.Field(i).Kind() == reflect.String {
+				if value := v.Field(i).String(); value != "" && !strings.HasPrefix(value, secretRefEnv) {
+					v.Field(i).SetString(redactedValue)
+				}
+				continue
+			}
+			redactSecrets(v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redactSecrets(v.Index(i))
+		}
+	}
 }
 
 func WriteDummyServerConfig() {
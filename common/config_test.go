@@ -0,0 +1,174 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, path string, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yml")
+	writeConfigFile(t, path, `
+server:
+  port: 8080
+  certificate_directories:
+    - "/etc/letsencrypt/live"
+public_age_keys:
+  - "age1base"
+`)
+	writeConfigFile(t, filepath.Join(dir, "conf.d", "10-client-a.yml"), `
+public_age_keys:
+  - "age1clienta"
+`)
+	writeConfigFile(t, filepath.Join(dir, "conf.d", "20-client-b.yaml"), `
+server:
+  listen_address: "0.0.0.0"
+public_age_keys:
+  - "age1clientb"
+`)
+
+	t.Run("fragments are merged in order", func(t *testing.T) {
+		config, err := LoadServerConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, int32(8080), config.ServerDetails.Port)
+		assert.Equal(t, "0.0.0.0", config.ServerDetails.ListenAddress)
+		assert.Equal(t, []string{"/etc/letsencrypt/live"}, config.ServerDetails.CertificateDirectory)
+		assert.Equal(t, []string{"age1base", "age1clienta", "age1clientb"}, config.PublicAgeKeys)
+	})
+
+	t.Run("environment overrides", func(t *testing.T) {
+		t.Setenv("CERTDIST_SERVER_PORT", "9090")
+		t.Setenv("CERTDIST_PUBLIC_AGE_KEYS", "age1env1, age1env2")
+		t.Setenv("CERTDIST_WEBHOOKS_0_URL", "https://hooks.example.com")
+
+		config, err := LoadServerConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, int32(9090), config.ServerDetails.Port)
+		assert.Equal(t, []string{"age1env1", "age1env2"}, config.PublicAgeKeys)
+		require.Len(t, config.Webhooks, 1)
+		assert.Equal(t, "https://hooks.example.com", config.Webhooks[0].URL)
+	})
+
+	t.Run("invalid environment value", func(t *testing.T) {
+		t.Setenv("CERTDIST_SERVER_PORT", "not-a-port")
+		_, err := LoadServerConfig(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := LoadServerConfig(filepath.Join(dir, "missing.yml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.yml")
+	writeConfigFile(t, path, `
+connection:
+  server: "https://certdist.example.com"
+certificate:
+  - domain: "example.com"
+    directory: "/etc/ssl/example.com"
+`)
+	t.Setenv("CERTDIST_AGE_KEY_PRIVATE_KEY", "AGE-SECRET-KEY-1")
+	t.Setenv("CERTDIST_CERTIFICATE_0_DIRECTORY", "/tmp/example.com")
+	t.Setenv("CERTDIST_CERTIFICATE_1_DOMAIN", "example.org")
+
+	config, err := LoadClientConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "AGE-SECRET-KEY-1", config.AgeKey.PrivateKey)
+	require.Len(t, config.Certificate, 2)
+	assert.Equal(t, "/tmp/example.com", config.Certificate[0].Directory)
+	assert.Equal(t, "example.org", config.Certificate[1].Domain)
+}
+
+func TestCheckConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yml")
+	writeConfigFile(t, path, `
+server:
+  port: 8080
+  certificate_directory: "/etc/letsencrypt/live"
+public_age_keys:
+  - "age1base"
+`)
+	writeConfigFile(t, filepath.Join(dir, "conf.d", "10-client-a.yml"), `
+public_age_key:
+  - "age1clienta"
+`)
+	writeConfigFile(t, filepath.Join(dir, "conf.d", "20-empty.yml"), "")
+
+	problems := CheckConfigLayers(path, &ServerModeConfig{})
+	require.Len(t, problems, 2)
+	assert.Contains(t, problems[0].Error(), path)
+	assert.Contains(t, problems[0].Error(), "certificate_directory")
+	assert.Contains(t, problems[1].Error(), "10-client-a.yml")
+	assert.Contains(t, problems[1].Error(), "public_age_key")
+
+	writeConfigFile(t, path, "server:\n  port: 8080\n")
+	require.NoError(t, os.Remove(filepath.Join(dir, "conf.d", "10-client-a.yml")))
+	assert.Empty(t, CheckConfigLayers(path, &ServerModeConfig{}))
+}
+
+func TestCheckWritableDirectory(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, CheckWritableDirectory(dir))
+	assert.NoError(t, CheckWritableDirectory(filepath.Join(dir, "not", "yet", "created")))
+	_, err := os.Stat(filepath.Join(dir, "not"))
+	assert.True(t, os.IsNotExist(err), "checking must not create directories")
+
+	file := filepath.Join(dir, "file")
+	writeConfigFile(t, file, "")
+	assert.Error(t, CheckWritableDirectory(file))
+}
+
+func TestPrintEffectiveConfigRedactsSecrets(t *testing.T) {
+	privateKey, _ := NewAgeTestKey(t)
+	server := ServerModeConfig{
+		Webhooks:    []WebhookConfig{{URL: "https://hooks.example.com", Secret: "webhook-secret"}},
+		Replication: ReplicationConfig{AgeKey: AgeKeyConfig{PrivateKey: privateKey}},
+	}
+	var out bytes.Buffer
+	require.NoError(t, writeEffectiveConfig(&out, server))
+	assert.NotContains(t, out.String(), privateKey)
+	assert.NotContains(t, out.String(), "webhook-secret")
+	assert.Contains(t, out.String(), "https://hooks.example.com")
+	// The printed configuration is a copy
+	assert.Equal(t, "webhook-secret", server.Webhooks[0].Secret)
+	assert.Equal(t, privateKey, server.Replication.AgeKey.PrivateKey)
+
+	client := ClientModeConfig{AgeKey: AgeKeyConfig{PrivateKey: privateKey}}
+	out.Reset()
+	require.NoError(t, writeEffectiveConfig(&out, client))
+	assert.NotContains(t, out.String(), privateKey)
+	assert.Contains(t, out.String(), redactedValue)
+
+	client.AgeKey.PrivateKey = "env:CERTDIST_KEY"
+	out.Reset()
+	require.NoError(t, writeEffectiveConfig(&out, client))
+	assert.Contains(t, out.String(), "env:CERTDIST_KEY")
+}
+
+func TestCopyConfig(t *testing.T) {
+	config := ServerModeConfig{
+		PublicAgeKeys: []string{"age1a"},
+		ClientGroups:  []ClientGroupConfig{{Name: "lb", Members: []string{"age1b"}}},
+	}
+	copied := CopyConfig(config)
+	copied.PublicAgeKeys[0] = "age1c"
+	copied.ClientGroups[0].Members[0] = "age1d"
+
+	assert.Equal(t, "age1a", config.PublicAgeKeys[0])
+	assert.Equal(t, "age1b", config.ClientGroups[0].Members[0])
+}
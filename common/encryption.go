@@ -7,13 +7,24 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"filippo.io/age"
 )
 
 // EncryptAndZipCertificates takes a list of certificate info, zips the corresponding files,
-// and encrypts the zip archive using the provided age public key.
-func EncryptAndZipCertificates(certificates []*CertificateInfo, publicKey string) ([]byte, error) {
+// and encrypts the zip archive to all provided age or SSH public keys.
+func EncryptAndZipCertificates(certificates []*CertificateInfo, publicKeys ...string) ([]byte, error) {
+	return EncryptAndZipBundle(certificates, nil, publicKeys...)
+}
+
+// EncryptAndZipBundle is like EncryptAndZipCertificates, but also adds the given in-memory
+// files, e.g. OCSP responses, to the archive.
+func EncryptAndZipBundle(certificates []*CertificateInfo, extraFiles map[string][]byte, publicKeys ...string) ([]byte, error) {
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("at least one public key is required")
+	}
+
 	// 1. Create a buffer to write our zip archive to.
 	zipBuf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(zipBuf)
@@ -36,18 +47,37 @@ func EncryptAndZipCertificates(certificates []*CertificateInfo, publicKey string
 		}
 	}
 
+	names := make([]string, 0, len(extraFiles))
+	for name := range extraFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		zipFile, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zip entry for %s: %w", name, err)
+		}
+		if _, err := zipFile.Write(extraFiles[name]); err != nil {
+			return nil, fmt.Errorf("failed to write file content to zip for %s: %w", name, err)
+		}
+	}
+
 	if err := zipWriter.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close zip writer: %w", err)
 	}
 
-	// 3. Encrypt the zip buffer with the age public key.
-	recipient, err := age.ParseX25519Recipient(publicKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse age public key: %w", err)
+	// 3. Encrypt the zip buffer with the age (or SSH) public keys.
+	recipients := make([]age.Recipient, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		recipient, err := ParseRecipient(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age public key: %w", err)
+		}
+		recipients = append(recipients, recipient)
 	}
 
 	encryptedBuf := new(bytes.Buffer)
-	w, err := age.Encrypt(encryptedBuf, recipient)
+	w, err := age.Encrypt(encryptedBuf, recipients...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create encryption writer: %w", err)
 	}
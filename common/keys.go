@@ -0,0 +1,83 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// IsSSHPublicKey reports whether the key is an SSH public key like "ssh-ed25519 AAAA...".
+func IsSSHPublicKey(key string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key), "ssh-")
+}
+
+// ParseRecipient parses an age X25519 public key or an ssh-ed25519/ssh-rsa public key.
+func ParseRecipient(key string) (age.Recipient, error) {
+	key = strings.TrimSpace(key)
+	if IsSSHPublicKey(key) {
+		return agessh.ParseRecipient(key)
+	}
+	return age.ParseX25519Recipient(key)
+}
+
+// NormalizePublicKey returns the canonical form of a public key, which strips the comment
+// of SSH public keys, so keys can be compared as strings.
+func NormalizePublicKey(key string) string {
+	key = strings.TrimSpace(key)
+	if !IsSSHPublicKey(key) {
+		return key
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return key
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+}
+
+// LoadAgeIdentity returns the identity used to decrypt certificates and its public key,
+// either from the (referenced) age private key, an age identity file or an SSH private key file.
+func LoadAgeIdentity(keyConfig AgeKeyConfig) (age.Identity, string, error) {
+	if keyConfig.SSHKeyFile != "" {
+		return loadSSHIdentity(keyConfig.SSHKeyFile)
+	}
+	if keyConfig.PrivateKeyFile != "" {
+		identity, err := loadIdentityFile(keyConfig)
+		if err != nil {
+			return nil, "", err
+		}
+		return identity, identity.Recipient().String(), nil
+	}
+
+	privateKey, err := ResolveSecret(keyConfig.PrivateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve age private key: %w", err)
+	}
+	identity, err := age.ParseX25519Identity(privateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse age private key: %w", err)
+	}
+	return identity, identity.Recipient().String(), nil
+}
+
+func loadSSHIdentity(path string) (age.Identity, string, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read ssh key file: %w", err)
+	}
+
+	identity, err := agessh.ParseIdentity(pemBytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse ssh key file %s: %w", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse ssh key file %s: %w", path, err)
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	return identity, publicKey, nil
+}
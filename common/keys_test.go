@@ -0,0 +1,76 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRecipient(t *testing.T) {
+	_, agePublicKey := NewAgeTestKey(t)
+	_, sshPublicKey := NewSSHTestKey(t, t.TempDir())
+
+	t.Run("age public key", func(t *testing.T) {
+		_, err := ParseRecipient(agePublicKey)
+		assert.NoError(t, err)
+	})
+
+	t.Run("ssh public key with comment", func(t *testing.T) {
+		_, err := ParseRecipient(sshPublicKey)
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := ParseRecipient("ssh-ed25519 invalid")
+		assert.Error(t, err)
+	})
+}
+
+func TestNormalizePublicKey(t *testing.T) {
+	_, agePublicKey := NewAgeTestKey(t)
+	_, sshPublicKey := NewSSHTestKey(t, t.TempDir())
+
+	assert.Equal(t, agePublicKey, NormalizePublicKey(" "+agePublicKey+"\n"))
+	assert.Equal(t, strings.TrimSuffix(sshPublicKey, " root@test"), NormalizePublicKey(sshPublicKey))
+}
+
+func TestLoadAgeIdentity(t *testing.T) {
+	t.Run("age private key", func(t *testing.T) {
+		privateKey, publicKey := NewAgeTestKey(t)
+		_, loadedPublicKey, err := LoadAgeIdentity(AgeKeyConfig{PrivateKey: privateKey})
+		require.NoError(t, err)
+		assert.Equal(t, publicKey, loadedPublicKey)
+	})
+
+	t.Run("ssh key file decrypts", func(t *testing.T) {
+		keyPath, sshPublicKey := NewSSHTestKey(t, t.TempDir())
+		identity, loadedPublicKey, err := LoadAgeIdentity(AgeKeyConfig{SSHKeyFile: keyPath})
+		require.NoError(t, err)
+		assert.Equal(t, NormalizePublicKey(sshPublicKey), loadedPublicKey)
+
+		recipient, err := ParseRecipient(sshPublicKey)
+		require.NoError(t, err)
+		encrypted := new(bytes.Buffer)
+		w, err := age.Encrypt(encrypted, recipient)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("secret"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r, err := age.Decrypt(encrypted, identity)
+		require.NoError(t, err)
+		decrypted, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "secret", string(decrypted))
+	})
+
+	t.Run("missing ssh key file", func(t *testing.T) {
+		_, _, err := LoadAgeIdentity(AgeKeyConfig{SSHKeyFile: "nonexistent"})
+		assert.Error(t, err)
+	})
+}
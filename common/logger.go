@@ -1,20 +1,43 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 const (
-	LogKeyRequestId = "request_id"
+	LogKeyRequestId       = "request_id"
+	LogKeyClientRequestId = "client_request_id"
 )
 
+// Log formats and outputs supported by ConfigureLogger.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputSyslog = "syslog"
+)
+
+// InitLogger sets up the default logger, until the configuration is known.
 func InitLogger() {
-	consoleWriter := zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) {
-		w.Out = os.Stdout
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	log.Logger = log.Output(newConsoleWriter(os.Stdout, false)).With().Caller().Logger()
+	// log.Ctx falls back to the global logger for contexts without a logger
+	zerolog.DefaultContextLogger = &log.Logger
+}
+
+func newConsoleWriter(out io.Writer, noColor bool) zerolog.ConsoleWriter {
+	return zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) {
+		w.Out = out
+		w.NoColor = noColor
 		w.TimeFormat = "2006-01-02 15:04:05"
 		w.FormatLevel = func(i interface{}) string {
 			s := fmt.Sprintf("%s", i)
@@ -23,24 +46,81 @@ func InitLogger() {
 			}
 			return s
 		}
-		//w.FormatMessage = func(i interface{}) string {
-		//	return fmt.Sprintf("[%s]", i)
-		//}
-		//w.FormatFieldName = func(i interface{}) string {
-		//	return fmt.Sprintf("\n\t%s:", i)
-		//}
-		//w.FormatFieldValue = func(i interface{}) string {
-		//	return fmt.Sprintf("%s", i)
-		//}
-		//w.FormatExtra = func(m map[string]interface{}, b *bytes.Buffer) error {
-		//	// remove request_id from extra fields
-		//	delete(m, LOG_KEY_REQUEST_ID)
-		//	for k, v := range m {
-		//		b.WriteString(fmt.Sprintf("\n\t%s:%v", k, v))
-		//	}
-		//	return nil
-		//}
 	})
+}
+
+// levelConsoleWriter renders events like the console writer without colors and passes
+// their level on, so syslog receives them with the matching priority.
+type levelConsoleWriter struct {
+	out zerolog.LevelWriter
+}
+
+func (w levelConsoleWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w levelConsoleWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	var buf bytes.Buffer
+	if _, err := newConsoleWriter(&buf, true).Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := w.out.WriteLevel(level, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// LogConfigFromEnv returns the log configuration set by CERTDIST_LOG_* environment
+// variables, e.g. CERTDIST_LOG_LEVEL=debug. It applies before a configuration is loaded.
+func LogConfigFromEnv() (LogConfig, error) {
+	var config LogConfig
+	err := applyEnvOverrides(reflect.ValueOf(&config).Elem(), EnvPrefix+"_LOG")
+	return config, err
+}
+
+// ConfigureLogger replaces the global logger according to the configuration.
+func ConfigureLogger(config LogConfig) error {
+	level := zerolog.InfoLevel
+	if config.Level != "" {
+		parsed, err := zerolog.ParseLevel(config.Level)
+		if err != nil || parsed == zerolog.NoLevel {
+			return fmt.Errorf("invalid log level %s", config.Level)
+		}
+		level = parsed
+	}
+
+	if config.Format != "" && config.Format != LogFormatConsole && config.Format != LogFormatJSON {
+		return fmt.Errorf("invalid log format %s, must be %s or %s", config.Format, LogFormatConsole, LogFormatJSON)
+	}
+
+	var out zerolog.LevelWriter
+	switch config.Output {
+	case "", LogOutputStdout:
+		out = zerolog.LevelWriterAdapter{Writer: os.Stdout}
+	case LogOutputStderr:
+		out = zerolog.LevelWriterAdapter{Writer: os.Stderr}
+	case LogOutputSyslog:
+		writer, err := newSyslogWriter()
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		out = writer
+	default:
+		return fmt.Errorf("invalid log output %s, must be %s, %s or %s", config.Output, LogOutputStdout, LogOutputStderr, LogOutputSyslog)
+	}
+
+	var logger zerolog.Logger
+	switch {
+	case config.Format == LogFormatJSON:
+		logger = zerolog.New(out)
+	case config.Output == LogOutputSyslog:
+		// syslog adds the time itself and doesn't render colors
+		logger = zerolog.New(levelConsoleWriter{out: out})
+	default:
+		logger = zerolog.New(newConsoleWriter(out, false))
+	}
 
-	log.Logger = log.Output(consoleWriter).With().Caller().Logger()
+	zerolog.SetGlobalLevel(level)
+	log.Logger = logger.With().Timestamp().Caller().Logger()
+	return nil
 }
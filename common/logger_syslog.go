@@ -0,0 +1,19 @@
+//go:build !windows
+
+package common
+
+import (
+	"log/syslog"
+
+	"github.com/rs/zerolog"
+)
+
+// newSyslogWriter connects to the local syslog daemon, which journald provides on systemd
+// hosts. Levels are mapped to syslog priorities.
+func newSyslogWriter() (zerolog.LevelWriter, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "go-certdist")
+	if err != nil {
+		return nil, err
+	}
+	return zerolog.SyslogLevelWriter(writer), nil
+}
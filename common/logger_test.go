@@ -0,0 +1,64 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureLogger(t *testing.T) {
+	t.Cleanup(InitLogger)
+
+	require.NoError(t, ConfigureLogger(LogConfig{Level: "warn", Format: LogFormatJSON, Output: LogOutputStderr}))
+	assert.Equal(t, zerolog.WarnLevel, zerolog.GlobalLevel())
+
+	require.NoError(t, ConfigureLogger(LogConfig{}))
+	assert.Equal(t, zerolog.InfoLevel, zerolog.GlobalLevel())
+
+	assert.Error(t, ConfigureLogger(LogConfig{Level: "verbose"}))
+	assert.Error(t, ConfigureLogger(LogConfig{Format: "xml"}))
+	assert.Error(t, ConfigureLogger(LogConfig{Output: "file"}))
+}
+
+func TestLogConfigFromEnv(t *testing.T) {
+	t.Setenv("CERTDIST_LOG_LEVEL", "debug")
+	t.Setenv("CERTDIST_LOG_FORMAT", "json")
+
+	env, err := LogConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, LogConfig{Level: "debug", Format: "json"}, env)
+
+	config := LogConfig{Level: "warn", Output: LogOutputStderr}.Merge(env).Merge(LogConfig{Level: "error"})
+	assert.Equal(t, LogConfig{Level: "error", Format: "json", Output: LogOutputStderr}, config)
+}
+
+// recordingLevelWriter remembers the level of every written event.
+type recordingLevelWriter struct {
+	levels   []zerolog.Level
+	messages []string
+}
+
+func (w *recordingLevelWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *recordingLevelWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	w.levels = append(w.levels, level)
+	w.messages = append(w.messages, string(p))
+	return len(p), nil
+}
+
+func TestLevelConsoleWriter(t *testing.T) {
+	out := &recordingLevelWriter{}
+	logger := zerolog.New(levelConsoleWriter{out: out})
+
+	logger.Warn().Str("domain", "example.com").Msg("Certificate expires soon")
+	logger.Error().Msg("Failed")
+
+	assert.Equal(t, []zerolog.Level{zerolog.WarnLevel, zerolog.ErrorLevel}, out.levels)
+	assert.Contains(t, out.messages[0], "Certificate expires soon")
+	assert.Contains(t, out.messages[0], "domain=example.com")
+	assert.NotContains(t, out.messages[0], "{")
+}
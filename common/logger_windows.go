@@ -0,0 +1,11 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+func newSyslogWriter() (zerolog.LevelWriter, error) {
+	return nil, fmt.Errorf("syslog is not supported on windows")
+}
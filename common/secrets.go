@@ -0,0 +1,125 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	secretRefEnv  = "env:"
+	secretRefExec = "exec:"
+)
+
+// ResolveSecret returns the value of a secret reference: "env:NAME" reads the environment
+// variable NAME, "exec:command" the trimmed output of the command, everything else is
+// returned as is.
+func ResolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretRefEnv):
+		name := strings.TrimPrefix(ref, secretRefEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return strings.TrimSpace(value), nil
+	case strings.HasPrefix(ref, secretRefExec):
+		command := strings.TrimPrefix(ref, secretRefExec)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to execute secret command '%s': %w", command, err)
+		}
+		return strings.TrimSpace(string(output)), nil
+	default:
+		return ref, nil
+	}
+}
+
+// loadIdentityFile parses an age identity file as written by age-keygen. Files encrypted
+// with a passphrase (age -p) are decrypted with the configured passphrase first.
+func loadIdentityFile(keyConfig AgeKeyConfig) (*age.X25519Identity, error) {
+	data, err := os.ReadFile(keyConfig.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	if isAgeEncrypted(data) {
+		passphrase, err := readPassphrase(keyConfig)
+		if err != nil {
+			return nil, err
+		}
+		scryptIdentity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		var r io.Reader = bytes.NewReader(data)
+		if bytes.HasPrefix(data, []byte(armor.Header)) {
+			r = armor.NewReader(r)
+		}
+		decrypted, err := age.Decrypt(r, scryptIdentity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key file %s: %w", keyConfig.PrivateKeyFile, err)
+		}
+		if data, err = io.ReadAll(decrypted); err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key file %s: %w", keyConfig.PrivateKeyFile, err)
+		}
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key file %s: %w", keyConfig.PrivateKeyFile, err)
+	}
+	// The first identity defines the public key sent to the server
+	identity, ok := identities[0].(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("private key file %s does not contain an X25519 identity", keyConfig.PrivateKeyFile)
+	}
+	return identity, nil
+}
+
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("age-encryption.org/")) || bytes.HasPrefix(data, []byte(armor.Header))
+}
+
+// readPassphrase reads the passphrase of the private key file from a file or from a
+// systemd credential in $CREDENTIALS_DIRECTORY.
+func readPassphrase(keyConfig AgeKeyConfig) (string, error) {
+	path := keyConfig.PassphraseFile
+	if keyConfig.PassphraseCredential != "" {
+		credentialsDirectory := os.Getenv("CREDENTIALS_DIRECTORY")
+		if credentialsDirectory == "" {
+			return "", fmt.Errorf("CREDENTIALS_DIRECTORY is not set, is the credential %s configured in the systemd unit?", keyConfig.PassphraseCredential)
+		}
+		path = filepath.Join(credentialsDirectory, keyConfig.PassphraseCredential)
+	}
+	if path == "" {
+		return "", fmt.Errorf("private key file %s is passphrase-protected, but neither age_key.passphrase_file nor age_key.passphrase_credential is configured", keyConfig.PrivateKeyFile)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	// Only the first line is the passphrase
+	passphrase, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase = strings.TrimRight(passphrase, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase in %s is empty", path)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Run("literal", func(t *testing.T) {
+		value, err := ResolveSecret("AGE-SECRET-KEY-1")
+		require.NoError(t, err)
+		assert.Equal(t, "AGE-SECRET-KEY-1", value)
+	})
+
+	t.Run("environment variable", func(t *testing.T) {
+		t.Setenv("CERTDIST_TEST_SECRET", "from-env\n")
+		value, err := ResolveSecret("env:CERTDIST_TEST_SECRET")
+		require.NoError(t, err)
+		assert.Equal(t, "from-env", value)
+	})
+
+	t.Run("missing environment variable", func(t *testing.T) {
+		_, err := ResolveSecret("env:CERTDIST_TEST_MISSING")
+		assert.Error(t, err)
+	})
+
+	t.Run("command output", func(t *testing.T) {
+		value, err := ResolveSecret("exec:echo from-exec")
+		require.NoError(t, err)
+		assert.Equal(t, "from-exec", value)
+	})
+
+	t.Run("failing command", func(t *testing.T) {
+		_, err := ResolveSecret("exec:exit 1")
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadIdentityFile(t *testing.T) {
+	dir := t.TempDir()
+	privateKey, publicKey := NewAgeTestKey(t)
+	identityFile := []byte("# created: 2025-01-01T00:00:00Z\n# public key: " + publicKey + "\n" + privateKey + "\n")
+
+	t.Run("plain identity file", func(t *testing.T) {
+		path := filepath.Join(dir, "key.txt")
+		require.NoError(t, os.WriteFile(path, identityFile, 0600))
+
+		_, loadedPublicKey, err := LoadAgeIdentity(AgeKeyConfig{PrivateKeyFile: path})
+		require.NoError(t, err)
+		assert.Equal(t, publicKey, loadedPublicKey)
+	})
+
+	// Encrypt the identity file like "age -p" does
+	recipient, err := age.NewScryptRecipient("correct horse battery staple")
+	require.NoError(t, err)
+	recipient.SetWorkFactor(10)
+	encrypted := new(bytes.Buffer)
+	w, err := age.Encrypt(encrypted, recipient)
+	require.NoError(t, err)
+	_, err = w.Write(identityFile)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	encryptedPath := filepath.Join(dir, "key.txt.age")
+	require.NoError(t, os.WriteFile(encryptedPath, encrypted.Bytes(), 0600))
+
+	t.Run("passphrase file", func(t *testing.T) {
+		passphraseFile := filepath.Join(dir, "passphrase")
+		require.NoError(t, os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0600))
+
+		_, loadedPublicKey, err := LoadAgeIdentity(AgeKeyConfig{PrivateKeyFile: encryptedPath, PassphraseFile: passphraseFile})
+		require.NoError(t, err)
+		assert.Equal(t, publicKey, loadedPublicKey)
+	})
+
+	t.Run("systemd credential", func(t *testing.T) {
+		credentialsDirectory := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(credentialsDirectory, "certdist-passphrase"), []byte("correct horse battery staple"), 0600))
+		t.Setenv("CREDENTIALS_DIRECTORY", credentialsDirectory)
+
+		_, loadedPublicKey, err := LoadAgeIdentity(AgeKeyConfig{PrivateKeyFile: encryptedPath, PassphraseCredential: "certdist-passphrase"})
+		require.NoError(t, err)
+		assert.Equal(t, publicKey, loadedPublicKey)
+	})
+
+	t.Run("missing passphrase", func(t *testing.T) {
+		_, _, err := LoadAgeIdentity(AgeKeyConfig{PrivateKeyFile: encryptedPath})
+		assert.Error(t, err)
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		passphraseFile := filepath.Join(dir, "wrong-passphrase")
+		require.NoError(t, os.WriteFile(passphraseFile, []byte("wrong"), 0600))
+
+		_, _, err := LoadAgeIdentity(AgeKeyConfig{PrivateKeyFile: encryptedPath, PassphraseFile: passphraseFile})
+		assert.Error(t, err)
+	})
+}
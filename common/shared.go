@@ -1,24 +1,188 @@
 package common
 
-import "time"
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
 
 const CertificateRequestEndpoint = "/api/v1/certificate-request"
+const WatchEndpoint = "/api/v1/watch"
 const HealthEndpoint = "/health"
+const MetricsEndpoint = "/metrics"
+
+const CertificateRequestEndpointV2 = "/api/v2/certificate-request"
+const WatchEndpointV2 = "/api/v2/watch"
+const InfoEndpoint = "/api/v2/info"
+const ArtifactRequestEndpoint = "/api/v2/artifact-request"
+
+// RequestIDHeader carries the ID the server logs a request under, it is returned in every
+// response. Clients may send their own ID, which the server logs next to it.
+const RequestIDHeader = "X-Request-ID"
 
 //
 // Server
 //
 
 type ServerDetailsConfig struct {
-	Port                 int32    `yaml:"port"`
-	ListenAddress        string   `yaml:"listen_address,omitempty"`
-	CertificateDirectory []string `yaml:"certificate_directories"`
+	Port                   int32           `yaml:"port,omitempty"`
+	ListenAddress          string          `yaml:"listen_address,omitempty"`
+	Listen                 ListenAddresses `yaml:"listen,omitempty"`
+	SocketMode             string          `yaml:"socket_mode,omitempty"`
+	CertificateDirectory   []string        `yaml:"certificate_directories"`
+	RefreshIntervalSeconds int             `yaml:"refresh_interval_seconds,omitempty"`
+	InventoryFile          string          `yaml:"inventory_file,omitempty"`
+}
+
+// ListenAddresses are additional addresses the server listens on, e.g. "unix:/run/certdist.sock"
+// or "tcp:0.0.0.0:8080". In YAML either a single address or a list of addresses.
+type ListenAddresses []string
+
+func (l *ListenAddresses) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = ListenAddresses{value.Value}
+		return nil
+	}
+	var addresses []string
+	if err := value.Decode(&addresses); err != nil {
+		return err
+	}
+	*l = addresses
+	return nil
+}
+
+// WebhookConfig defines an endpoint which is notified about server events.
+type WebhookConfig struct {
+	URL        string   `yaml:"url"`
+	Secret     string   `yaml:"secret,omitempty" secret:"true"`
+	Events     []string `yaml:"events,omitempty"`      // empty means all events
+	MaxRetries int      `yaml:"max_retries,omitempty"` // 0 means 5 retries, -1 no retries
+}
+
+// ExpiryWatchdogConfig defines when the server considers a certificate about to expire
+// and which command is run to renew it.
+type ExpiryWatchdogConfig struct {
+	WarningDays          int    `yaml:"warning_days,omitempty"`
+	CriticalDays         int    `yaml:"critical_days,omitempty"`
+	CheckIntervalMinutes int    `yaml:"check_interval_minutes,omitempty"`
+	Command              string `yaml:"command,omitempty"`
+}
+
+// ClientGroupConfig defines a named group of clients, e.g. a HA pair sharing a certificate.
+// Members may only request the group's domains; with SharedBundle the certificates are
+// encrypted once to all members and every member receives the identical bundle.
+type ClientGroupConfig struct {
+	Name         string   `yaml:"name"`
+	Members      []string `yaml:"members"`
+	Domains      []string `yaml:"domains,omitempty"` // empty means all domains
+	SharedBundle bool     `yaml:"shared_bundle,omitempty"`
+	Artifacts    []string `yaml:"artifacts,omitempty"` // empty means no artifacts
+}
+
+// ArtifactConfig defines a named set of arbitrary files, e.g. DH parameters or session
+// ticket keys, which is distributed like a certificate. The files are either listed one by
+// one or are all regular files of the directory.
+type ArtifactConfig struct {
+	Name      string   `yaml:"name"`
+	Files     []string `yaml:"files,omitempty"`
+	Directory string   `yaml:"directory,omitempty"`
+}
+
+// LogConfig defines the log output of the server and the client. Empty values keep the
+// defaults, info level in console format on stdout.
+type LogConfig struct {
+	Level  string `yaml:"level,omitempty"`  // trace, debug, info, warn or error
+	Format string `yaml:"format,omitempty"` // console or json
+	Output string `yaml:"output,omitempty"` // stdout, stderr or syslog
+}
+
+// Merge returns the configuration with the non-empty values of override applied.
+func (c LogConfig) Merge(override LogConfig) LogConfig {
+	if override.Level != "" {
+		c.Level = override.Level
+	}
+	if override.Format != "" {
+		c.Format = override.Format
+	}
+	if override.Output != "" {
+		c.Output = override.Output
+	}
+	return c
 }
 
 // ServerModeConfig defines the structure for the server configuration.
 type ServerModeConfig struct {
-	ServerDetails ServerDetailsConfig `yaml:"server"`
-	PublicAgeKeys []string            `yaml:"public_age_keys"`
+	ServerDetails   ServerDetailsConfig   `yaml:"server"`
+	PublicAgeKeys   []string              `yaml:"public_age_keys"`
+	ClientGroups    []ClientGroupConfig   `yaml:"client_groups,omitempty"`
+	Webhooks        []WebhookConfig       `yaml:"webhooks,omitempty"`
+	ExpiryWatchdog  ExpiryWatchdogConfig  `yaml:"expiry_watchdog,omitempty"`
+	Replication     ReplicationConfig     `yaml:"replication,omitempty"`
+	ChainValidation ChainValidationConfig `yaml:"chain_validation,omitempty"`
+	OCSP            OCSPConfig            `yaml:"ocsp,omitempty"`
+	Revocation      RevocationConfig      `yaml:"revocation,omitempty"`
+	Artifacts       []ArtifactConfig      `yaml:"artifacts,omitempty"`
+	CA              CAConfig              `yaml:"ca,omitempty"`
+	CSR             CSRConfig             `yaml:"csr,omitempty"`
+	Log             LogConfig             `yaml:"log,omitempty"`
+}
+
+// CSRConfig enables signing the certificate signing requests of clients, which keep their
+// private keys. Requests are signed by the internal CA, or by Command if configured.
+type CSRConfig struct {
+	Enabled        bool             `yaml:"enabled,omitempty"`
+	Command        string           `yaml:"command,omitempty"` // reads the CSR from stdin, writes the chain to stdout
+	TimeoutSeconds int              `yaml:"timeout_seconds,omitempty"`
+	Clients        []CAClientConfig `yaml:"clients,omitempty"` // names signed by the command per key
+}
+
+// CAConfig turns the server into a small CA, which issues short-lived certificates for
+// internal names to the clients allowed to request them.
+type CAConfig struct {
+	CertificateFile string           `yaml:"certificate_file,omitempty"` // issuing root or intermediate
+	KeyFile         string           `yaml:"key_file,omitempty"`
+	ChainFile       string           `yaml:"chain_file,omitempty"` // certificates above the issuing one, optional
+	Directory       string           `yaml:"directory,omitempty"`  // one subdirectory per issued name
+	ValidityHours   int              `yaml:"validity_hours,omitempty"`
+	Clients         []CAClientConfig `yaml:"clients,omitempty"`
+}
+
+// CAClientConfig defines the names the CA issues certificates for to the client key.
+type CAClientConfig struct {
+	PublicKey string   `yaml:"public_key"`
+	Names     []string `yaml:"names"` // glob patterns
+}
+
+// RevocationConfig enables checking certificates against the OCSP responder and the CRL
+// of their CA, revoked certificates are not delivered.
+type RevocationConfig struct {
+	OCSP                 bool `yaml:"ocsp,omitempty"`
+	CRL                  bool `yaml:"crl,omitempty"`
+	CheckIntervalMinutes int  `yaml:"check_interval_minutes,omitempty"`
+}
+
+// OCSPConfig enables fetching OCSP responses, which are delivered with the certificates.
+type OCSPConfig struct {
+	Enabled              bool `yaml:"enabled,omitempty"`
+	CheckIntervalMinutes int  `yaml:"check_interval_minutes,omitempty"`
+}
+
+// ChainValidationConfig defines how the server checks certificates before delivering them.
+type ChainValidationConfig struct {
+	Policy    string   `yaml:"policy,omitempty"`     // warn (default), refuse or off
+	RootFiles []string `yaml:"root_files,omitempty"` // PEM files with trusted roots, system roots if empty
+}
+
+// ReplicationConfig turns the server into a read-only replica, which pulls the certificates
+// of the given domains from the primary, encrypted to its own age key.
+type ReplicationConfig struct {
+	Primary         string       `yaml:"primary,omitempty"`
+	AgeKey          AgeKeyConfig `yaml:"age_key,omitempty"`
+	Domains         []string     `yaml:"domains,omitempty"`
+	Directory       string       `yaml:"directory,omitempty"` // one subdirectory per domain
+	IntervalSeconds int          `yaml:"interval_seconds,omitempty"`
 }
 
 //
@@ -29,23 +193,58 @@ type CertificateConfig struct {
 	Domain        string   `yaml:"domain"`
 	Directory     string   `yaml:"directory"`
 	RenewCommands []string `yaml:"renew_commands,omitempty"`
+	// CSR makes the client generate the private key and only request a signed certificate
+	CSR             bool `yaml:"csr,omitempty"`
+	KeyRotationDays int  `yaml:"key_rotation_days,omitempty"` // 0 keeps the key
+}
+
+// ClientArtifactConfig defines an artifact the client requests by name.
+type ClientArtifactConfig struct {
+	Name          string   `yaml:"name"`
+	Directory     string   `yaml:"directory"`
+	RenewCommands []string `yaml:"renew_commands,omitempty"`
 }
 
 type ClientConnectionConfig struct {
-	Server string `yaml:"server"`
+	Server              string   `yaml:"server,omitempty"`
+	Servers             []string `yaml:"servers,omitempty"` // additional servers for failover
+	DisableWatch        bool     `yaml:"disable_watch,omitempty"`
+	WatchTimeoutSeconds int      `yaml:"watch_timeout_seconds,omitempty"`
+}
+
+// ServerURLs returns all configured servers, server first.
+func (c ClientConnectionConfig) ServerURLs() []string {
+	var urls []string
+	if c.Server != "" {
+		urls = append(urls, c.Server)
+	}
+	for _, server := range c.Servers {
+		if !slices.Contains(urls, server) {
+			urls = append(urls, server)
+		}
+	}
+	return urls
 }
 
+// AgeKeyConfig defines the identity of the client. PrivateKey may also reference the key
+// as "env:NAME" or "exec:command", PrivateKeyFile may be passphrase-protected (age -p).
 type AgeKeyConfig struct {
-	PublicKey  string `yaml:"public_key,omitempty"`
-	PrivateKey string `yaml:"private_key"`
+	PublicKey            string `yaml:"public_key,omitempty"`
+	PrivateKey           string `yaml:"private_key,omitempty" secret:"true"`
+	PrivateKeyFile       string `yaml:"private_key_file,omitempty"`
+	PassphraseFile       string `yaml:"passphrase_file,omitempty"`
+	PassphraseCredential string `yaml:"passphrase_credential,omitempty"` // name of a systemd credential
+	SSHKeyFile           string `yaml:"ssh_key_file,omitempty"`
 }
 
 // ClientModeConfig defines the structure for the client configuration.
 type ClientModeConfig struct {
 	ConnectionDetails ClientConnectionConfig `yaml:"connection"`
 	Certificate       []CertificateConfig    `yaml:"certificate"`
+	Artifacts         []ClientArtifactConfig `yaml:"artifacts,omitempty"`
 	AgeKey            AgeKeyConfig           `yaml:"age_key"`
 	IntervalHours     int                    `yaml:"interval_hours"`
+	Log               LogConfig              `yaml:"log,omitempty"`
 }
 
 //
@@ -54,7 +253,95 @@ type ClientModeConfig struct {
 
 // CertificateRequest defines the structure for the certificate request JSON body.
 type CertificateRequest struct {
-	Domain       string    `json:"domain"`
-	AgePublicKey string    `json:"age_public_key"`
-	Expiration   time.Time `json:"expiration"`
+	Domain        string    `json:"domain"`
+	AgePublicKey  string    `json:"age_public_key"`
+	Expiration    time.Time `json:"expiration"`
+	SerialNumber  string    `json:"serial_number,omitempty"` // of the certificate the client currently holds
+	ClientVersion string    `json:"client_version,omitempty"`
+	// OCSP is set by clients which want updated OCSP responses even if the certificate is
+	// unchanged, OCSPThisUpdate is the ThisUpdate of the response they currently hold.
+	OCSP           bool      `json:"ocsp,omitempty"`
+	OCSPThisUpdate time.Time `json:"ocsp_this_update,omitzero"`
+	// CSR is a PEM encoded certificate signing request, the server answers with the signed
+	// certificate and its chain, but without private key.
+	CSR string `json:"csr,omitempty"`
+}
+
+// ArtifactRequest requests the files of a named artifact. Version is the version the client
+// currently holds, the server answers with 304 if it is still current.
+type ArtifactRequest struct {
+	Name          string `json:"name"`
+	AgePublicKey  string `json:"age_public_key"`
+	Version       string `json:"version,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+// ArtifactVersionHeader is the response header with the version of the delivered artifact.
+const ArtifactVersionHeader = "X-Certdist-Artifact-Version"
+
+// WatchRequest subscribes to changes of the given domains. Versions holds the last
+// version the client has seen per domain, the server answers as soon as one differs.
+type WatchRequest struct {
+	Domains        []string          `json:"domains"`
+	AgePublicKey   string            `json:"age_public_key"`
+	Versions       map[string]string `json:"versions,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"` // 0 answers immediately
+}
+
+// WatchResponse contains the current version of every watched domain and the
+// domains whose version differs from the one sent in the WatchRequest.
+type WatchResponse struct {
+	Versions map[string]string `json:"versions"`
+	Changed  []string          `json:"changed,omitempty"`
+}
+
+// Error codes of the v2 API
+const (
+	ErrorCodeInvalidRequest      = "invalid_request"
+	ErrorCodeMethodNotAllowed    = "method_not_allowed"
+	ErrorCodeForbidden           = "forbidden"
+	ErrorCodeNotFound            = "not_found"
+	ErrorCodeServerMisconfigured = "server_misconfigured"
+	ErrorCodeInvalidCertificate  = "invalid_certificate"
+	ErrorCodeCertificateRevoked  = "certificate_revoked"
+	ErrorCodeInternal            = "internal_error"
+)
+
+// APIError is the JSON error body of the v2 API.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.RequestId == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (request_id %s)", e.Code, e.Message, e.RequestId)
+}
+
+// Features advertised by the info endpoint
+const (
+	FeatureWatch         = "watch"
+	FeatureSharedBundles = "shared_bundles"
+	FeatureSSHRecipients = "ssh_recipients"
+	FeatureOCSP          = "ocsp"
+	FeatureArtifacts     = "artifacts"
+	FeatureCSR           = "csr"
+)
+
+// FormatZipAge is a zip archive of the certificate files, encrypted with age.
+const FormatZipAge = "zip+age"
+
+// OCSPFileSuffix is the suffix of OCSP responses in a bundle, e.g. cert.pem.ocsp.
+const OCSPFileSuffix = ".ocsp"
+
+// ServerInfo is returned by the info endpoint, so clients can discover the capabilities of the server.
+type ServerInfo struct {
+	Version     string   `json:"version"`
+	APIVersions []string `json:"api_versions"`
+	Formats     []string `json:"formats"`
+	Features    []string `json:"features"`
 }
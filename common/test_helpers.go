@@ -1,10 +1,23 @@
 package common
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"filippo.io/age"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 // NewAgeTestKey generates a new age key pair for testing purposes.
@@ -14,3 +27,55 @@ func NewAgeTestKey(t *testing.T) (privateKey string, publicKey string) {
 	require.NoError(t, err)
 	return identity.String(), identity.Recipient().String()
 }
+
+// NewSSHTestKey writes a new ed25519 SSH private key into dir and returns its path and
+// the public key in authorized_keys format (including a comment).
+func NewSSHTestKey(t *testing.T, dir string) (keyPath string, publicKey string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+	keyPath = filepath.Join(dir, "ssh_host_ed25519_key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+
+	sshPublicKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return keyPath, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))) + " root@test"
+}
+
+// NewTestCertificate writes a self-signed certificate (cert.pem) and its private key
+// (privkey.pem) for the given domain into dir.
+func NewTestCertificate(t *testing.T, dir, domain string, notAfter time.Time) (certPath, keyPath string) {
+	t.Helper()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1337),
+		Subject: pkix.Name{
+			Organization: []string{"Test Corp"},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{domain},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privKey.PublicKey, privKey)
+	require.NoError(t, err)
+
+	certPath = filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644))
+
+	keyBytes, err := x509.MarshalECPrivateKey(privKey)
+	require.NoError(t, err)
+	keyPath = filepath.Join(dir, "privkey.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+
+	return certPath, keyPath
+}
@@ -0,0 +1,4 @@
+package common
+
+// Version of go-certdist, set at build time via -ldflags "-X go-certdist/common.Version=..."
+var Version = "dev"
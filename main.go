@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"go-certdist/command/client"
 	"go-certdist/command/server"
 	"go-certdist/common"
+	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -13,61 +19,257 @@ import (
 func main() {
 	common.InitLogger()
 
-	if len(os.Args) < 2 {
-		printHelp()
+	global := &globalOptions{}
+	root := flag.NewFlagSet("go-certdist", flag.ContinueOnError)
+	root.Usage = func() { printHelp(root.Output()) }
+	global.register(root)
+	if err := root.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	if root.NArg() == 0 {
+		printHelp(os.Stdout)
 		os.Exit(1)
 	}
+	cmd := findCommand(global, root.Arg(0))
+	if cmd == nil {
+		printHelp(os.Stderr)
+		log.Fatal().Str("command", root.Arg(0)).Msg("Unknown command")
+	}
+	cmd.execute(global, root.Args()[1:])
+}
+
+// commands returns all commands in the order of the help message.
+func commands(global *globalOptions) []*command {
+	var clientOptions client.Options
+	var staleAfter time.Duration
+	return []*command{
+		{
+			name:      "server",
+			args:      "<config file path>",
+			summary:   "Start the server.",
+			minArgs:   1,
+			logConfig: true,
+			run: func(args []string) {
+				config, err := common.LoadServerConfig(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to load server config")
+				}
+				if err := global.configureLogging(config.Log); err != nil {
+					log.Fatal().Err(err).Msg("Invalid log configuration")
+				}
+				server.StartServer(config)
+			},
+		},
+		{
+			name:      "client",
+			args:      "<config file path>",
+			summary:   "Start the client, requesting the configured certificates and artifacts.",
+			minArgs:   1,
+			logConfig: true,
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&clientOptions.Once, "once", false, "exit after a single run even if interval_hours is configured")
+				fs.BoolVar(&clientOptions.Force, "force", false, "request certificates and artifacts even if they are up-to-date")
+				fs.Var((*stringList)(&clientOptions.Domains), "domain", "only request the certificate of this configured domain and no artifacts, may be repeated")
+			},
+			run: func(args []string) {
+				config, err := common.LoadClientConfig(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to load client config")
+				}
+				if err := global.configureLogging(config.Log); err != nil {
+					log.Fatal().Err(err).Msg("Invalid log configuration")
+				}
+				client.ExecuteClient(config, clientOptions)
+			},
+		},
+		{
+			name:    "inventory",
+			args:    "<server config file path> [stale after hours]",
+			summary: "List the clients known to the server.",
+			minArgs: 1,
+			flags: func(fs *flag.FlagSet) {
+				fs.DurationVar(&staleAfter, "stale-after", 48*time.Hour, "mark clients as stale which haven't been seen for this long")
+			},
+			run: func(args []string) {
+				if len(args) > 1 {
+					hours, err := strconv.Atoi(args[1])
+					if err != nil {
+						log.Fatal().Err(err).Str("hours", args[1]).Msg("Invalid number of hours")
+					}
+					staleAfter = time.Duration(hours) * time.Hour
+				}
+				config, err := common.LoadServerConfig(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to load server config")
+				}
+				if err := server.PrintInventory(config, staleAfter); err != nil {
+					log.Fatal().Err(err).Msg("Failed to print client inventory")
+				}
+			},
+		},
+		{
+			name:    "bundle",
+			args:    "<server config file path> <client group> <output directory>",
+			summary: "Pre-generate the shared bundles of a client group.",
+			minArgs: 3,
+			run: func(args []string) {
+				config, err := common.LoadServerConfig(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to load server config")
+				}
+				if err := server.WriteGroupBundles(config, args[1], args[2]); err != nil {
+					log.Fatal().Err(err).Msg("Failed to write shared bundles")
+				}
+			},
+		},
+		{
+			name:    "keygen",
+			summary: "Generate a new age key pair.",
+			run: func(args []string) {
+				if err := common.GenerateAndPrintKeyPair(); err != nil {
+					log.Fatal().Err(err).Msg("Failed to generate key pair")
+				}
+			},
+		},
+		{
+			name:    "config",
+			args:    "<server|client> | show <server|client> <config file path>",
+			summary: "Write a dummy config file, or print the effective config with conf.d and CERTDIST_* applied.",
+			minArgs: 1,
+			run: func(args []string) {
+				switch args[0] {
+				case "server":
+					common.WriteDummyServerConfig()
+				case "client":
+					common.WriteDummyClientConfig()
+				case "show":
+					if len(args) < 3 {
+						log.Fatal().Msg("Usage: go-certdist config show <server|client> <config file path>")
+					}
+					if err := printEffectiveConfig(args[1], args[2]); err != nil {
+						log.Fatal().Err(err).Msg("Failed to print effective config")
+					}
+				default:
+					log.Fatal().Str("command", args[0]).Msg("Unknown config command")
+				}
+			},
+		},
+		{
+			name:    "validate",
+			args:    "<server|client> <config file path>",
+			summary: "Check the config and print all problems, exits non-zero if there are any.",
+			minArgs: 2,
+			run: func(args []string) {
+				problems, err := validateConfig(args[0], args[1])
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to validate config")
+				}
+				if len(problems) > 0 {
+					for _, problem := range problems {
+						fmt.Println(problem)
+					}
+					os.Exit(1)
+				}
+				fmt.Println("Configuration is valid")
+			},
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "Print the help message of go-certdist or of a command.",
+			run: func(args []string) {
+				if len(args) == 0 {
+					printHelp(os.Stdout)
+					return
+				}
+				cmd := findCommand(global, args[0])
+				if cmd == nil {
+					log.Fatal().Str("command", args[0]).Msg("Unknown command")
+				}
+				fs := cmd.newFlagSet(&globalOptions{})
+				fs.SetOutput(os.Stdout)
+				fs.Usage()
+			},
+		},
+	}
+}
+
+func findCommand(global *globalOptions, name string) *command {
+	for _, cmd := range commands(global) {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
 
-	switch os.Args[1] {
+func printEffectiveConfig(configType string, path string) error {
+	switch configType {
 	case "server":
-		if len(os.Args) < 3 {
-			log.Fatal().Msg("Usage: go-certdist server <config file path>")
+		config, err := common.LoadServerConfig(path)
+		if err != nil {
+			return err
 		}
-		config := common.LoadServerConfig(os.Args[2])
-		server.StartServer(config)
+		return common.PrintEffectiveConfig(config)
 	case "client":
-		if len(os.Args) < 3 {
-			log.Fatal().Msg("Usage: go-certdist client <config file path>")
-		}
-		config := common.LoadClientConfig(os.Args[2])
-		client.ExecuteClient(config)
-	case "keygen":
-		if err := common.GenerateAndPrintKeyPair(); err != nil {
-			log.Fatal().Err(err).Msg("Failed to generate key pair")
+		config, err := common.LoadClientConfig(path)
+		if err != nil {
+			return err
 		}
-	case "config":
-		if len(os.Args) < 3 {
-			log.Fatal().Msg("Usage: go-certdist config <server|client>")
+		return common.PrintEffectiveConfig(config)
+	default:
+		return fmt.Errorf("unknown config type %s", configType)
+	}
+}
+
+// validateConfig returns all problems of the configuration, including unknown fields
+// in the base file and the conf.d fragments.
+func validateConfig(configType string, path string) ([]error, error) {
+	switch configType {
+	case "server":
+		problems := common.CheckConfigLayers(path, &common.ServerModeConfig{})
+		config, err := common.LoadServerConfig(path)
+		if err != nil {
+			return append(problems, err), nil
 		}
-		switch os.Args[2] {
-		case "server":
-			common.WriteDummyServerConfig()
-		case "client":
-			common.WriteDummyClientConfig()
-		default:
-			log.Fatal().Str("command", os.Args[2]).Msg("Unknown config command")
+		return append(problems, server.ValidateConfig(config)...), nil
+	case "client":
+		problems := common.CheckConfigLayers(path, &common.ClientModeConfig{})
+		config, err := common.LoadClientConfig(path)
+		if err != nil {
+			return append(problems, err), nil
 		}
-	case "help":
-		printHelp()
+		return append(problems, client.ValidateConfig(context.Background(), config)...), nil
 	default:
-		printHelp()
-		log.Fatal().Str("command", os.Args[1]).Msg("Unknown command")
+		return nil, fmt.Errorf("unknown config type %s", configType)
 	}
 }
 
-func printHelp() {
-	fmt.Println(`go-certdist - A tool for distributing certificates.
+func printHelp(out io.Writer) {
+	_, _ = fmt.Fprint(out, `go-certdist - A tool for distributing certificates.
 
 Usage:
 
-	go-certdist <command> [arguments]
+	go-certdist [global options] <command> [options] [arguments]
 
 The commands are:
 
-	server <path>      start the server
-	client <path>      start the client
-	keygen             generate a new age key pair
-	config <type>      write a dummy config file (server or client)
-	help               print this help message
-	`)
+`)
+	for _, cmd := range commands(&globalOptions{}) {
+		_, _ = fmt.Fprintf(out, "\t%-10s %s\n", cmd.name, cmd.summary)
+	}
+	_, _ = fmt.Fprint(out, `
+The global options, also accepted by every command, are:
+
+	--log-level <level>    log level: trace, debug, info, warn or error
+	--log-format <format>  log format: console or json
+	--log-output <output>  log output: stdout, stderr or syslog
+
+Use "go-certdist help <command>" or "go-certdist <command> --help" for the options and
+arguments of a command.
+`)
 }
@@ -0,0 +1,61 @@
+package certdist
+
+import (
+	"context"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Artifact holds the files of a named artifact, e.g. DH parameters or session ticket keys.
+type Artifact struct {
+	Name string
+	// Version identifies the content of the files, send it with the next request.
+	Version string
+	// Files maps the file names to their contents.
+	Files map[string][]byte
+}
+
+// WriteFiles writes all files of the artifact to the directory, only readable by the owner.
+func (a *Artifact) WriteFiles(dir string) error {
+	return writeFiles(dir, a.Files, func([]byte) os.FileMode { return 0600 })
+}
+
+// FetchArtifact requests the files of the named artifact. It returns ErrNotModified if the
+// server still has the given version.
+func (c *Client) FetchArtifact(ctx context.Context, name string, currentVersion string) (*Artifact, error) {
+	reqBody := common.ArtifactRequest{
+		Name:          name,
+		AgePublicKey:  c.publicKey,
+		Version:       currentVersion,
+		ClientVersion: common.Version,
+	}
+	resp, err := c.post(ctx, common.ArtifactRequestEndpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	zipData, err := decrypt(data, c.identity)
+	if err != nil {
+		return nil, err
+	}
+	files, err := unzipFiles(zipData)
+	if err != nil {
+		return nil, err
+	}
+	return &Artifact{Name: name, Version: resp.Header.Get(common.ArtifactVersionHeader), Files: files}, nil
+}
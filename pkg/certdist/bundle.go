@@ -0,0 +1,215 @@
+package certdist
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxBundleFileSize limits the size of a single file in a bundle.
+const maxBundleFileSize = 1 << 20
+
+// Bundle holds the certificate files of a domain as delivered by the server.
+type Bundle struct {
+	Domain string
+	// Files maps the file names, e.g. fullchain.pem and privkey.pem, to their contents.
+	Files map[string][]byte
+	// Certificate is the leaf certificate of the domain.
+	Certificate *x509.Certificate
+	// Chain are the intermediate certificates, without the leaf.
+	Chain []*x509.Certificate
+	// PrivateKey of the leaf certificate, nil if the bundle doesn't contain one.
+	PrivateKey crypto.PrivateKey
+	// OCSP is the OCSP response fetched by the server for the leaf, nil if there is none.
+	OCSP *ocsp.Response
+}
+
+// TLSCertificate returns the bundle as certificate usable in a tls.Config.
+func (b *Bundle) TLSCertificate() (tls.Certificate, error) {
+	if b.PrivateKey == nil {
+		return tls.Certificate{}, fmt.Errorf("%w: no private key for %s", ErrInvalidBundle, b.Domain)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{b.Certificate.Raw},
+		PrivateKey:  b.PrivateKey,
+		Leaf:        b.Certificate,
+	}
+	if b.OCSP != nil {
+		cert.OCSPStaple = b.OCSP.Raw
+	}
+	for _, intermediate := range b.Chain {
+		cert.Certificate = append(cert.Certificate, intermediate.Raw)
+	}
+	return cert, nil
+}
+
+// WriteFiles writes all files of the bundle to the directory, private keys are only
+// readable by the owner.
+func (b *Bundle) WriteFiles(dir string) error {
+	return writeFiles(dir, b.Files, func(data []byte) os.FileMode {
+		if isPrivateKeyFile(data) {
+			return 0600
+		}
+		return 0644
+	})
+}
+
+func writeFiles(dir string, files map[string][]byte, fileMode func(data []byte) os.FileMode) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		mode := fileMode(data)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, mode); err != nil {
+			return err
+		}
+		// WriteFile keeps the mode of existing files
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptBundle decrypts and parses a bundle as returned by the certificate endpoint.
+func decryptBundle(domain string, data []byte, identity age.Identity) (*Bundle, error) {
+	zipData, err := decrypt(data, identity)
+	if err != nil {
+		return nil, err
+	}
+	return parseBundle(domain, zipData)
+}
+
+func decrypt(data []byte, identity age.Identity) ([]byte, error) {
+	decryptor, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt: %w", ErrInvalidBundle, err)
+	}
+	zipData, err := io.ReadAll(decryptor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read decrypted data: %w", ErrInvalidBundle, err)
+	}
+	return zipData, nil
+}
+
+func parseBundle(domain string, zipData []byte) (*Bundle, error) {
+	files, err := unzipFiles(zipData)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{Domain: domain, Files: files}
+	if err := bundle.parsePEM(); err != nil {
+		return nil, err
+	}
+	for name, data := range bundle.Files {
+		if !strings.HasSuffix(name, common.OCSPFileSuffix) {
+			continue
+		}
+		response, err := ocsp.ParseResponse(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to parse OCSP response %s: %w", ErrInvalidBundle, name, err)
+		}
+		bundle.OCSP = response
+	}
+	return bundle, nil
+}
+
+// unzipFiles returns the files of the zip archive by their base name.
+func unzipFiles(zipData []byte) (map[string][]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+	}
+
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxBundleFileSize+1))
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read %s: %w", ErrInvalidBundle, f.Name, err)
+		}
+		if len(data) > maxBundleFileSize {
+			return nil, fmt.Errorf("%w: file %s is too large", ErrInvalidBundle, f.Name)
+		}
+		// Never write outside the target directory
+		files[filepath.Base(f.Name)] = data
+	}
+	return files, nil
+}
+
+// parsePEM extracts the leaf, the intermediates and the private key from the files. The
+// same certificate is usually contained in more than one file, e.g. cert.pem and fullchain.pem.
+func (b *Bundle) parsePEM() error {
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var certificates []*x509.Certificate
+	for _, name := range names {
+		rest := b.Files[name]
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return fmt.Errorf("%w: failed to parse certificate in %s: %w", ErrInvalidBundle, name, err)
+				}
+				if !slices.ContainsFunc(certificates, cert.Equal) {
+					certificates = append(certificates, cert)
+				}
+			case strings.Contains(block.Type, "PRIVATE KEY") && b.PrivateKey == nil:
+				key, err := common.ParsePrivateKey(block.Bytes)
+				if err != nil {
+					return fmt.Errorf("%w: failed to parse private key in %s: %w", ErrInvalidBundle, name, err)
+				}
+				b.PrivateKey = key
+			}
+		}
+	}
+
+	if len(certificates) == 0 {
+		return fmt.Errorf("%w: no certificate for %s", ErrInvalidBundle, b.Domain)
+	}
+	// The leaf is the first non-CA certificate, self-signed certificates may be both
+	leaf := slices.IndexFunc(certificates, func(cert *x509.Certificate) bool { return !cert.IsCA })
+	if leaf < 0 {
+		leaf = 0
+	}
+	b.Certificate = certificates[leaf]
+	b.Chain = slices.Delete(certificates, leaf, leaf+1)
+	return nil
+}
+
+func isPrivateKeyFile(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && strings.Contains(block.Type, "PRIVATE KEY")
+}
@@ -0,0 +1,359 @@
+// Package certdist is a client library for go-certdist servers. It fetches and decrypts
+// certificate bundles without writing to disk or logging.
+package certdist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-certdist/common"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+// infoTimeout limits the request to the info endpoint used to negotiate the API version.
+const infoTimeout = 30 * time.Second
+
+// watchGracePeriod is added to the watch timeout for the server to respond.
+const watchGracePeriod = 30 * time.Second
+
+type endpoints struct {
+	version     string
+	certificate string
+	watch       string
+}
+
+var endpointsV1 = endpoints{version: "v1", certificate: common.CertificateRequestEndpoint, watch: common.WatchEndpoint}
+var endpointsV2 = endpoints{version: "v2", certificate: common.CertificateRequestEndpointV2, watch: common.WatchEndpointV2}
+
+// Client requests certificates from a certdist server. The API version is negotiated on
+// the first request and kept for the lifetime of the client.
+type Client struct {
+	// ServerURL is the base URL of the server, e.g. https://certdist.example.com
+	ServerURL string
+	// HTTPClient is used for all requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	identity  age.Identity
+	publicKey string
+
+	mu  sync.Mutex
+	api *endpoints
+}
+
+// Request describes the certificate a client currently has, so the server only sends a
+// bundle if it has a newer one.
+type Request struct {
+	Domain        string
+	CurrentExpiry time.Time // zero if the client has no certificate
+	CurrentSerial string    // hex encoded, optional
+	// OCSP asks the server to send the bundle again if it has an OCSP response newer than
+	// CurrentOCSPUpdate, the ThisUpdate of the response the client has. CurrentOCSPUpdate
+	// is zero if the client has no response.
+	OCSP              bool
+	CurrentOCSPUpdate time.Time
+	// CSR is a PEM encoded certificate signing request. The server then signs a certificate
+	// for it and the bundle doesn't contain a private key.
+	CSR []byte
+}
+
+// KeyConfig locates the age key of the client, the fields match the age_key section of the
+// client config. Exactly one of PrivateKey, PrivateKeyFile and SSHKeyFile has to be set.
+type KeyConfig struct {
+	PrivateKey           string
+	PrivateKeyFile       string
+	PassphraseFile       string // for a passphrase protected PrivateKeyFile
+	PassphraseCredential string // name of a systemd credential holding the passphrase
+	SSHKeyFile           string
+}
+
+// ServerInfo is the version and the capabilities reported by a server.
+type ServerInfo struct {
+	Version     string
+	APIVersions []string
+	Formats     []string
+	Features    []string
+}
+
+// WatchResult reports the current versions of the watched domains and the domains whose
+// version differs from the given one.
+type WatchResult struct {
+	Versions map[string]string
+	Changed  []string
+}
+
+// NewClient creates a client decrypting bundles with the identity. The public key has to
+// be one of the keys configured on the server.
+func NewClient(serverURL string, identity age.Identity, publicKey string) *Client {
+	return &Client{
+		ServerURL: strings.TrimSuffix(serverURL, "/"),
+		identity:  identity,
+		publicKey: common.NormalizePublicKey(publicKey),
+	}
+}
+
+// NewClientFromKey creates a client from an age_key configuration as used by the client config.
+func NewClientFromKey(serverURL string, keyConfig KeyConfig) (*Client, error) {
+	identity, publicKey, err := common.LoadAgeIdentity(common.AgeKeyConfig{
+		PrivateKey:           keyConfig.PrivateKey,
+		PrivateKeyFile:       keyConfig.PrivateKeyFile,
+		PassphraseFile:       keyConfig.PassphraseFile,
+		PassphraseCredential: keyConfig.PassphraseCredential,
+		SSHKeyFile:           keyConfig.SSHKeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(serverURL, identity, publicKey), nil
+}
+
+// Info returns the version and the capabilities of the server. It fails for servers only
+// supporting API v1.
+func (c *Client) Info(ctx context.Context) (*ServerInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, infoTimeout)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodGet, common.InfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	var info common.ServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode server info: %w", err)
+	}
+
+	api := endpointsV1
+	if slices.Contains(info.APIVersions, endpointsV2.version) {
+		api = endpointsV2
+	}
+	c.mu.Lock()
+	c.api = &api
+	c.mu.Unlock()
+	return &ServerInfo{
+		Version:     info.Version,
+		APIVersions: info.APIVersions,
+		Formats:     info.Formats,
+		Features:    info.Features,
+	}, nil
+}
+
+// Health returns the problems reported by the health endpoint of the server, none if the
+// server is healthy.
+func (c *Client) Health(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, infoTimeout)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodGet, common.HealthEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if lines[0] == "OK" {
+		return nil, nil
+	}
+	// DEGRADED followed by one problem per line
+	return lines[1:], nil
+}
+
+// APIVersion returns the negotiated API version, e.g. "v2".
+func (c *Client) APIVersion(ctx context.Context) string {
+	return c.endpoints(ctx).version
+}
+
+// endpoints returns the endpoints of the best API version supported by the server. Servers
+// without the info endpoint only support v1.
+func (c *Client) endpoints(ctx context.Context) endpoints {
+	c.mu.Lock()
+	api := c.api
+	c.mu.Unlock()
+	if api != nil {
+		return *api
+	}
+
+	if _, err := c.Info(ctx); err != nil {
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) && (serverErr.StatusCode == http.StatusNotFound || serverErr.StatusCode == http.StatusMethodNotAllowed) {
+			c.mu.Lock()
+			c.api = &endpointsV1
+			c.mu.Unlock()
+		}
+		// otherwise try again with the next request
+		return endpointsV1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.api
+}
+
+// Fetch requests the certificate bundle of the domain. It returns ErrNotModified if the
+// server has no certificate expiring later than currentExpiry, newer OCSP responses alone
+// are not fetched.
+func (c *Client) Fetch(ctx context.Context, domain string, currentExpiry time.Time) (*Bundle, error) {
+	return c.Do(ctx, Request{Domain: domain, CurrentExpiry: currentExpiry})
+}
+
+// Do is like Fetch, but also reports the serial number of the current certificate and
+// optionally asks for newer OCSP responses.
+func (c *Client) Do(ctx context.Context, request Request) (*Bundle, error) {
+	data, err := c.fetchEncrypted(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return c.DecryptBundle(request.Domain, data)
+}
+
+// DecryptBundle decrypts a bundle as returned by the server, e.g. one kept in a cache.
+func (c *Client) DecryptBundle(domain string, data []byte) (*Bundle, error) {
+	return decryptBundle(domain, data, c.identity)
+}
+
+// fetchEncrypted returns the still encrypted bundle of the domain.
+func (c *Client) fetchEncrypted(ctx context.Context, request Request) ([]byte, error) {
+	reqBody := common.CertificateRequest{
+		Domain:         request.Domain,
+		AgePublicKey:   c.publicKey,
+		Expiration:     request.CurrentExpiry,
+		SerialNumber:   request.CurrentSerial,
+		ClientVersion:  common.Version,
+		OCSP:           request.OCSP,
+		OCSPThisUpdate: request.CurrentOCSPUpdate,
+		CSR:            string(request.CSR),
+	}
+	resp, err := c.post(ctx, c.endpoints(ctx).certificate, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return data, nil
+}
+
+// Watch long-polls the server until one of the domains has a version different from the
+// given versions, or the timeout elapsed. The timeout is rounded up to full seconds, at least
+// one. It returns ErrWatchUnsupported for old servers.
+func (c *Client) Watch(ctx context.Context, domains []string, versions map[string]string, timeout time.Duration) (*WatchResult, error) {
+	seconds := max(int(math.Ceil(timeout.Seconds())), 1)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second+watchGracePeriod)
+	defer cancel()
+
+	reqBody := common.WatchRequest{
+		Domains:        domains,
+		AgePublicKey:   c.publicKey,
+		Versions:       versions,
+		TimeoutSeconds: seconds,
+	}
+	resp, err := c.post(ctx, c.endpoints(ctx).watch, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, ErrWatchUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var watchResp common.WatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&watchResp); err != nil {
+		return nil, fmt.Errorf("failed to decode watch response: %w", err)
+	}
+	return &WatchResult{Versions: watchResp.Versions, Changed: watchResp.Changed}, nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, body any) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.httpClient().Do(req)
+}
+
+// newRequest creates a request to the endpoint, passing on the request ID of the context.
+func (c *Client) newRequest(ctx context.Context, method string, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.ServerURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(common.RequestIDHeader, id)
+	}
+	return req, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// responseError turns an unexpected response into a *ServerError, using the JSON error
+// body of API v2 if present.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	serverErr := &ServerError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		RequestID:  resp.Header.Get(common.RequestIDHeader),
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var apiErr common.APIError
+		if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Code != "" {
+			serverErr.Code = apiErr.Code
+			serverErr.Message = apiErr.Message
+			if apiErr.RequestId != "" {
+				serverErr.RequestID = apiErr.RequestId
+			}
+		}
+	}
+	return serverErr
+}
@@ -0,0 +1,230 @@
+package certdist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-certdist/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer serves the certificate of the domain encrypted to the public key, on the
+// endpoints of the given API version.
+func newTestServer(t *testing.T, apiVersion string, domain string, publicKey string) (*httptest.Server, *[]string) {
+	t.Helper()
+	dir := t.TempDir()
+	common.NewTestCertificate(t, dir, domain, time.Now().Add(30*24*time.Hour))
+	certs := common.LoadCertificates([]string{dir})[0].Certificates
+	require.Len(t, certs, 2)
+	bundle, err := common.EncryptAndZipCertificates(certs, publicKey)
+	require.NoError(t, err)
+
+	var paths []string
+	mux := http.NewServeMux()
+	if apiVersion == "v2" {
+		mux.HandleFunc(common.InfoEndpoint, func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(common.ServerInfo{Version: "test", APIVersions: []string{"v1", "v2"}})
+		})
+	}
+	certificateHandler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var req common.CertificateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.AgePublicKey != publicKey {
+			if apiVersion == "v2" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"code":"forbidden","message":"Public key not authorized","request_id":"abc"}`))
+				return
+			}
+			http.Error(w, "Public key not authorized", http.StatusForbidden)
+			return
+		}
+		if !req.Expiration.IsZero() {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(bundle)
+	}
+	mux.HandleFunc(common.CertificateRequestEndpoint, certificateHandler)
+	if apiVersion == "v2" {
+		mux.HandleFunc(common.CertificateRequestEndpointV2, certificateHandler)
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &paths
+}
+
+func newTestClient(t *testing.T, serverURL string) *Client {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	return NewClient(serverURL, identity, identity.Recipient().String())
+}
+
+func TestNewClientFromKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+
+	client, err := NewClientFromKey(srv.URL, KeyConfig{PrivateKey: identity.String()})
+	require.NoError(t, err)
+	info, err := client.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &ServerInfo{Version: "test", APIVersions: []string{"v1", "v2"}}, info)
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	assert.NoError(t, err)
+}
+
+func TestFetchV2(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, paths := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	client := NewClient(srv.URL+"/", identity, identity.Recipient().String())
+
+	bundle, err := client.Fetch(context.Background(), "example.com", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{common.CertificateRequestEndpointV2}, *paths)
+	assert.Equal(t, "v2", client.APIVersion(context.Background()))
+
+	assert.Equal(t, []string{"example.com"}, bundle.Certificate.DNSNames)
+	assert.Empty(t, bundle.Chain)
+	assert.NotNil(t, bundle.PrivateKey)
+	assert.Contains(t, bundle.Files, "cert.pem")
+	assert.Contains(t, bundle.Files, "privkey.pem")
+
+	tlsCert, err := bundle.TLSCertificate()
+	require.NoError(t, err)
+	assert.Len(t, tlsCert.Certificate, 1)
+	assert.Equal(t, bundle.Certificate, tlsCert.Leaf)
+
+	dir := filepath.Join(t.TempDir(), "example.com")
+	require.NoError(t, bundle.WriteFiles(dir))
+	info, err := os.Stat(filepath.Join(dir, "privkey.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, "cert.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestFetchFallsBackToV1(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, paths := newTestServer(t, "v1", "example.com", identity.Recipient().String())
+	client := NewClient(srv.URL, identity, identity.Recipient().String())
+
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{common.CertificateRequestEndpoint}, *paths)
+	assert.Equal(t, "v1", client.APIVersion(context.Background()))
+}
+
+func TestFetchNotModified(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	client := NewClient(srv.URL, identity, identity.Recipient().String())
+
+	_, err = client.Fetch(context.Background(), "example.com", time.Now().Add(60*24*time.Hour))
+	assert.ErrorIs(t, err, ErrNotModified)
+}
+
+func TestFetchForbidden(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	for _, apiVersion := range []string{"v1", "v2"} {
+		t.Run(apiVersion, func(t *testing.T) {
+			srv, _ := newTestServer(t, apiVersion, "example.com", identity.Recipient().String())
+			client := newTestClient(t, srv.URL)
+
+			_, err := client.Fetch(context.Background(), "example.com", time.Time{})
+			assert.ErrorIs(t, err, ErrForbidden)
+			var serverErr *ServerError
+			require.True(t, errors.As(err, &serverErr))
+			assert.Equal(t, http.StatusForbidden, serverErr.StatusCode)
+			assert.Equal(t, "Public key not authorized", serverErr.Message)
+			if apiVersion == "v2" {
+				assert.Equal(t, common.ErrorCodeForbidden, serverErr.Code)
+				assert.Equal(t, "abc", serverErr.RequestID)
+			}
+		})
+	}
+}
+
+func TestFetchWrongIdentity(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	// Claims the public key of the authorized identity, but can't decrypt the bundle
+	client := NewClient(srv.URL, other, identity.Recipient().String())
+
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+}
+
+func TestWatchUnsupported(t *testing.T) {
+	client := newTestClient(t, "")
+	srv, _ := newTestServer(t, "v1", "example.com", client.publicKey)
+	client.ServerURL = srv.URL
+
+	_, err := client.Watch(context.Background(), []string{"example.com"}, nil, time.Second)
+	assert.ErrorIs(t, err, ErrWatchUnsupported)
+}
+
+func TestWatchTimeoutRoundedUp(t *testing.T) {
+	var received []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req common.WatchRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		received = append(received, req.TimeoutSeconds)
+		_ = json.NewEncoder(w).Encode(common.WatchResponse{})
+	}))
+	defer srv.Close()
+	client := newTestClient(t, srv.URL)
+	client.api = &endpointsV2
+
+	for _, timeout := range []time.Duration{0, 500 * time.Millisecond, 1500 * time.Millisecond} {
+		_, err := client.Watch(context.Background(), []string{"example.com"}, nil, timeout)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []int{1, 1, 2}, received)
+}
+
+func TestRequestID(t *testing.T) {
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get(common.RequestIDHeader))
+		w.Header().Set(common.RequestIDHeader, "server-id")
+		http.Error(w, "Public key not authorized", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	client := newTestClient(t, srv.URL)
+	client.api = &endpointsV1
+
+	// The ID of the context is sent to the server
+	_, err := client.Fetch(WithRequestID(context.Background(), "client-id"), "example.com", time.Time{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"client-id"}, received)
+
+	// The ID of the response header is reported for plain text errors
+	var serverErr *ServerError
+	require.True(t, errors.As(err, &serverErr))
+	assert.Equal(t, "server-id", serverErr.RequestID)
+	assert.Contains(t, err.Error(), "(request_id server-id)")
+
+	_, err = client.Fetch(context.Background(), "example.com", time.Time{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"client-id", ""}, received)
+}
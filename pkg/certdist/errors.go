@@ -0,0 +1,55 @@
+package certdist
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotModified is returned by Fetch if the client already has the current certificate.
+	ErrNotModified = errors.New("certdist: certificate not modified")
+	// ErrForbidden is matched by server errors for keys that may not request the domain.
+	ErrForbidden = errors.New("certdist: forbidden")
+	// ErrNotFound is matched by server errors for domains without a certificate on the server.
+	ErrNotFound = errors.New("certdist: certificate not found")
+	// ErrWatchUnsupported is returned by Watch if the server can't watch for changes.
+	ErrWatchUnsupported = errors.New("certdist: server does not support watching for changes")
+	// ErrInvalidBundle is matched by errors of bundles that can't be decrypted or parsed.
+	ErrInvalidBundle = errors.New("certdist: invalid bundle")
+)
+
+// ServerError is returned for unexpected responses of the server. Code is only set by
+// servers supporting API v2, RequestID by servers returning the X-Request-ID header.
+type ServerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *ServerError) Error() string {
+	msg := fmt.Sprintf("certdist: server responded with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request_id %s)", e.RequestID)
+	}
+	return msg
+}
+
+// Unwrap allows matching the error with errors.Is against ErrForbidden and ErrNotFound.
+func (e *ServerError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return nil
+	}
+}
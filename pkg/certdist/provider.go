@@ -0,0 +1,248 @@
+package certdist
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultProviderRefreshInterval = time.Hour
+
+// providerWatchTimeout is below the maximum the server allows for a single watch request.
+const providerWatchTimeout = 55 * time.Second
+
+const providerRetryDelay = time.Minute
+
+// ProviderOptions configures a Provider.
+type ProviderOptions struct {
+	// RefreshInterval defines how often the server is asked for a newer certificate, one
+	// hour by default, and more often for short-lived certificates. Changes reported by the
+	// server are fetched immediately.
+	RefreshInterval time.Duration
+	// CacheFile stores the last bundle, still encrypted to the client's key, so the
+	// certificate is available on a cold start while the server is unreachable.
+	CacheFile string
+	// OnError is called for errors of background refreshes, the last good certificate is
+	// kept in use.
+	OnError func(err error)
+}
+
+// Provider keeps the certificate of a domain in memory for a tls.Config, stapling the OCSP
+// response if the server provides one:
+//
+//	provider := certdist.NewProvider(client, "example.com", certdist.ProviderOptions{})
+//	if err := provider.Load(ctx); err != nil { ... }
+//	go provider.Run(ctx)
+//	tlsConfig := &tls.Config{GetCertificate: provider.GetCertificate}
+type Provider struct {
+	client  *Client
+	domain  string
+	options ProviderOptions
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	ocspUpdate  time.Time
+	fromCache   bool // the certificate was loaded from the cache file and may be stale
+}
+
+// NewProvider creates a provider for the certificate of the domain.
+func NewProvider(client *Client, domain string, options ProviderOptions) *Provider {
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = defaultProviderRefreshInterval
+	}
+	return &Provider{client: client, domain: domain, options: options}
+}
+
+// Load fetches the certificate from the server. If the server is unreachable, the cached
+// bundle is used instead unless its certificate expired; it only fails if neither is
+// available. Run then fetches the certificate right away.
+func (p *Provider) Load(ctx context.Context) error {
+	err := p.Refresh(ctx)
+	if err == nil || p.options.CacheFile == "" {
+		return err
+	}
+
+	data, cacheErr := os.ReadFile(p.options.CacheFile)
+	if cacheErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to read cache file: %w", cacheErr))
+	}
+	certificate, ocspUpdate, cacheErr := p.decrypt(data)
+	if cacheErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to use cache file: %w", cacheErr))
+	}
+	if notAfter := certificate.Leaf.NotAfter; !time.Now().Before(notAfter) {
+		return errors.Join(err, fmt.Errorf("cached certificate expired at %s", notAfter.Format(time.RFC3339)))
+	}
+	p.set(certificate, ocspUpdate, true)
+	p.reportError(err)
+	return nil
+}
+
+// Refresh asks the server for a newer certificate and uses it. The current certificate is
+// kept on errors.
+func (p *Provider) Refresh(ctx context.Context) error {
+	request := Request{Domain: p.domain, OCSP: true}
+	if current := p.current(); current != nil {
+		request.CurrentExpiry = current.Leaf.NotAfter
+		p.mu.RLock()
+		request.CurrentOCSPUpdate = p.ocspUpdate
+		p.mu.RUnlock()
+	}
+
+	data, err := p.client.fetchEncrypted(ctx, request)
+	if errors.Is(err, ErrNotModified) {
+		p.mu.Lock()
+		p.fromCache = false
+		p.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	certificate, ocspUpdate, err := p.decrypt(data)
+	if err != nil {
+		return err
+	}
+	p.set(certificate, ocspUpdate, false)
+	if p.options.CacheFile != "" {
+		if err := writeCacheFile(p.options.CacheFile, data); err != nil {
+			return fmt.Errorf("failed to write cache file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the certificate in the background until the context is cancelled. It
+// watches the server for changes if supported and otherwise polls every RefreshInterval.
+func (p *Provider) Run(ctx context.Context) {
+	versions := make(map[string]string)
+	watch := true
+	nextRefresh := p.nextRefresh()
+	for ctx.Err() == nil {
+		if !time.Now().Before(nextRefresh) {
+			if err := p.Refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				p.reportError(err)
+				nextRefresh = time.Now().Add(min(providerRetryDelay, p.options.RefreshInterval))
+			} else {
+				nextRefresh = p.nextRefresh()
+			}
+		}
+
+		if watch {
+			resp, err := p.client.Watch(ctx, []string{p.domain}, versions, min(providerWatchTimeout, time.Until(nextRefresh)))
+			switch {
+			case errors.Is(err, ErrWatchUnsupported):
+				watch = false
+			case err != nil:
+				if ctx.Err() == nil {
+					p.reportError(err)
+				}
+				sleep(ctx, min(providerRetryDelay, time.Until(nextRefresh)))
+			default:
+				// The first response only establishes the current versions
+				baseline := len(versions) == 0
+				maps.Copy(versions, resp.Versions)
+				if !baseline && len(resp.Changed) > 0 {
+					nextRefresh = time.Now()
+				}
+			}
+		} else {
+			sleep(ctx, time.Until(nextRefresh))
+		}
+	}
+}
+
+// nextRefresh returns when the server is asked for a newer certificate next: right away if
+// the certificate was loaded from the cache, otherwise after RefreshInterval but at the
+// latest half way to the expiry of the certificate.
+func (p *Provider) nextRefresh() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.certificate == nil || p.fromCache {
+		return time.Now()
+	}
+	untilExpiry := time.Until(p.certificate.Leaf.NotAfter)
+	return time.Now().Add(min(p.options.RefreshInterval, max(untilExpiry/2, providerRetryDelay)))
+}
+
+// GetCertificate returns the current certificate, it can be used as tls.Config.GetCertificate.
+func (p *Provider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current := p.current()
+	if current == nil {
+		return nil, fmt.Errorf("certdist: no certificate loaded for %s", p.domain)
+	}
+	return current, nil
+}
+
+func (p *Provider) current() *tls.Certificate {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.certificate
+}
+
+// decrypt returns the certificate of the bundle and the ThisUpdate of its OCSP response.
+func (p *Provider) decrypt(data []byte) (*tls.Certificate, time.Time, error) {
+	bundle, err := p.client.DecryptBundle(p.domain, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	certificate, err := bundle.TLSCertificate()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var ocspUpdate time.Time
+	if bundle.OCSP != nil {
+		ocspUpdate = bundle.OCSP.ThisUpdate
+	}
+	return &certificate, ocspUpdate, nil
+}
+
+// set replaces the current certificate.
+func (p *Provider) set(certificate *tls.Certificate, ocspUpdate time.Time, fromCache bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.certificate = certificate
+	p.ocspUpdate = ocspUpdate
+	p.fromCache = fromCache
+}
+
+func (p *Provider) reportError(err error) {
+	if p.options.OnError != nil {
+		p.options.OnError(err)
+	}
+}
+
+// writeCacheFile replaces the cache file atomically.
+func writeCacheFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".certdist-cache-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,163 @@
+package certdist
+
+import (
+	"context"
+	"go-certdist/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderLoadsFromServer(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	provider := NewProvider(NewClient(srv.URL, identity, identity.Recipient().String()), "example.com", ProviderOptions{})
+
+	_, err = provider.GetCertificate(nil)
+	assert.Error(t, err)
+
+	require.NoError(t, provider.Load(context.Background()))
+	certificate, err := provider.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, certificate.Leaf.DNSNames)
+
+	// The server responds with 304 as the client already has the certificate
+	require.NoError(t, provider.Refresh(context.Background()))
+	again, err := provider.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, certificate, again)
+}
+
+func TestProviderKeepsLastGoodCertificate(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	provider := NewProvider(NewClient(srv.URL, identity, identity.Recipient().String()), "example.com", ProviderOptions{})
+	require.NoError(t, provider.Load(context.Background()))
+
+	srv.Close()
+	assert.Error(t, provider.Refresh(context.Background()))
+	certificate, err := provider.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, certificate.Leaf.DNSNames)
+}
+
+func TestProviderColdStartFromCache(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	cacheFile := filepath.Join(t.TempDir(), "example.com.age")
+	srv, _ := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+	client := NewClient(srv.URL, identity, identity.Recipient().String())
+	require.NoError(t, NewProvider(client, "example.com", ProviderOptions{CacheFile: cacheFile}).Load(context.Background()))
+	srv.Close()
+
+	var reported []error
+	provider := NewProvider(client, "example.com", ProviderOptions{
+		CacheFile: cacheFile,
+		OnError:   func(err error) { reported = append(reported, err) },
+	})
+	require.NoError(t, provider.Load(context.Background()))
+	assert.Len(t, reported, 1)
+	certificate, err := provider.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, certificate.Leaf.DNSNames)
+
+	// Without cache the provider can't start
+	provider = NewProvider(client, "example.com", ProviderOptions{CacheFile: filepath.Join(t.TempDir(), "missing.age")})
+	assert.Error(t, provider.Load(context.Background()))
+}
+
+// newTestBundle returns a bundle of a certificate for example.com encrypted to the public key.
+func newTestBundle(t *testing.T, publicKey string, expiry time.Time) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	common.NewTestCertificate(t, dir, "example.com", expiry)
+	data, err := common.EncryptAndZipCertificates(common.LoadCertificates([]string{dir})[0].Certificates, publicKey)
+	require.NoError(t, err)
+	return data
+}
+
+func TestProviderRejectsExpiredCache(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	cacheFile := filepath.Join(t.TempDir(), "example.com.age")
+	require.NoError(t, os.WriteFile(cacheFile, newTestBundle(t, identity.Recipient().String(), time.Now().Add(-time.Hour)), 0600))
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	provider := NewProvider(NewClient(down.URL, identity, identity.Recipient().String()), "example.com", ProviderOptions{CacheFile: cacheFile})
+	err = provider.Load(context.Background())
+	assert.ErrorContains(t, err, "cached certificate expired")
+	_, err = provider.GetCertificate(nil)
+	assert.Error(t, err)
+}
+
+func TestProviderRefreshesAfterColdStart(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	cacheFile := filepath.Join(t.TempDir(), "example.com.age")
+	require.NoError(t, os.WriteFile(cacheFile, newTestBundle(t, identity.Recipient().String(), time.Now().Add(24*time.Hour)), 0600))
+	srv, paths := newTestServer(t, "v2", "example.com", identity.Recipient().String())
+
+	client := NewClient(srv.URL+"/unreachable", identity, identity.Recipient().String())
+	provider := NewProvider(client, "example.com", ProviderOptions{CacheFile: cacheFile, OnError: func(error) {}})
+	require.NoError(t, provider.Load(context.Background()))
+	require.Empty(t, *paths)
+
+	// The cached certificate may be stale, Run asks the server right away instead of after
+	// RefreshInterval
+	client.ServerURL = srv.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	provider.Run(ctx)
+	assert.Len(t, *paths, 1)
+}
+
+func TestProviderRefreshBeforeExpiry(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	provider := NewProvider(NewClient("", identity, identity.Recipient().String()), "example.com", ProviderOptions{})
+
+	certificate, ocspUpdate, err := provider.decrypt(newTestBundle(t, identity.Recipient().String(), time.Now().Add(30*24*time.Hour)))
+	require.NoError(t, err)
+	provider.set(certificate, ocspUpdate, false)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), provider.nextRefresh(), time.Minute)
+
+	// Short-lived certificates are refreshed half way to their expiry
+	certificate, ocspUpdate, err = provider.decrypt(newTestBundle(t, identity.Recipient().String(), time.Now().Add(40*time.Minute)))
+	require.NoError(t, err)
+	provider.set(certificate, ocspUpdate, false)
+	assert.WithinDuration(t, time.Now().Add(20*time.Minute), provider.nextRefresh(), time.Minute)
+}
+
+func TestProviderRunStopsWithContext(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, "v1", "example.com", identity.Recipient().String())
+	provider := NewProvider(NewClient(srv.URL, identity, identity.Recipient().String()), "example.com", ProviderOptions{RefreshInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		provider.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	// The first refresh fetched the certificate
+	_, err = provider.GetCertificate(nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,26 @@
+package certdist
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose requests send the ID to the server, which logs
+// them under this ID. Without an ID the server chooses one, it is reported in ServerError.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID set by WithRequestID, empty if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random ID in the format the server uses.
+func NewRequestID() string {
+	return fmt.Sprintf("%x", rand.Uint32())
+}